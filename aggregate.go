@@ -0,0 +1,406 @@
+// This handles aggregations, which count and sum the records in a table without sending the records anywhere. A aggregation is a JSON object like:
+//   {"filter": {"status": "open"}, "group_by": ["customer.country"], "accumulators": {"orders": {"$count": true}, "revenue": {"$sum": "total"}}}
+// The filter is optional and picks the records like a filter query does (see query.go). Each group_by key is a index key path (see index_path.go), and records are grouped by the values they have at those paths. A record without the key is grouped under null.
+// Each accumulator works out one value for each group:
+//   - $count counts the records. If it is given a path instead of true, it only counts the records which have that key.
+//   - $sum and $avg add up the numbers at the path. Values which aren't numbers are skipped, and $avg is null if there are no numbers.
+//   - $min and $max find the smallest and largest value at the path. Numbers are smaller than strings, and anything else is skipped.
+// Each shard aggregates its own records and sends back a partial result for each group, which the shard asking merges. Only the groups cross the network.
+// With replicas, a record is only aggregated by the first shard which holds it (see HandleShardCalculation), so it is never counted twice.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Defines the accumulators a aggregation can use.
+const (
+	AggregateCount = "$count"
+	AggregateSum   = "$sum"
+	AggregateAvg   = "$avg"
+	AggregateMin   = "$min"
+	AggregateMax   = "$max"
+)
+
+// The most keys a aggregation can be grouped by.
+const AggregateMaxGroupBy = 10
+
+// The most groups a aggregation can have, both on each shard and once the groups from every shard are merged.
+const AggregateMaxGroups = 10000
+
+// The error which is returned when a aggregation has more than AggregateMaxGroups groups.
+var ErrTooManyGroups = errors.New("The aggregation has more than " + strconv.Itoa(AggregateMaxGroups) + " groups.")
+
+// Defines a aggregation.
+type AggregateQuery struct {
+	Filter       interface{}            `json:"filter,omitempty"`
+	GroupBy      []string               `json:"group_by,omitempty"`
+	Accumulators map[string]interface{} `json:"accumulators"`
+}
+
+// Defines a parsed accumulator. Key is empty if a $count counts every record.
+type Accumulator struct {
+	Name string
+	Op   string
+	Key  string
+}
+
+// Defines a parsed aggregation. The accumulators are sorted by name.
+type ParsedAggregate struct {
+	Filter       *Filter
+	GroupBy      []string
+	Accumulators []*Accumulator
+}
+
+// Parses a aggregation.
+func (q *AggregateQuery) Parse() (*ParsedAggregate, error) {
+	f, err := (&FilterQuery{Filter: q.Filter}).ParsedFilter()
+	if err != nil {
+		return nil, err
+	}
+	Parsed := &ParsedAggregate{Filter: f, GroupBy: q.GroupBy, Accumulators: make([]*Accumulator, 0, len(q.Accumulators))}
+	if Parsed.GroupBy == nil {
+		Parsed.GroupBy = []string{}
+	}
+	if len(Parsed.GroupBy) > AggregateMaxGroupBy {
+		return nil, errors.New("A aggregation can be grouped by at most " + strconv.Itoa(AggregateMaxGroupBy) + " keys.")
+	}
+	for _, v := range Parsed.GroupBy {
+		if _, err := ParseIndexPath(v); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parses each accumulator.
+	if len(q.Accumulators) == 0 {
+		return nil, errors.New("A aggregation must have at least one accumulator.")
+	}
+	for Name, Raw := range q.Accumulators {
+		Object, ok := Raw.(map[string]interface{})
+		if !ok || len(Object) != 1 {
+			return nil, errors.New(`The accumulator "` + Name + `" must be a object with one operator.`)
+		}
+		for Op, Value := range Object {
+			a := &Accumulator{Name: Name, Op: Op}
+			switch Op {
+			case AggregateCount:
+				if b, ok := Value.(bool); ok && b {
+					break
+				}
+				fallthrough
+			case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+				Key, ok := Value.(string)
+				if !ok {
+					return nil, errors.New(`The "` + Op + `" in the accumulator "` + Name + `" must be a key path.`)
+				}
+				if _, err := ParseIndexPath(Key); err != nil {
+					return nil, err
+				}
+				a.Key = Key
+			default:
+				if strings.HasPrefix(Op, "$") {
+					return nil, errors.New(`The accumulator operator "` + Op + `" does not exist.`)
+				}
+				return nil, errors.New(`The accumulator "` + Name + `" must be a object with one operator.`)
+			}
+			Parsed.Accumulators = append(Parsed.Accumulators, a)
+		}
+	}
+	sort.Slice(Parsed.Accumulators, func(a, b int) bool {
+		return Parsed.Accumulators[a].Name < Parsed.Accumulators[b].Name
+	})
+	return Parsed, nil
+}
+
+// Checks if a value which $min or $max can use is smaller than another. Numbers are smaller than strings.
+func AggregateLess(A interface{}, B interface{}) bool {
+	if Compared, ok := FilterCompare(A, B); ok {
+		return Compared < 0
+	}
+	_, ok := A.(float64)
+	return ok
+}
+
+// Defines the partial value of one accumulator in a group. This is what shards send back, so it can be merged with the same accumulator from another shard.
+type AggregateState struct {
+	Count   int         `json:"c,omitempty"`
+	Sum     float64     `json:"s,omitempty"`
+	Numbers int         `json:"n,omitempty"`
+	Min     interface{} `json:"min,omitempty"`
+	Max     interface{} `json:"max,omitempty"`
+}
+
+// Adds a value to the state.
+func (s *AggregateState) Add(Value interface{}) {
+	s.Count++
+	switch v := Value.(type) {
+	case float64:
+		s.Sum += v
+		s.Numbers++
+	case string:
+	default:
+		return
+	}
+	if s.Min == nil || AggregateLess(Value, s.Min) {
+		s.Min = Value
+	}
+	if s.Max == nil || AggregateLess(s.Max, Value) {
+		s.Max = Value
+	}
+}
+
+// Merges the state from another shard into this one.
+func (s *AggregateState) Merge(Other *AggregateState) {
+	s.Count += Other.Count
+	s.Sum += Other.Sum
+	s.Numbers += Other.Numbers
+	if Other.Min != nil && (s.Min == nil || AggregateLess(Other.Min, s.Min)) {
+		s.Min = Other.Min
+	}
+	if Other.Max != nil && (s.Max == nil || AggregateLess(s.Max, Other.Max)) {
+		s.Max = Other.Max
+	}
+}
+
+// Gets the final value of a accumulator from its state.
+func (a *Accumulator) Result(s *AggregateState) interface{} {
+	switch a.Op {
+	case AggregateCount:
+		return s.Count
+	case AggregateSum:
+		return s.Sum
+	case AggregateAvg:
+		if s.Numbers == 0 {
+			return nil
+		}
+		return s.Sum / float64(s.Numbers)
+	case AggregateMin:
+		return s.Min
+	default:
+		return s.Max
+	}
+}
+
+// Defines the partial result for one group. The states are in the same order as the accumulators.
+type AggregatePartial struct {
+	Group  []interface{}     `json:"group"`
+	States []*AggregateState `json:"states"`
+}
+
+// Gets the values of a record to group it by.
+func (p *ParsedAggregate) GroupFor(Record map[string]interface{}) []interface{} {
+	Group := make([]interface{}, len(p.GroupBy))
+	for i, k := range p.GroupBy {
+		Group[i], _ = LookupIndexKey(Record, k)
+	}
+	return Group
+}
+
+// Gets the string a group is stored under.
+func AggregateGroupKey(Group []interface{}) string {
+	b, err := json.Marshal(Group)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// Adds a record to its group.
+func (p *ParsedAggregate) Add(Groups map[string]*AggregatePartial, Record map[string]interface{}) {
+	Group := p.GroupFor(Record)
+	GroupKey := AggregateGroupKey(Group)
+	Partial := Groups[GroupKey]
+	if Partial == nil {
+		Partial = &AggregatePartial{Group: Group, States: make([]*AggregateState, len(p.Accumulators))}
+		for i := range Partial.States {
+			Partial.States[i] = &AggregateState{}
+		}
+		Groups[GroupKey] = Partial
+	}
+	for i, a := range p.Accumulators {
+		if a.Key == "" {
+			Partial.States[i].Count++
+			continue
+		}
+		Value, Exists := LookupIndexKey(Record, a.Key)
+		if Exists {
+			Partial.States[i].Add(Value)
+		}
+	}
+}
+
+// Aggregates the records on this shard. If Owner is not empty, only the records which Owner is the first shard for are aggregated.
+func (d *DBCore) Aggregate(DatabaseName string, TableName string, Query *AggregateQuery, Owner string) ([]*AggregatePartial, error) {
+	Parsed, err := Query.Parse()
+	if err != nil {
+		return nil, err
+	}
+	Plan, err := d.PlanQuery(DatabaseName, TableName, Parsed.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Adds each record which matches to its group. Records which have gone or expired are skipped.
+	Replicas := 0
+	if Owner != "" {
+		Replicas = GetReplicas(DatabaseName, TableName)
+	}
+	Groups := map[string]*AggregatePartial{}
+	for _, k := range d.PlanKeys(DatabaseName, TableName, Plan) {
+		if Owner != "" && HandleShardCalculation(k, ShardInstance.Shards, Replicas)[0] != Owner {
+			continue
+		}
+		Item, _, err := d.GetWithMeta(DatabaseName, TableName, k)
+		if err != nil {
+			continue
+		}
+		Record, ok := (*Item).(map[string]interface{})
+		if !ok || !Parsed.Filter.Matches(Record) {
+			continue
+		}
+		Parsed.Add(Groups, Record)
+		if len(Groups) > AggregateMaxGroups {
+			return nil, ErrTooManyGroups
+		}
+	}
+	Partials := make([]*AggregatePartial, 0, len(Groups))
+	for _, v := range Groups {
+		Partials = append(Partials, v)
+	}
+	return Partials, nil
+}
+
+// Defines a row in the result of a aggregation. Group has the value of each group_by key, and Values has the result of each accumulator.
+type AggregateRow struct {
+	Group  map[string]interface{} `json:"group"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// The remote aggregation structure.
+type RemoteAggregateStructure struct {
+	AggregateQuery
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Owner string `json:"owner"`
+}
+
+// The response from a remote shard after a aggregation.
+type RemoteAggregateResponse struct {
+	Err *string `json:"error"`
+	Partials []*AggregatePartial `json:"partials"`
+}
+
+// Runs a aggregation on one shard.
+func (s *Shard) AggregateOnShard(ShardID string, Query *RemoteAggregateStructure) ([]*AggregatePartial, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.Aggregate(Query.DB, Query.Table, &Query.AggregateQuery, Query.Owner)
+	}
+	var Response RemoteAggregateResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/aggregate", Query, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Partials, nil
+}
+
+// Runs a aggregation on every shard in parallel and merges the partial results. The rows are sorted by their group.
+func (s *Shard) Aggregate(DatabaseName string, TableName string, Query *AggregateQuery) ([]*AggregateRow, error) {
+	Parsed, err := Query.Parse()
+	if err != nil {
+		return nil, err
+	}
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before aggregating records.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Gets the partial results from each shard and merges the states of each group.
+	Groups := map[string]*AggregatePartial{}
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Partials, err := s.AggregateOnShard(ShardID, &RemoteAggregateStructure{
+				AggregateQuery: *Query,
+				DB: DatabaseName,
+				Table: TableName,
+				Owner: ShardID,
+			})
+			ResultsLock.Lock()
+			defer ResultsLock.Unlock()
+			if err != nil {
+				Failed = err
+				return
+			}
+			if Failed != nil {
+				return
+			}
+			for _, v := range Partials {
+				if len(v.States) != len(Parsed.Accumulators) || len(v.Group) != len(Parsed.GroupBy) {
+					Failed = errors.New("A shard sent back a partial result which doesn't match the aggregation.")
+					return
+				}
+				GroupKey := AggregateGroupKey(v.Group)
+				Existing := Groups[GroupKey]
+				if Existing == nil {
+					// Each shard can have up to the limit, so the merged groups are checked as well.
+					if len(Groups) == AggregateMaxGroups {
+						Failed = ErrTooManyGroups
+						return
+					}
+					Groups[GroupKey] = v
+					continue
+				}
+				for i, State := range v.States {
+					Existing.States[i].Merge(State)
+				}
+			}
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+
+	// Without group_by there is always one row, even if no records matched.
+	if len(Parsed.GroupBy) == 0 && len(Groups) == 0 {
+		Partial := &AggregatePartial{Group: []interface{}{}, States: make([]*AggregateState, len(Parsed.Accumulators))}
+		for i := range Partial.States {
+			Partial.States[i] = &AggregateState{}
+		}
+		Groups[AggregateGroupKey(Partial.Group)] = Partial
+	}
+
+	// Works out the final value of each accumulator.
+	GroupKeys := make([]string, 0, len(Groups))
+	for k := range Groups {
+		GroupKeys = append(GroupKeys, k)
+	}
+	sort.Strings(GroupKeys)
+	Rows := make([]*AggregateRow, 0, len(GroupKeys))
+	for _, k := range GroupKeys {
+		Partial := Groups[k]
+		Row := &AggregateRow{Group: map[string]interface{}{}, Values: map[string]interface{}{}}
+		for i, Key := range Parsed.GroupBy {
+			Row.Group[Key] = Partial.Group[i]
+		}
+		for i, a := range Parsed.Accumulators {
+			Row.Values[a.Name] = a.Result(Partial.States[i])
+		}
+		Rows = append(Rows, Row)
+	}
+	return Rows, nil
+}
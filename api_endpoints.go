@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/buaazp/fasthttprouter"
 	"github.com/valyala/fasthttp"
@@ -69,6 +72,40 @@ func SendUnauthorized(ctx *fasthttp.RequestCtx) {
 	}, ctx)
 }
 
+// Gets the write options from the "If-Match", "If-None-Match" and "TTL" headers. The TTL can also be given with the "ttl" query argument.
+func GetWriteOptions(ctx *fasthttp.RequestCtx, Mode int) (*WriteOptions, error) {
+	Options := WriteOptions{Mode: Mode}
+	if ctx.Request.Header.Peek("If-Match") != nil {
+		Options.IfMatch = ParseETagCondition(string(ctx.Request.Header.Peek("If-Match")))
+	}
+	if ctx.Request.Header.Peek("If-None-Match") != nil {
+		Options.IfNoneMatch = ParseETagCondition(string(ctx.Request.Header.Peek("If-None-Match")))
+	}
+	TTL := ctx.Request.Header.Peek("TTL")
+	if TTL == nil {
+		TTL = ctx.QueryArgs().Peek("ttl")
+	}
+	if TTL != nil {
+		Seconds, err := strconv.ParseInt(string(TTL), 10, 64)
+		if err != nil || Seconds <= 0 {
+			return nil, errors.New("The TTL must be a positive number of seconds.")
+		}
+		Options.TTL = Seconds
+	}
+	return &Options, nil
+}
+
+// Gets the status code for a error from a write.
+func WriteErrorStatus(err error) int {
+	if err == ErrPreconditionFailed {
+		return 412
+	}
+	if IsUniqueViolation(err) {
+		return 409
+	}
+	return 400
+}
+
 // A wrapper for authorization.
 func TokenWrapper(ToWrap func(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation)) func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
@@ -125,7 +162,7 @@ func GETItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformati
 	}
 
 	Item := ctx.UserValue("item").(string)
-	g, err := ShardInstance.Get(DB, Table, Item)
+	g, Meta, err := ShardInstance.GetFields(DB, Table, Item, SplitProjectionFields(string(ctx.QueryArgs().Peek("fields"))))
 	if err != nil {
 		ctx.Response.SetStatusCode(400)
 		e := err.Error()
@@ -135,6 +172,12 @@ func GETItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformati
 		}, ctx)
 		return
 	}
+	ctx.Response.Header.Set("ETag", FormatETag(Meta.Version))
+	if ctx.Request.Header.Peek("If-None-Match") != nil && ConditionMatches(ParseETagCondition(string(ctx.Request.Header.Peek("If-None-Match"))), Meta) {
+		// The client already has this version.
+		ctx.Response.SetStatusCode(304)
+		return
+	}
 	ctx.Response.SetStatusCode(200)
 	SendJSONResponse(GenericResponse{
 		Error: nil,
@@ -303,15 +346,44 @@ func GETTableHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
+	DBData, err := ShardInstance.Table(DB, Table)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
 	ctx.Response.SetStatusCode(200)
-	DBData := ShardInstance.Table(DB, Table)
 	SendJSONResponse(GenericResponse{
 		Error: nil,
 		Data:  ToInterfacePtr(DBData),
 	}, ctx)
 }
 
-// Gets the table keys.
+// Gets the key list query from the query string.
+func GetKeyListQuery(ctx *fasthttp.RequestCtx) (*KeyListQuery, error) {
+	Args := ctx.QueryArgs()
+	Query := KeyListQuery{
+		Prefix: string(Args.Peek("prefix")),
+		Start:  string(Args.Peek("start")),
+		End:    string(Args.Peek("end")),
+		After:  string(Args.Peek("after")),
+		Limit:  KeyListDefaultLimit,
+	}
+	if Args.Has("limit") {
+		Limit, err := strconv.Atoi(string(Args.Peek("limit")))
+		if err != nil || Limit <= 0 || Limit > KeyListMaxLimit {
+			return nil, errors.New("The limit must be between 1 and " + strconv.Itoa(KeyListMaxLimit) + ".")
+		}
+		Query.Limit = Limit
+	}
+	return &Query, nil
+}
+
+// Gets a page of the table keys.
 func GETTableKeysHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
 	Perm := AccessControl.Read
 	DB := ctx.UserValue("db").(string)
@@ -353,7 +425,18 @@ func GETTableKeysHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInfo
 		return
 	}
 
-	DBData, err := ShardInstance.TableKeys(DB, Table)
+	Query, err := GetKeyListQuery(ctx)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	DBData, err := ShardInstance.ListKeys(DB, Table, Query)
 	if err != nil {
 		e := err.Error()
 		ctx.Response.SetStatusCode(400)
@@ -524,7 +607,90 @@ func DELETEItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInform
 		return
 	}
 
-	err := ShardInstance.DeleteRecord(DB, Table, Item)
+	Options, err := GetWriteOptions(ctx, WriteReplace)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	err = ShardInstance.Delete(DB, Table, Item, Options)
+	if err == nil {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(WriteErrorStatus(err))
+		e := err.Error()
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	}
+}
+
+// Sets the default TTL of a table. The body is the number of seconds records written to the table live for, or 0 to stop records expiring by default.
+func PUTTableTTLHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Admin
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Admin
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Admin
+			}
+		}
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	var TTL int64
+	err := json.Unmarshal(ctx.Request.Body(), &TTL)
+	if err != nil {
+		e := "The TTL must be a number of seconds."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	err = ShardInstance.SetTableTTL(DB, Table, TTL)
 	if err == nil {
 		ctx.Response.SetStatusCode(200)
 		SendJSONResponse(GenericResponse{
@@ -583,9 +749,20 @@ func POSTItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
+	Options, err := GetWriteOptions(ctx, WriteInsert)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
 	var Response interface{}
 	Data := ctx.Request.Body()
-	err := json.Unmarshal(Data, &Response)
+	err = json.Unmarshal(Data, &Response)
 	if err != nil {
 		e := "The JSON given is invalid."
 		ctx.Response.SetStatusCode(400)
@@ -596,15 +773,16 @@ func POSTItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
-	err = ShardInstance.Insert(DB, Table, ctx.UserValue("item").(string), &Response)
+	Meta, err := ShardInstance.Write(DB, Table, ctx.UserValue("item").(string), &Response, Options)
 	if err != nil {
 		e := err.Error()
-		ctx.Response.SetStatusCode(400)
+		ctx.Response.SetStatusCode(WriteErrorStatus(err))
 		SendJSONResponse(GenericResponse{
 			Error: &e,
 			Data:  nil,
 		}, ctx)
 	} else {
+		ctx.Response.Header.Set("ETag", FormatETag(Meta.Version))
 		ctx.Response.SetStatusCode(200)
 		SendJSONResponse(GenericResponse{
 			Error: nil,
@@ -613,59 +791,15 @@ func POSTItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 	}
 }
 
-// Lists all the databases.
-func GETDatabasesHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
-	// We will get all the databases first to reduce the lock length.
-	Core.ArrayLock.RLock()
-	Databases := make([]string, len(*Core.Structure))
-	for i, v := range *Core.Structure {
-		Databases[i] = v.Name
-	}
-	Core.ArrayLock.RUnlock()
-
-	// Remove any which the user shouldn't be able to see (no read permissions).
-	DatabasesClone := Databases
-	for _, v := range DatabasesClone {
-		Perm := AccessControl.Read
-		if AccessControl.DBOverrides != nil {
-			DBOverride := (*AccessControl.DBOverrides)[v]
-			if DBOverride != nil {
-				Perm = DBOverride.Read
-			}
-		}
-		if v == "__internal" {
-			// No!
-			Databases = Databases[1:]
-			continue
-		}
-		if v == "remixdb" && !AccessControl.Admin {
-			// This DB needs admin.
-			Databases = Databases[1:]
-			continue
-		}
-		if !Perm {
-			// We should remove this one.
-			Databases = Databases[1:]
-			continue
-		}
-	}
-
-	ctx.Response.SetStatusCode(200)
-	SendJSONResponse(GenericResponse{
-		Error: nil,
-		Data:  ToInterfacePtr(Databases),
-	}, ctx)
-}
-
-// Deletes a index.
-func DELETEIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
-	Perm := AccessControl.Admin
+// Allows a user to upsert a item in the DB. If the "If-Match" header is "*", the item must already exist.
+func PUTItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Write
 	DB := ctx.UserValue("db").(string)
 	Table := ctx.UserValue("table").(string)
 	if AccessControl.DBOverrides != nil {
 		DBOverride := (*AccessControl.DBOverrides)[DB]
 		if DBOverride != nil {
-			Perm = DBOverride.Admin
+			Perm = DBOverride.Write
 		}
 	}
 	if AccessControl.TableOverrides != nil {
@@ -673,11 +807,17 @@ func DELETEIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInfor
 		if DBTableOverride != nil {
 			TableOverride := (*DBTableOverride)[Table]
 			if TableOverride != nil {
-				Perm = TableOverride.Admin
+				Perm = TableOverride.Write
 			}
 		}
 	}
 
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
 	if DB == "__internal" {
 		// Here be dragons!
 		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
@@ -693,32 +833,57 @@ func DELETEIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInfor
 		return
 	}
 
-	err := ShardInstance.DeleteIndex(DB, Table, ctx.UserValue("index").(string))
-	if err == nil {
-		ctx.Response.SetStatusCode(200)
+	Options, err := GetWriteOptions(ctx, WriteUpsert)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
 		SendJSONResponse(GenericResponse{
-			Error: nil,
+			Error: &e,
 			Data:  nil,
 		}, ctx)
-	} else {
+		return
+	}
+
+	var Response interface{}
+	Data := ctx.Request.Body()
+	err = json.Unmarshal(Data, &Response)
+	if err != nil {
+		e := "The JSON given is invalid."
 		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Meta, err := ShardInstance.Write(DB, Table, ctx.UserValue("item").(string), &Response, Options)
+	if err != nil {
 		e := err.Error()
+		ctx.Response.SetStatusCode(WriteErrorStatus(err))
 		SendJSONResponse(GenericResponse{
 			Error: &e,
 			Data:  nil,
 		}, ctx)
+	} else {
+		ctx.Response.Header.Set("ETag", FormatETag(Meta.Version))
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  nil,
+		}, ctx)
 	}
 }
 
-// Gets the index.
-func PUTIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
-	Perm := AccessControl.Admin
+// Allows a user to patch a item in the DB. A "Content-Type" of "application/json-patch+json" is treated as a JSON Patch, anything else is treated as a JSON Merge Patch.
+func PATCHItemHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Write
 	DB := ctx.UserValue("db").(string)
 	Table := ctx.UserValue("table").(string)
 	if AccessControl.DBOverrides != nil {
 		DBOverride := (*AccessControl.DBOverrides)[DB]
 		if DBOverride != nil {
-			Perm = DBOverride.Admin
+			Perm = DBOverride.Write
 		}
 	}
 	if AccessControl.TableOverrides != nil {
@@ -726,11 +891,17 @@ func PUTIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		if DBTableOverride != nil {
 			TableOverride := (*DBTableOverride)[Table]
 			if TableOverride != nil {
-				Perm = TableOverride.Admin
+				Perm = TableOverride.Write
 			}
 		}
 	}
 
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
 	if DB == "__internal" {
 		// Here be dragons!
 		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
@@ -746,9 +917,20 @@ func PUTIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
-	var Response []string
+	Options, err := GetWriteOptions(ctx, WriteReplace)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	var Patch interface{}
 	Data := ctx.Request.Body()
-	err := json.Unmarshal(Data, &Response)
+	err = json.Unmarshal(Data, &Patch)
 	if err != nil {
 		e := "The JSON given is invalid."
 		ctx.Response.SetStatusCode(400)
@@ -759,25 +941,49 @@ func PUTIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
-	err = ShardInstance.CreateIndex(DB, Table, ctx.UserValue("index").(string), Response)
-	if err == nil {
-		ctx.Response.SetStatusCode(200)
+	PatchType := PatchMerge
+	if strings.HasPrefix(string(ctx.Request.Header.ContentType()), "application/json-patch+json") {
+		PatchType = PatchJSON
+	}
+
+	Meta, err := ShardInstance.Patch(DB, Table, ctx.UserValue("item").(string), PatchType, Patch, Options)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(WriteErrorStatus(err))
 		SendJSONResponse(GenericResponse{
-			Error: nil,
+			Error: &e,
 			Data:  nil,
 		}, ctx)
 	} else {
-		ctx.Response.SetStatusCode(400)
-		e := err.Error()
+		ctx.Response.Header.Set("ETag", FormatETag(Meta.Version))
+		ctx.Response.SetStatusCode(200)
 		SendJSONResponse(GenericResponse{
-			Error: &e,
+			Error: nil,
 			Data:  nil,
 		}, ctx)
 	}
 }
 
-// Gets the index.
-func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+// Parses a JSON array of keys for a batch, removing any duplicates.
+func ParseBatchKeys(Data []byte) ([]string, error) {
+	var Keys []string
+	err := json.Unmarshal(Data, &Keys)
+	if err != nil {
+		return nil, err
+	}
+	Seen := map[string]bool{}
+	Unique := make([]string, 0, len(Keys))
+	for _, v := range Keys {
+		if !Seen[v] {
+			Seen[v] = true
+			Unique = append(Unique, v)
+		}
+	}
+	return Unique, nil
+}
+
+// Gets a batch of items from a table. The body is a JSON array of keys and the result for each key is returned in a object keyed by the key.
+func POSTBatchGetHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
 	Perm := AccessControl.Read
 	DB := ctx.UserValue("db").(string)
 	Table := ctx.UserValue("table").(string)
@@ -797,10 +1003,967 @@ func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		}
 	}
 
-	if DB == "__internal" {
-		// Here be dragons!
-		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
-		SendJSONResponse(GenericResponse{
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Keys, err := ParseBatchKeys(ctx.Request.Body())
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+	if len(Keys) > BatchMaxItems {
+		e := "A batch cannot have more than " + strconv.Itoa(BatchMaxItems) + " keys."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+	Fields := SplitProjectionFields(string(ctx.QueryArgs().Peek("fields")))
+	if _, err := ParseProjection(Fields); err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(ShardInstance.BatchGet(DB, Table, Keys, Fields)),
+	}, ctx)
+}
+
+// Inserts a batch of items into a table. The body is a JSON object of keys to items and the result for each key is returned in a object keyed by the key.
+func POSTBatchInsertHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Write
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Write
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Write
+			}
+		}
+	}
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Options, err := GetWriteOptions(ctx, WriteInsert)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	var Body map[string]interface{}
+	err = json.Unmarshal(ctx.Request.Body(), &Body)
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+	if len(Body) > BatchMaxItems {
+		e := "A batch cannot have more than " + strconv.Itoa(BatchMaxItems) + " keys."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Items := make([]*BatchItem, 0, len(Body))
+	for k, v := range Body {
+		Items = append(Items, &BatchItem{
+			WriteOptions: *Options,
+			Key:          k,
+			Item:         ToInterfacePtr(v),
+		})
+	}
+
+	Results, err := ShardInstance.BatchWrite(DB, Table, BatchOpWrite, Items)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  ToInterfacePtr(Results),
+		}, ctx)
+	}
+}
+
+// Deletes a batch of items from a table. The body is a JSON array of keys and the result for each key is returned in a object keyed by the key.
+func POSTBatchDeleteHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Write
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Write
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Write
+			}
+		}
+	}
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Keys, err := ParseBatchKeys(ctx.Request.Body())
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+	if len(Keys) > BatchMaxItems {
+		e := "A batch cannot have more than " + strconv.Itoa(BatchMaxItems) + " keys."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Items := make([]*BatchItem, len(Keys))
+	for i, v := range Keys {
+		Items[i] = &BatchItem{Key: v}
+	}
+
+	Results, err := ShardInstance.BatchWrite(DB, Table, BatchOpDelete, Items)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  ToInterfacePtr(Results),
+		}, ctx)
+	}
+}
+
+// The body of a transaction.
+type TransactionBody struct {
+	DB         string                  `json:"db"`
+	Operations []*TransactionOperation `json:"operations"`
+}
+
+// Checks if the user can read (or write to) a table.
+func HasTablePermission(AccessControl *AccessControlInformation, DB string, Table string, Write bool) bool {
+	Perm := AccessControl.Read
+	if Write {
+		Perm = AccessControl.Write
+	}
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Read
+			if Write {
+				Perm = DBOverride.Write
+			}
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Read
+				if Write {
+					Perm = TableOverride.Write
+				}
+			}
+		}
+	}
+	return Perm
+}
+
+// Runs a transaction. Every operation needs read permission on its table, and every operation which writes needs write permission on its table.
+func POSTTransactionHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	var Body TransactionBody
+	err := json.Unmarshal(ctx.Request.Body(), &Body)
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+	DB := Body.DB
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	for _, v := range Body.Operations {
+		if !HasTablePermission(AccessControl, DB, v.Table, false) || (v.Writes() && !HasTablePermission(AccessControl, DB, v.Table, true)) {
+			SendUnauthorized(ctx)
+			return
+		}
+	}
+
+	Results, err := ShardInstance.Transaction(DB, Body.Operations)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(WriteErrorStatus(err))
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  ToInterfacePtr(Results),
+		}, ctx)
+	}
+}
+
+// Lists all the databases.
+func GETDatabasesHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	// We will get all the databases first to reduce the lock length.
+	Core.ArrayLock.RLock()
+	Databases := make([]string, len(*Core.Structure))
+	for i, v := range *Core.Structure {
+		Databases[i] = v.Name
+	}
+	Core.ArrayLock.RUnlock()
+
+	// Remove any which the user shouldn't be able to see (no read permissions).
+	DatabasesClone := Databases
+	for _, v := range DatabasesClone {
+		Perm := AccessControl.Read
+		if AccessControl.DBOverrides != nil {
+			DBOverride := (*AccessControl.DBOverrides)[v]
+			if DBOverride != nil {
+				Perm = DBOverride.Read
+			}
+		}
+		if v == "__internal" {
+			// No!
+			Databases = Databases[1:]
+			continue
+		}
+		if v == "remixdb" && !AccessControl.Admin {
+			// This DB needs admin.
+			Databases = Databases[1:]
+			continue
+		}
+		if !Perm {
+			// We should remove this one.
+			Databases = Databases[1:]
+			continue
+		}
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Databases),
+	}, ctx)
+}
+
+// Deletes a index.
+func DELETEIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Admin
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Admin
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Admin
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	err := ShardInstance.DeleteIndex(DB, Table, ctx.UserValue("index").(string))
+	if err == nil {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(400)
+		e := err.Error()
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	}
+}
+
+// Defines the body used to create a index.
+type IndexBody struct {
+	IndexOptions
+	Keys []string `json:"keys"`
+}
+
+// Parses the body used to create a index. This is either a array of keys or a object with the keys and the index options.
+func ParseIndexBody(Data []byte) ([]string, *IndexOptions, error) {
+	var Keys []string
+	if json.Unmarshal(Data, &Keys) == nil {
+		return Keys, &IndexOptions{}, nil
+	}
+	var Body IndexBody
+	err := json.Unmarshal(Data, &Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Body.Keys, &Body.IndexOptions, nil
+}
+
+// Creates the index.
+func PUTIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Admin
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Admin
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Admin
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Response, Options, err := ParseIndexBody(ctx.Request.Body())
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	err = ShardInstance.CreateIndex(DB, Table, ctx.UserValue("index").(string), Response, Options)
+	if err == nil {
+		ctx.Response.SetStatusCode(200)
+		SendJSONResponse(GenericResponse{
+			Error: nil,
+			Data:  nil,
+		}, ctx)
+	} else {
+		ctx.Response.SetStatusCode(400)
+		e := err.Error()
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+	}
+}
+
+// Checks a index against the records in its table on every shard.
+func GETIndexCheckHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Admin
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Admin
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Admin
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Reports, err := ShardInstance.CheckIndex(DB, Table, ctx.UserValue("index").(string), false)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Reports),
+	}, ctx)
+}
+
+// Checks a index on every shard and then rebuilds it from the records in its table.
+func POSTIndexRebuildHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Admin
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Admin
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Admin
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Reports, err := ShardInstance.CheckIndex(DB, Table, ctx.UserValue("index").(string), true)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Reports),
+	}, ctx)
+}
+
+// The number of records returned by a index query if no limit is given.
+const IndexQueryDefaultLimit = 100
+
+// The most records which can be returned by a index query.
+const IndexQueryMaxLimit = 1000
+
+// Gets a index query from the query arguments:
+//   - values: A JSON array of the values of the first keys of the index.
+//   - gt, gte, lt and lte: JSON values the next key of a ordered index has to be above or below.
+//   - prefix: A string the next key of a ordered index has to start with.
+//   - reverse: If this is "true", a ordered index is read backwards.
+//   - after: The cursor from the last page.
+//   - limit: How many records to return.
+func GetIndexQuery(ctx *fasthttp.RequestCtx) (*IndexQuery, error) {
+	Query := IndexQuery{Values: []interface{}{}, Limit: IndexQueryDefaultLimit}
+	Args := ctx.QueryArgs()
+	if Args.Has("values") {
+		err := json.Unmarshal(Args.Peek("values"), &Query.Values)
+		if err != nil {
+			return nil, errors.New("The values must be a JSON array.")
+		}
+	}
+	for Name, Bound := range map[string]*interface{}{"gt": &Query.Gt, "gte": &Query.Gte, "lt": &Query.Lt, "lte": &Query.Lte} {
+		if Args.Has(Name) {
+			err := json.Unmarshal(Args.Peek(Name), Bound)
+			if err != nil || *Bound == nil {
+				return nil, errors.New(`The "` + Name + `" bound must be a JSON value which is not null.`)
+			}
+		}
+	}
+	if Args.Has("prefix") {
+		Prefix := string(Args.Peek("prefix"))
+		Query.Prefix = &Prefix
+	}
+	Query.Reverse = string(Args.Peek("reverse")) == "true"
+	Query.After = string(Args.Peek("after"))
+	if Args.Has("limit") {
+		Limit, err := strconv.Atoi(string(Args.Peek("limit")))
+		if err != nil || Limit <= 0 || Limit > IndexQueryMaxLimit {
+			return nil, errors.New("The limit must be between 1 and " + strconv.Itoa(IndexQueryMaxLimit) + ".")
+		}
+		Query.Limit = Limit
+	}
+	Query.Fields = SplitProjectionFields(string(Args.Peek("fields")))
+	if _, err := ParseProjection(Query.Fields); err != nil {
+		return nil, err
+	}
+	return &Query, nil
+}
+
+// Gets a page of the records which match a query on a index.
+func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Read
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Read
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Read
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Query, err := GetIndexQuery(ctx)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Page, err := ShardInstance.GetAllByIndex(DB, Table, ctx.UserValue("index").(string), Query)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Page),
+	}, ctx)
+}
+
+// Gets a search from the query arguments:
+//   - q: The words to search for. Words in double quotes are a phrase.
+//   - offset: How many results to skip. This is the next offset from the last page.
+//   - limit: How many results to return.
+func GetSearchQuery(ctx *fasthttp.RequestCtx) (*SearchQuery, error) {
+	Query := SearchQuery{Limit: SearchDefaultLimit}
+	Args := ctx.QueryArgs()
+	Query.Query = string(Args.Peek("q"))
+	if Args.Has("offset") {
+		Offset, err := strconv.Atoi(string(Args.Peek("offset")))
+		if err != nil || Offset < 0 {
+			return nil, errors.New("The offset must be a number which is not negative.")
+		}
+		Query.Offset = Offset
+	}
+	if Args.Has("limit") {
+		Limit, err := strconv.Atoi(string(Args.Peek("limit")))
+		if err != nil || Limit <= 0 || Limit > SearchMaxLimit {
+			return nil, errors.New("The limit must be between 1 and " + strconv.Itoa(SearchMaxLimit) + ".")
+		}
+		Query.Limit = Limit
+	}
+
+	// Only the first SearchMaxDepth results can be paged through, so the last page is cut short.
+	if Query.Offset >= SearchMaxDepth {
+		return nil, errors.New("The offset must be less than " + strconv.Itoa(SearchMaxDepth) + ".")
+	}
+	if Query.Offset+Query.Limit > SearchMaxDepth {
+		Query.Limit = SearchMaxDepth - Query.Offset
+	}
+	return &Query, nil
+}
+
+// Gets a page of the records which match a search on a full-text index.
+func GETSearchHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Read
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Read
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Read
+			}
+		}
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Query, err := GetSearchQuery(ctx)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Page, err := ShardInstance.Search(DB, Table, ctx.UserValue("index").(string), Query)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Page),
+	}, ctx)
+}
+
+// Parses the body of a filter query. The body is a object with these fields:
+//   - filter: The filter records have to match (see filter.go). If this is missing, every record matches.
+//   - after: The cursor from the last page.
+//   - limit: How many records to return.
+func ParseFilterQuery(Data []byte) (*FilterQuery, error) {
+	Query := FilterQuery{}
+	if len(Data) != 0 {
+		err := json.Unmarshal(Data, &Query)
+		if err != nil {
+			return nil, errors.New("The JSON given is invalid.")
+		}
+	}
+	if Query.Limit == 0 {
+		Query.Limit = IndexQueryDefaultLimit
+	}
+	if Query.Limit < 0 || Query.Limit > IndexQueryMaxLimit {
+		return nil, errors.New("The limit must be between 1 and " + strconv.Itoa(IndexQueryMaxLimit) + ".")
+	}
+	if _, err := ParseProjection(Query.Fields); err != nil {
+		return nil, err
+	}
+	return &Query, nil
+}
+
+// Gets a page of the records in a table which match a filter.
+func POSTQueryHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Read
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Read
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Read
+			}
+		}
+	}
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	if !Perm {
+		SendUnauthorized(ctx)
+		return
+	}
+
+	Query, err := ParseFilterQuery(ctx.Request.Body())
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Page, err := ShardInstance.Query(DB, Table, Query)
+	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	ctx.Response.SetStatusCode(200)
+	SendJSONResponse(GenericResponse{
+		Error: nil,
+		Data:  ToInterfacePtr(Page),
+	}, ctx)
+}
+
+// Aggregates the records in a table which match a filter.
+func POSTAggregateHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformation) {
+	Perm := AccessControl.Read
+	DB := ctx.UserValue("db").(string)
+	Table := ctx.UserValue("table").(string)
+	if AccessControl.DBOverrides != nil {
+		DBOverride := (*AccessControl.DBOverrides)[DB]
+		if DBOverride != nil {
+			Perm = DBOverride.Read
+		}
+	}
+	if AccessControl.TableOverrides != nil {
+		DBTableOverride := (*AccessControl.TableOverrides)[DB]
+		if DBTableOverride != nil {
+			TableOverride := (*DBTableOverride)[Table]
+			if TableOverride != nil {
+				Perm = TableOverride.Read
+			}
+		}
+	}
+
+	if DB == "remixdb" && !AccessControl.Admin {
+		// Nope! This requires admin.
+		SendUnauthorized(ctx)
+		return
+	}
+
+	if DB == "__internal" {
+		// Here be dragons!
+		e := "This is an internal database used by RemixDB on a per-shard basis. Here be dragons!"
+		SendJSONResponse(GenericResponse{
 			Error: &e,
 			Data:  nil,
 		}, ctx)
@@ -812,10 +1975,24 @@ func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 		return
 	}
 
-	index, err := ShardInstance.GetIndex(DB, Table)
+	var Query AggregateQuery
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		e := "The JSON given is invalid."
+		ctx.Response.SetStatusCode(400)
+		SendJSONResponse(GenericResponse{
+			Error: &e,
+			Data:  nil,
+		}, ctx)
+		return
+	}
+
+	Rows, err := ShardInstance.Aggregate(DB, Table, &Query)
 	if err != nil {
+		e := err.Error()
+		ctx.Response.SetStatusCode(400)
 		SendJSONResponse(GenericResponse{
-			Error: &err,
+			Error: &e,
 			Data:  nil,
 		}, ctx)
 		return
@@ -824,7 +2001,7 @@ func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 	ctx.Response.SetStatusCode(200)
 	SendJSONResponse(GenericResponse{
 		Error: nil,
-		Data:  &index,
+		Data:  ToInterfacePtr(Rows),
 	}, ctx)
 }
 
@@ -832,6 +2009,8 @@ func GETIndexHTTP(ctx *fasthttp.RequestCtx, AccessControl *AccessControlInformat
 func EndpointsInit(router *fasthttprouter.Router) {
 	router.GET("/v1/record/:db/:table/:item", TokenWrapper(GETItemHTTP))
 	router.POST("/v1/record/:db/:table/:item", TokenWrapper(POSTItemHTTP))
+	router.PUT("/v1/record/:db/:table/:item", TokenWrapper(PUTItemHTTP))
+	router.PATCH("/v1/record/:db/:table/:item", TokenWrapper(PATCHItemHTTP))
 	router.DELETE("/v1/record/:db/:table/:item", TokenWrapper(DELETEItemHTTP))
 	router.GET("/v1/database/:db", TokenWrapper(GETDatabaseHTTP))
 	router.PUT("/v1/database/:db", TokenWrapper(PUTDatabaseHTTP))
@@ -839,9 +2018,19 @@ func EndpointsInit(router *fasthttprouter.Router) {
 	router.GET("/v1/table/:db/:table", TokenWrapper(GETTableHTTP))
 	router.GET("/v1/table/:db/:table/keys", TokenWrapper(GETTableKeysHTTP))
 	router.PUT("/v1/table/:db/:table", TokenWrapper(PUTTableHTTP))
+	router.PUT("/v1/table/:db/:table/ttl", TokenWrapper(PUTTableTTLHTTP))
 	router.DELETE("/v1/table/:db/:table", TokenWrapper(DELETETableHTTP))
 	router.GET("/v1/databases", TokenWrapper(GETDatabasesHTTP))
+	router.POST("/v1/transaction", TokenWrapper(POSTTransactionHTTP))
+	router.POST("/v1/batch/get/:db/:table", TokenWrapper(POSTBatchGetHTTP))
+	router.POST("/v1/batch/insert/:db/:table", TokenWrapper(POSTBatchInsertHTTP))
+	router.POST("/v1/batch/delete/:db/:table", TokenWrapper(POSTBatchDeleteHTTP))
 	router.DELETE("/v1/index/:db/:table/:index", TokenWrapper(DELETEIndexHTTP))
 	router.GET("/v1/index/:db/:table/:index", TokenWrapper(GETIndexHTTP))
 	router.PUT("/v1/index/:db/:table/:index", TokenWrapper(PUTIndexHTTP))
+	router.GET("/v1/search/:db/:table/:index", TokenWrapper(GETSearchHTTP))
+	router.POST("/v1/query/:db/:table", TokenWrapper(POSTQueryHTTP))
+	router.POST("/v1/aggregate/:db/:table", TokenWrapper(POSTAggregateHTTP))
+	router.GET("/v1/index/:db/:table/:index/check", TokenWrapper(GETIndexCheckHTTP))
+	router.POST("/v1/index/:db/:table/:index/rebuild", TokenWrapper(POSTIndexRebuildHTTP))
 }
@@ -0,0 +1,112 @@
+// This handles batches of gets, writes and deletes inside a table. Unlike a transaction, each key in a batch succeeds or fails on its own.
+
+package main
+
+import "errors"
+
+// The most keys which can be in one batch.
+const BatchMaxItems = 10000
+
+// Defines a item in a batch. Only the key is used for gets and deletes.
+type BatchItem struct {
+	WriteOptions
+	Key  string       `json:"key"`
+	Item *interface{} `json:"item,omitempty"`
+}
+
+// Defines the result for a key in a batch.
+type BatchResult struct {
+	Err     *string      `json:"error"`
+	Data    *interface{} `json:"data,omitempty"`
+	Version uint64       `json:"version,omitempty"`
+	Expires int64        `json:"expires,omitempty"`
+}
+
+// Creates the result for a key in a batch.
+func NewBatchResult(Data *interface{}, Meta *RecordMeta, err error) *BatchResult {
+	if err != nil {
+		e := err.Error()
+		return &BatchResult{Err: &e}
+	}
+	r := &BatchResult{Data: Data}
+	if Meta != nil {
+		r.Version = Meta.Version
+		r.Expires = Meta.Expires
+	}
+	return r
+}
+
+// Creates the same failed result for every item in a batch.
+func FailedBatchResults(Length int, err error) []*BatchResult {
+	Results := make([]*BatchResult, Length)
+	for i := range Results {
+		Results[i] = NewBatchResult(nil, nil, err)
+	}
+	return Results
+}
+
+// Gets a batch of items from a table. The results are in the same order as the keys. Fields can be nil to get the whole items.
+func (d *DBCore) BatchGet(DatabaseName string, TableName string, Keys []string, Fields *Projection) []*BatchResult {
+	Results := make([]*BatchResult, len(Keys))
+	for i, k := range Keys {
+		Item, Meta, err := d.GetWithMeta(DatabaseName, TableName, k)
+		Results[i] = NewBatchResult(Fields.Apply(Item), Meta, err)
+	}
+	return Results
+}
+
+// Writes a batch of items into a table while the table is locked. Each item is written with its own options. The results are in the same order as the items.
+func (d *DBCore) BatchWrite(DatabaseName string, TableName string, Items []*BatchItem) []*BatchResult {
+	// Checks the table exists.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return FailedBatchResults(len(Items), err)
+	}
+
+	// Locks the table.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.Lock()
+
+	// Writes each item.
+	Results := make([]*BatchResult, len(Items))
+	for i, v := range Items {
+		Options := v.WriteOptions
+		Meta, err := d.WriteCheckedNonThreadSafe(Table, DatabaseName, TableName, v.Key, v.Item, &Options)
+		Results[i] = NewBatchResult(nil, Meta, err)
+	}
+
+	// Unlocks the table.
+	lock.Unlock()
+
+	// Returns the results.
+	return Results
+}
+
+// Deletes a batch of items from a table while the table is locked. The results are in the same order as the items.
+func (d *DBCore) BatchDelete(DatabaseName string, TableName string, Items []*BatchItem) []*BatchResult {
+	// Checks the table exists.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return FailedBatchResults(len(Items), err)
+	}
+
+	// Locks the table.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.Lock()
+
+	// Deletes each item.
+	Results := make([]*BatchResult, len(Items))
+	for i, v := range Items {
+		Options := v.WriteOptions
+		err := d.DeleteCheckedNonThreadSafe(Table, DatabaseName, TableName, v.Key, &Options)
+		Results[i] = NewBatchResult(nil, nil, err)
+	}
+
+	// Unlocks the table.
+	lock.Unlock()
+
+	// Returns the results.
+	return Results
+}
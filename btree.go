@@ -0,0 +1,283 @@
+// This is the in-memory B-tree which ordered indexes are kept in. Entries are sorted by their key and then by the record they point to, so the same key can point to many records.
+
+package main
+
+import "sort"
+
+const (
+	// The degree of the tree. Each node (apart from the root) holds between BTreeDegree-1 and 2*BTreeDegree-1 entries.
+	BTreeDegree = 32
+
+	// The most entries a node can hold.
+	BTreeMaxEntries = 2*BTreeDegree - 1
+
+	// The least entries a node (apart from the root) can hold.
+	BTreeMinEntries = BTreeDegree - 1
+)
+
+// Defines a entry in the tree.
+type IndexEntry struct {
+	Key    string
+	Record string
+}
+
+// Checks if the entry sorts before the other entry.
+func (e *IndexEntry) Less(Other *IndexEntry) bool {
+	if e.Key != Other.Key {
+		return e.Key < Other.Key
+	}
+	return e.Record < Other.Record
+}
+
+// Defines a node in the tree. Leaves have no children.
+type BTreeNode struct {
+	Entries  []*IndexEntry
+	Children []*BTreeNode
+}
+
+// Defines the tree.
+type BTree struct {
+	Root   *BTreeNode
+	Length int
+}
+
+// Creates a empty tree.
+func NewBTree() *BTree {
+	return &BTree{}
+}
+
+// Finds the position of the first entry in the node which is not less than the entry given. The boolean is true if that entry is equal.
+func (n *BTreeNode) Find(Entry *IndexEntry) (int, bool) {
+	i := sort.Search(len(n.Entries), func(i int) bool {
+		return !n.Entries[i].Less(Entry)
+	})
+	return i, i < len(n.Entries) && !Entry.Less(n.Entries[i])
+}
+
+// Splits the node at the position given. Returns the entry which was at that position and the new node holding everything after it.
+func (n *BTreeNode) Split(i int) (*IndexEntry, *BTreeNode) {
+	Middle := n.Entries[i]
+	Right := &BTreeNode{Entries: append([]*IndexEntry{}, n.Entries[i+1:]...)}
+	n.Entries = append([]*IndexEntry{}, n.Entries[:i]...)
+	if len(n.Children) != 0 {
+		Right.Children = append([]*BTreeNode{}, n.Children[i+1:]...)
+		n.Children = append([]*BTreeNode{}, n.Children[:i+1]...)
+	}
+	return Middle, Right
+}
+
+// Inserts a entry below this node. The node must not be full. Returns false if the entry is already there.
+func (n *BTreeNode) Insert(Entry *IndexEntry) bool {
+	i, Found := n.Find(Entry)
+	if Found {
+		return false
+	}
+	if len(n.Children) == 0 {
+		n.Entries = append(n.Entries, nil)
+		copy(n.Entries[i+1:], n.Entries[i:])
+		n.Entries[i] = Entry
+		return true
+	}
+
+	// Splits the child first if it is full so there is always room to insert.
+	if len(n.Children[i].Entries) >= BTreeMaxEntries {
+		Middle, Right := n.Children[i].Split(BTreeMaxEntries / 2)
+		n.Entries = append(n.Entries, nil)
+		copy(n.Entries[i+1:], n.Entries[i:])
+		n.Entries[i] = Middle
+		n.Children = append(n.Children, nil)
+		copy(n.Children[i+2:], n.Children[i+1:])
+		n.Children[i+1] = Right
+		if !Entry.Less(Middle) {
+			if !Middle.Less(Entry) {
+				return false
+			}
+			i++
+		}
+	}
+	return n.Children[i].Insert(Entry)
+}
+
+// Makes sure the child at the position given has more than the least number of entries by taking one from a sibling or merging it with one.
+func (n *BTreeNode) GrowChild(i int) {
+	if i > 0 && len(n.Children[i-1].Entries) > BTreeMinEntries {
+		// Takes the last entry from the left sibling.
+		Child, Left := n.Children[i], n.Children[i-1]
+		Taken := Left.Entries[len(Left.Entries)-1]
+		Left.Entries = Left.Entries[:len(Left.Entries)-1]
+		Child.Entries = append([]*IndexEntry{n.Entries[i-1]}, Child.Entries...)
+		n.Entries[i-1] = Taken
+		if len(Left.Children) != 0 {
+			Moved := Left.Children[len(Left.Children)-1]
+			Left.Children = Left.Children[:len(Left.Children)-1]
+			Child.Children = append([]*BTreeNode{Moved}, Child.Children...)
+		}
+	} else if i < len(n.Entries) && len(n.Children[i+1].Entries) > BTreeMinEntries {
+		// Takes the first entry from the right sibling.
+		Child, Right := n.Children[i], n.Children[i+1]
+		Taken := Right.Entries[0]
+		Right.Entries = append([]*IndexEntry{}, Right.Entries[1:]...)
+		Child.Entries = append(Child.Entries, n.Entries[i])
+		n.Entries[i] = Taken
+		if len(Right.Children) != 0 {
+			Child.Children = append(Child.Children, Right.Children[0])
+			Right.Children = append([]*BTreeNode{}, Right.Children[1:]...)
+		}
+	} else {
+		// Merges the child with its right sibling (or its left sibling if it is the last child).
+		if i >= len(n.Entries) {
+			i--
+		}
+		Child, Right := n.Children[i], n.Children[i+1]
+		Child.Entries = append(Child.Entries, n.Entries[i])
+		Child.Entries = append(Child.Entries, Right.Entries...)
+		Child.Children = append(Child.Children, Right.Children...)
+		n.Entries = append(n.Entries[:i], n.Entries[i+1:]...)
+		n.Children = append(n.Children[:i+1], n.Children[i+2:]...)
+	}
+}
+
+// Removes the largest entry below this node and returns it.
+func (n *BTreeNode) RemoveMax() *IndexEntry {
+	if len(n.Children) == 0 {
+		Entry := n.Entries[len(n.Entries)-1]
+		n.Entries = n.Entries[:len(n.Entries)-1]
+		return Entry
+	}
+	i := len(n.Children) - 1
+	if len(n.Children[i].Entries) <= BTreeMinEntries {
+		n.GrowChild(i)
+		return n.RemoveMax()
+	}
+	return n.Children[i].RemoveMax()
+}
+
+// Removes a entry below this node. Returns false if the entry isn't there.
+func (n *BTreeNode) Remove(Entry *IndexEntry) bool {
+	i, Found := n.Find(Entry)
+	if len(n.Children) == 0 {
+		if !Found {
+			return false
+		}
+		n.Entries = append(n.Entries[:i], n.Entries[i+1:]...)
+		return true
+	}
+
+	// Makes sure the child we go into can lose a entry. This can move the entry we are looking for, so start again after.
+	if len(n.Children[i].Entries) <= BTreeMinEntries {
+		n.GrowChild(i)
+		return n.Remove(Entry)
+	}
+	if Found {
+		// Replaces the entry with the largest entry before it.
+		n.Entries[i] = n.Children[i].RemoveMax()
+		return true
+	}
+	return n.Children[i].Remove(Entry)
+}
+
+// Calls the function for each entry below this node which is not less than From (or every entry if From is nil) in order. Stops when the function returns false.
+func (n *BTreeNode) Ascend(From *IndexEntry, Handler func(Entry *IndexEntry) bool) bool {
+	i := 0
+	if From != nil {
+		i, _ = n.Find(From)
+	}
+	for ; i < len(n.Entries); i++ {
+		if len(n.Children) != 0 && !n.Children[i].Ascend(From, Handler) {
+			return false
+		}
+		if !Handler(n.Entries[i]) {
+			return false
+		}
+	}
+	if len(n.Children) != 0 {
+		return n.Children[len(n.Entries)].Ascend(From, Handler)
+	}
+	return true
+}
+
+// Calls the function for each entry below this node which is not more than From (or every entry if From is nil) in reverse order. Stops when the function returns false.
+func (n *BTreeNode) Descend(From *IndexEntry, Handler func(Entry *IndexEntry) bool) bool {
+	i := len(n.Entries)
+	if From != nil {
+		var Found bool
+		i, Found = n.Find(From)
+		if Found {
+			i++
+		}
+	}
+	for ; i > 0; i-- {
+		if len(n.Children) != 0 && !n.Children[i].Descend(From, Handler) {
+			return false
+		}
+		if !Handler(n.Entries[i-1]) {
+			return false
+		}
+	}
+	if len(n.Children) != 0 {
+		return n.Children[0].Descend(From, Handler)
+	}
+	return true
+}
+
+// Inserts a entry into the tree. Returns false if the entry is already there.
+func (t *BTree) Insert(Entry *IndexEntry) bool {
+	if t.Root == nil {
+		t.Root = &BTreeNode{Entries: []*IndexEntry{Entry}}
+		t.Length++
+		return true
+	}
+	if len(t.Root.Entries) >= BTreeMaxEntries {
+		Left := t.Root
+		Middle, Right := Left.Split(BTreeMaxEntries / 2)
+		t.Root = &BTreeNode{Entries: []*IndexEntry{Middle}, Children: []*BTreeNode{Left, Right}}
+	}
+	if !t.Root.Insert(Entry) {
+		return false
+	}
+	t.Length++
+	return true
+}
+
+// Removes a entry from the tree. Returns false if the entry isn't there.
+func (t *BTree) Remove(Entry *IndexEntry) bool {
+	if t.Root == nil {
+		return false
+	}
+	Removed := t.Root.Remove(Entry)
+	if len(t.Root.Entries) == 0 {
+		if len(t.Root.Children) != 0 {
+			t.Root = t.Root.Children[0]
+		} else {
+			t.Root = nil
+		}
+	}
+	if Removed {
+		t.Length--
+	}
+	return Removed
+}
+
+// Checks if a entry is in the tree.
+func (t *BTree) Has(Entry *IndexEntry) bool {
+	Found := false
+	t.Ascend(Entry, func(e *IndexEntry) bool {
+		Found = e.Key == Entry.Key && e.Record == Entry.Record
+		return false
+	})
+	return Found
+}
+
+// Calls the function for each entry which is not less than From (or every entry if From is nil) in order. Stops when the function returns false.
+func (t *BTree) Ascend(From *IndexEntry, Handler func(Entry *IndexEntry) bool) {
+	if t.Root != nil {
+		t.Root.Ascend(From, Handler)
+	}
+}
+
+// Calls the function for each entry which is not more than From (or every entry if From is nil) in reverse order. Stops when the function returns false.
+func (t *BTree) Descend(From *IndexEntry, Handler func(Entry *IndexEntry) bool) {
+	if t.Root != nil {
+		t.Root.Descend(From, Handler)
+	}
+}
@@ -0,0 +1,125 @@
+// This handles the commands RemixDB can be run with. With no command, the database is started. The commands talk to a database which is already running over HTTP, so they are safe to use while it is serving:
+//   - check-index [--rebuild] <db> <table> <index>: Checks a index against the records in its table and prints the report from each shard. With --rebuild, the index is rebuilt after it is checked.
+// The commands use the REMIXDB_URL (defaults to http://127.0.0.1:7010) and REMIXDB_TOKEN environment variables.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Runs a command and returns the exit code.
+func RunCommand(Args []string) int {
+	switch Args[0] {
+	case "check-index":
+		return CheckIndexCommand(Args[1:])
+	default:
+		println("Unknown command \"" + Args[0] + "\". The commands are:")
+		println("  check-index [--rebuild] <db> <table> <index>")
+		return 2
+	}
+}
+
+// Checks a index and prints the reports. Returns 1 if a shard found a problem and the index wasn't rebuilt.
+func CheckIndexCommand(Args []string) int {
+	Rebuild := false
+	if len(Args) != 0 && Args[0] == "--rebuild" {
+		Rebuild = true
+		Args = Args[1:]
+	}
+	if len(Args) != 3 {
+		println("Usage: check-index [--rebuild] <db> <table> <index>")
+		return 2
+	}
+
+	// Sends the request.
+	BaseURL := os.Getenv("REMIXDB_URL")
+	if BaseURL == "" {
+		BaseURL = "http://127.0.0.1:7010"
+	}
+	u, err := url.Parse(BaseURL)
+	if err != nil {
+		println("The URL \"" + BaseURL + "\" is invalid.")
+		return 2
+	}
+	Method := "GET"
+	Action := "check"
+	if Rebuild {
+		Method = "POST"
+		Action = "rebuild"
+	}
+	u.Path = "/v1/index/" + url.PathEscape(Args[0]) + "/" + url.PathEscape(Args[1]) + "/" + url.PathEscape(Args[2]) + "/" + Action
+	client, err := http.NewRequest(Method, u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	client.Header.Set("Token-Auth", os.Getenv("REMIXDB_TOKEN"))
+	req, err := HTTPClient.Do(client)
+	if err != nil {
+		println("Could not reach RemixDB: " + err.Error())
+		return 2
+	}
+	Data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	err = req.Body.Close()
+	if err != nil {
+		panic(err)
+	}
+	var Response struct {
+		Error *string                      `json:"error"`
+		Data  map[string]*IndexCheckReport `json:"data"`
+	}
+	err = json.Unmarshal(Data, &Response)
+	if err != nil {
+		println("RemixDB responded with a status " + strconv.Itoa(req.StatusCode) + ".")
+		return 2
+	}
+	if Response.Error != nil {
+		println(*Response.Error)
+		return 2
+	}
+
+	// Prints the report from each shard.
+	ShardIDs := make([]string, 0, len(Response.Data))
+	for k := range Response.Data {
+		ShardIDs = append(ShardIDs, k)
+	}
+	sort.Strings(ShardIDs)
+	Consistent := true
+	for _, ShardID := range ShardIDs {
+		Report := Response.Data[ShardID]
+		println("Shard " + ShardID + ": checked " + strconv.Itoa(Report.Checked) + " records.")
+		for _, Problem := range []struct {
+			Name    string
+			Problem *IndexCheckProblem
+		}{{"missing", Report.Missing}, {"stale", Report.Stale}, {"duplicate", Report.Duplicate}} {
+			if Problem.Problem.Count == 0 {
+				continue
+			}
+			println("  " + strconv.Itoa(Problem.Problem.Count) + " records have " + Problem.Name + " entries:")
+			for _, r := range Problem.Problem.Records {
+				println("    " + r)
+			}
+		}
+		if Report.Consistent {
+			println("  The index is consistent.")
+		} else {
+			Consistent = false
+		}
+		if Report.Rebuilding {
+			println("  The index is being rebuilt.")
+		}
+	}
+	if !Consistent && !Rebuild {
+		return 1
+	}
+	return 0
+}
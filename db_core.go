@@ -6,9 +6,9 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"sync"
 )
 
@@ -22,6 +22,9 @@ type DBStructure struct {
 type Table struct {
 	Name string `json:"n"`
 	Indexes []*Index `json:"i"`
+	DefaultTTL int64 `json:"ttl,omitempty"`
+	Expiring bool `json:"x,omitempty"`
+	VersionCeiling uint64 `json:"vc,omitempty"`
 }
 
 type DBCore struct {
@@ -30,28 +33,17 @@ type DBCore struct {
 	BaseFSLock *sync.Mutex
 	ArrayLock *sync.RWMutex
 	DBTableLockMap *map[string]*map[string]*sync.RWMutex
+	Engine StorageEngine
+	Expiry *ExpiryTracker
+	Versions *VersionClock
 }
 
 // Creates the DB core.
 func NewDBCore() {
+	CheckDurabilityMode()
 	x, _ := os.Getwd()
 	join := path.Join(x, "remixdb_data")
-	if _, err := os.Stat(join); os.IsNotExist(err) {
-		// Folder doesn't exist. Make the folder.
-		err := os.Mkdir(join, 0777)
-		if err != nil {
-			panic(err)
-		}
-	}
-	if _, err := os.Stat(path.Join(join, "dbs")); os.IsNotExist(err) {
-		// Folder doesn't exist. Make the folder.
-		err := os.Mkdir(path.Join(join, "dbs"), 0777)
-		if err != nil {
-			panic(err)
-		}
-	}
 	dbs := make([]*DBStructure, 0)
-	structure := path.Join(join, "structure")
 	BaseFSLock := sync.Mutex{}
 	ArrayLock := sync.RWMutex{}
 	Core = &DBCore{
@@ -60,17 +52,17 @@ func NewDBCore() {
 		BaseFSLock:  &BaseFSLock,
 		ArrayLock: &ArrayLock,
 		DBTableLockMap: &map[string]*map[string]*sync.RWMutex{},
+		Engine: NewStorageEngine(join),
+		Expiry: NewExpiryTracker(),
+		Versions: NewVersionClock(),
 	}
-	if _, err := os.Stat(structure); os.IsNotExist(err) {
+	structure := Core.Engine.LoadStructure()
+	if structure == nil {
 		// Lets create the DB structure.
 		Core.SaveStructure()
 	} else {
 		// Lets load the DB structure.
-		d, err := ioutil.ReadFile(structure)
-		if err != nil {
-			panic(err)
-		}
-		err = json.Unmarshal(d, &dbs)
+		err := json.Unmarshal(structure, &dbs)
 		if err != nil {
 			panic(err)
 		}
@@ -78,10 +70,18 @@ func NewDBCore() {
 	for _, db := range dbs {
 		for _, table := range db.Tables {
 			for _, index := range table.Indexes {
-				index.Init(join, db.Name, table.Name)
+				if index.Build != nil {
+					Core.RestartIndexBuild(db.Name, table.Name, index)
+					continue
+				}
+				index.Init(Core.Engine, db.Name, table.Name)
+			}
+			if table.Expiring {
+				Core.LoadExpiries(db.Name, table.Name)
 			}
 		}
 	}
+	go Core.ExpiryReaper()
 }
 
 // Get a copy of the DB structure if it exists.
@@ -123,18 +123,11 @@ func (d *DBCore) SaveStructure() {
 	d.BaseFSLock.Lock()
 
 	// Saves the current structure.
-	f, err := os.Create(path.Join(d.Base, "structure"))
-	if err != nil {
-		panic(err)
-	}
 	data, err := json.Marshal(d.Structure)
 	if err != nil {
 		panic(err)
 	}
-	_, err = f.Write(data)
-	if err != nil {
-		panic(err)
-	}
+	d.Engine.SaveStructure(data)
 
 	// Unlocks the base FS lock.
 	d.BaseFSLock.Unlock()
@@ -189,12 +182,8 @@ func (d *DBCore) CreateDatabase(DatabaseName string) error {
 	// Locks the base FS lock.
 	d.BaseFSLock.Lock()
 
-	// Creates all the needed folders.
-	DBFolder := path.Join(d.Base, "dbs", B64FSEncode(DatabaseName))
-	err := os.Mkdir(DBFolder, 0777)
-	if err != nil {
-		panic(err)
-	}
+	// Creates the storage for the database.
+	d.Engine.CreateDatabase(DatabaseName)
 
 	// Unlocks the base FS lock.
 	d.BaseFSLock.Unlock()
@@ -235,19 +224,7 @@ func (d *DBCore) CreateTable(DatabaseName string, TableName string) error {
 			break
 		}
 	}
-	TableDir := path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName))
-	err := os.Mkdir(TableDir, 0777)
-	if err != nil {
-		panic(err)
-	}
-	err = os.Mkdir(path.Join(TableDir, "r"), 0777)
-	if err != nil {
-		panic(err)
-	}
-	err = os.Mkdir(path.Join(TableDir, "i"), 0777)
-	if err != nil {
-		panic(err)
-	}
+	d.Engine.CreateTable(DatabaseName, TableName)
 
 	// Unlocks the array lock.
 	d.ArrayLock.Unlock()
@@ -279,6 +256,12 @@ func (d *DBCore) GetTableLock(DatabaseName string, TableName string) *sync.RWMut
 
 // Gets a item from a table.
 func (d *DBCore) Get(DatabaseName string, TableName string, Item string) (*interface{}, error) {
+	item, _, err := d.GetWithMeta(DatabaseName, TableName, Item)
+	return item, err
+}
+
+// Gets a item from a table along with its metadata.
+func (d *DBCore) GetWithMeta(DatabaseName string, TableName string, Item string) (*interface{}, *RecordMeta, error) {
 	// Defines what it will be marshalled into.
 	var item interface{}
 
@@ -288,33 +271,41 @@ func (d *DBCore) Get(DatabaseName string, TableName string, Item string) (*inter
 	// See if the item is in the cache.
 	CacheResult := Cache.Get(CacheKey)
 	if CacheResult != nil {
-		err := json.Unmarshal(*CacheResult, &item)
+		Meta, Data := DecodeRecord(*CacheResult)
+		if Meta.Expired(NowMillis()) {
+			err := errors.New("The item specified does not exist.")
+			return nil, nil, err
+		}
+		err := json.Unmarshal(Data, &item)
 		if err != nil {
 			panic(err)
 		}
-		return &item, nil
+		return &item, Meta, nil
 	}
 
 	// Checks the table exists.
 	if d.Table(DatabaseName, TableName) == nil {
 		err := errors.New(`The table "` + TableName + `" does not exist.`)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Try and get the item from the filesystem.
 	lock := d.GetTableLock(DatabaseName, TableName)
 	lock.RLock()
-	ItemDir := path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "r", B64FSEncode(Item))
-	if _, err := os.Stat(ItemDir); os.IsNotExist(err) {
+	data := d.Engine.ReadRecord(DatabaseName, TableName, Item)
+	if data == nil {
 		err := errors.New("The item specified does not exist.")
 		lock.RUnlock()
-		return nil, err
+		return nil, nil, err
 	}
-	data, err := ioutil.ReadFile(ItemDir)
-	if err != nil {
-		panic(err)
+	Meta, Data := DecodeRecord(data)
+	if Meta.Expired(NowMillis()) {
+		// The reaper hasn't got to this yet.
+		err := errors.New("The item specified does not exist.")
+		lock.RUnlock()
+		return nil, nil, err
 	}
-	err = json.Unmarshal(data, &item)
+	err := json.Unmarshal(Data, &item)
 	if err != nil {
 		panic(err)
 	}
@@ -322,83 +313,244 @@ func (d *DBCore) Get(DatabaseName string, TableName string, Item string) (*inter
 	lock.RUnlock()
 
 	// Return the value.
-	return &item, nil
+	return &item, Meta, nil
 }
 
-// Inserts a item into the database.
-func (d *DBCore) Insert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+// Reads a record from the storage engine. Returns nil for both if the record doesn't exist. Records which have expired but have not been reaped yet are still returned.
+// The table lock should be held when this is called.
+func (d *DBCore) ReadRecordNonThreadSafe(DatabaseName string, TableName string, Key string) (*RecordMeta, *interface{}) {
+	data := d.Engine.ReadRecord(DatabaseName, TableName, Key)
+	if data == nil {
+		return nil, nil
+	}
+	Meta, Data := DecodeRecord(data)
+	var item interface{}
+	err := json.Unmarshal(Data, &item)
+	if err != nil {
+		panic(err)
+	}
+	return Meta, &item
+}
+
+// Gets the metadata of a record if the record is live. Returns nil if the record does not exist or has expired.
+func LiveMeta(Meta *RecordMeta) *RecordMeta {
+	if Meta == nil || Meta.Expired(NowMillis()) {
+		return nil
+	}
+	return Meta
+}
+
+// Defines the modes a record can be written with.
+const (
+	// Only writes the record if it does not exist.
+	WriteInsert = iota
+
+	// Only writes the record if it already exists.
+	WriteReplace
+
+	// Writes the record whether it exists or not.
+	WriteUpsert
+)
+
+// Writes a record into a table with the options specified. The record, the indexes and the cache are all updated while the table is locked.
+// Returns the metadata the record was written with.
+func (d *DBCore) Write(DatabaseName string, TableName string, Key string, Item *interface{}, Options *WriteOptions) (*RecordMeta, error) {
 	// Checks the table exists.
 	Table := d.Table(DatabaseName, TableName)
 	if Table == nil {
 		err := errors.New(`The table "` + TableName + `" does not exist.`)
-		return err
+		return nil, err
 	}
 
-	// Check if a record exists already.
-	r, _ := d.Get(DatabaseName, TableName, Key)
-	if r != nil {
+	// Locks the table.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.Lock()
+
+	// Writes the item.
+	NewMeta, err := d.WriteCheckedNonThreadSafe(Table, DatabaseName, TableName, Key, Item, Options)
+
+	// Unlocks the table.
+	lock.Unlock()
+
+	// Returns the result.
+	return NewMeta, err
+}
+
+// Checks the mode and preconditions allow a write and then writes the item. The table lock must be held when this is called.
+func (d *DBCore) WriteCheckedNonThreadSafe(Table *Table, DatabaseName string, TableName string, Key string, Item *interface{}, Options *WriteOptions) (*RecordMeta, error) {
+	// Gets the current version of the record if it exists. A expired record counts as not existing.
+	Meta, Old := d.ReadRecordNonThreadSafe(DatabaseName, TableName, Key)
+	Live := LiveMeta(Meta)
+
+	// Checks the mode allows this write.
+	if Options.Mode == WriteInsert && Live != nil {
 		err := errors.New(`The record "` + Key + `" already exists.`)
-		return err
+		return nil, err
+	}
+	if Options.Mode == WriteReplace && Live == nil {
+		err := errors.New(`The record "` + Key + `" does not exist.`)
+		return nil, err
+	}
+
+	// Checks the preconditions.
+	if !Options.PreconditionsMet(Live) {
+		return nil, ErrPreconditionFailed
+	}
+
+	// Checks the unique indexes. Writes which carry a version are copies from the first shard holding the record, which already checked them.
+	if Options.Version == 0 {
+		err := d.CheckUniqueNonThreadSafe(Table, DatabaseName, TableName, Key, Item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Writes the item.
+	NewMeta := &RecordMeta{
+		Version: d.NextVersionNonThreadSafe(DatabaseName, TableName, Meta, Options),
+		Expires: Options.Expires,
+	}
+	d.WriteNonThreadSafe(Table, DatabaseName, TableName, Key, Old, Item, NewMeta)
+
+	// Everything worked! Return a null for error.
+	return NewMeta, nil
+}
+
+// Writes a item into the storage engine with the metadata specified and updates the indexes, the expiry tracker and the cache. The table lock must be held when this is called.
+func (d *DBCore) WriteNonThreadSafe(Table *Table, DatabaseName string, TableName string, Key string, Old *interface{}, Item *interface{}, Meta *RecordMeta) {
+	b, err := json.Marshal(Item)
+	if err != nil {
+		panic(err)
+	}
+	b = EncodeRecord(Meta, b)
+	if Meta.Expires != 0 && !Table.Expiring {
+		d.MarkTableExpiringNonThreadSafe(DatabaseName, TableName)
+	}
+	d.Engine.WriteRecord(DatabaseName, TableName, Key, b)
+	d.AfterWriteNonThreadSafe(Table, DatabaseName, TableName, Key, Old, Item, Meta, b)
+}
+
+// Updates the indexes, the expiry tracker and the cache after a record is written to the storage engine. Data is the encoded record. The table lock must be held when this is called.
+func (d *DBCore) AfterWriteNonThreadSafe(Table *Table, DatabaseName string, TableName string, Key string, Old *interface{}, Item *interface{}, Meta *RecordMeta, Data []byte) {
+	d.UpdateIndexes(Table, DatabaseName, TableName, Key, Old, Item)
+	d.Expiry.Set(DatabaseName, TableName, Key, Meta.Expires)
+	Cache.Set(DatabaseName+":"+TableName+":"+Key, Data)
+}
+
+// Patches a item in the database. The patch is applied while the table is locked so other writers can't get in between the read and the write.
+// Options can be nil. The mode in the options is ignored since a patch always needs the record to exist. The record keeps its expiry unless a new one is given.
+// Returns the new metadata and the patched item.
+func (d *DBCore) Patch(DatabaseName string, TableName string, Key string, PatchType string, Patch interface{}, Options *WriteOptions) (*RecordMeta, *interface{}, error) {
+	// Checks the table exists.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return nil, nil, err
+	}
+	if Options == nil {
+		Options = &WriteOptions{Mode: WriteReplace}
 	}
 
 	// Locks the table.
 	lock := d.GetTableLock(DatabaseName, TableName)
 	lock.Lock()
 
-	// Inserts the item into the filesystem.
-	ItemDir := path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "r", B64FSEncode(Key))
-	f, err := os.Create(ItemDir)
-	if err != nil {
-		panic(err)
+	// Gets the current version of the record.
+	Meta, Old := d.ReadRecordNonThreadSafe(DatabaseName, TableName, Key)
+	if LiveMeta(Meta) == nil {
+		lock.Unlock()
+		err := errors.New(`The record "` + Key + `" does not exist.`)
+		return nil, nil, err
 	}
-	b, err := json.Marshal(Item)
+
+	// Checks the preconditions.
+	if !Options.PreconditionsMet(Meta) {
+		lock.Unlock()
+		return nil, nil, ErrPreconditionFailed
+	}
+
+	// Applies the patch.
+	New, err := ApplyPatch(*Old, PatchType, Patch)
 	if err != nil {
-		panic(err)
+		lock.Unlock()
+		return nil, nil, err
 	}
-	_, err = f.Write(b)
+
+	// Checks the unique indexes.
+	err = d.CheckUniqueNonThreadSafe(Table, DatabaseName, TableName, Key, &New)
 	if err != nil {
-		panic(err)
+		lock.Unlock()
+		return nil, nil, err
+	}
+
+	// Writes the item.
+	NewMeta := &RecordMeta{
+		Version: d.NextVersionNonThreadSafe(DatabaseName, TableName, Meta, Options),
+		Expires: Meta.Expires,
+	}
+	if Options.Expires != 0 {
+		NewMeta.Expires = Options.Expires
 	}
+	d.WriteNonThreadSafe(Table, DatabaseName, TableName, Key, Old, &New, NewMeta)
 
 	// Unlocks the table.
 	lock.Unlock()
 
-	// Inserts into any relevant indexes if needed.
-	cast, ok := (*Item).(map[string]interface{})
-	if ok {
-		for _, v := range Table.Indexes {
-			IndexBy := make([]interface{}, 0)
-			IndexFits := true
-			for _, k := range v.Keys {
-				if cast[k] == nil {
-					IndexFits = false
-					break
-				} else {
-					IndexBy = append(IndexBy, cast[k])
-				}
-			}
+	// Yay! Return a null pointer for errors.
+	return NewMeta, &New, nil
+}
 
-			// Why? Fuck knows. Go dislikes having interface{} [] as a type for a map key apparently.
-			j, err := json.Marshal(IndexBy)
-			if err != nil {
-				panic(err)
-			}
+// Moves a record in all of the tables indexes from the old version to the new version. Either version can be nil.
+// Indexes where the keys didn't change are left alone, unless the index is being built. The build skips the records which have been written, so the record might not be in the index yet.
+func (d *DBCore) UpdateIndexes(Table *Table, DatabaseName string, TableName string, Key string, Old *interface{}, New *interface{}) {
+	for _, v := range Table.Indexes {
+		OldKeys := v.KeysFor(Old)
+		NewKeys := v.KeysFor(New)
+		if v.Build == nil && SameStrings(OldKeys, NewKeys) {
+			continue
+		}
+		if len(NewKeys) != 0 {
+			v.Insert(d.Engine, DatabaseName, TableName, NewKeys, Key)
+		} else {
+			v.DeleteItem(d.Engine, DatabaseName, TableName, Key)
+		}
 
-			if IndexFits {
-				v.Insert(d.Base, DatabaseName, TableName, string(j), Key)
-			}
+		// Marks the record as done for the build now that it is in the index.
+		if v.Build != nil {
+			v.Build.Touch(Key)
 		}
 	}
+}
 
-	// Everything worked! Return a null for error.
-	return nil
+// Inserts a item into the database.
+func (d *DBCore) Insert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := d.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteInsert})
+	return err
+}
+
+// Replaces a item which is already in the database.
+func (d *DBCore) Replace(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := d.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteReplace})
+	return err
+}
+
+// Inserts a item into the database, replacing it if it already exists.
+func (d *DBCore) Upsert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := d.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteUpsert})
+	return err
 }
 
 // Deletes a record from a table.
 func (d *DBCore) DeleteRecord(DatabaseName string, TableName string, Item string) error {
-	// Check if the item actually exists.
-	record, err := d.Get(DatabaseName, TableName, Item)
-	if err != nil {
+	return d.Delete(DatabaseName, TableName, Item, nil)
+}
+
+// Deletes a record from a table if the preconditions in the options are met. Options can be nil.
+func (d *DBCore) Delete(DatabaseName string, TableName string, Item string, Options *WriteOptions) error {
+	// Checks the table exists.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
 		return err
 	}
 
@@ -407,40 +559,46 @@ func (d *DBCore) DeleteRecord(DatabaseName string, TableName string, Item string
 	lock.Lock()
 
 	// Deletes the record.
-	e := os.Remove(path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "r", B64FSEncode(Item)))
-	if e != nil {
-		panic(e)
-	}
+	err := d.DeleteCheckedNonThreadSafe(Table, DatabaseName, TableName, Item, Options)
 
 	// Unlocks the table.
 	lock.Unlock()
 
-	// Checks if any indexes are used and handles them if they are.
-	cast, ok := (*record).(map[string]interface{})
-	if ok {
-		Table := d.Table(DatabaseName, TableName)
-		for _, v := range Table.Indexes {
-			IndexFits := true
-			for _, k := range v.Keys {
-				if cast[k] == nil {
-					IndexFits = false
-					break
-				}
-			}
+	// Returns the result.
+	return err
+}
 
-			if IndexFits {
-				v.DeleteItem(d.Base, DatabaseName, TableName, Item)
-			}
-		}
+// Checks the record exists and the preconditions are met and then deletes the record. Options can be nil. The table lock must be held when this is called.
+func (d *DBCore) DeleteCheckedNonThreadSafe(Table *Table, DatabaseName string, TableName string, Item string, Options *WriteOptions) error {
+	// Check if the item actually exists.
+	Meta, record := d.ReadRecordNonThreadSafe(DatabaseName, TableName, Item)
+	if LiveMeta(Meta) == nil {
+		err := errors.New("The item specified does not exist.")
+		return err
 	}
 
-	// Wipe the item from the cache.
-	Cache.Delete(DatabaseName + ":" + TableName + ":" + Item)
+	// Checks the preconditions.
+	if Options != nil && !Options.PreconditionsMet(Meta) {
+		return ErrPreconditionFailed
+	}
+
+	// Deletes the record.
+	d.Engine.DeleteRecord(DatabaseName, TableName, Item)
+
+	// Removes the record from any indexes, the cache and the expiry tracker.
+	d.AfterDeleteNonThreadSafe(Table, DatabaseName, TableName, Item, record)
 
 	// Yay! Return a null pointer for errors.
 	return nil
 }
 
+// Removes a record from any indexes it is in, the cache and the expiry tracker after it is deleted from the storage engine. The table lock must be held when this is called.
+func (d *DBCore) AfterDeleteNonThreadSafe(Table *Table, DatabaseName string, TableName string, Key string, Old *interface{}) {
+	d.UpdateIndexes(Table, DatabaseName, TableName, Key, Old, nil)
+	Cache.Delete(DatabaseName + ":" + TableName + ":" + Key)
+	d.Expiry.Set(DatabaseName, TableName, Key, 0)
+}
+
 // Deletes a index.
 func (d *DBCore) DeleteIndex(DatabaseName string, TableName string, IndexName string) error {
 	// Gets the table lock.
@@ -494,18 +652,28 @@ func (d *DBCore) DeleteIndex(DatabaseName string, TableName string, IndexName st
 	// Unlocks the table lock.
 	lock.Unlock()
 
-	// Do some filesystem garbage collection (this can be in the background).
-	err := os.RemoveAll(path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(IndexName)))
-	if err != nil {
-		panic(err)
-	}
+	// Do some storage garbage collection (this can be in the background).
+	d.Engine.DeleteIndex(DatabaseName, TableName, IndexName)
 
 	// Yay, no errors!
 	return nil
 }
 
 // Creates a index.
-func (d *DBCore) CreateIndex(DatabaseName string, TableName string, IndexName string, Keys []string) error {
+func (d *DBCore) CreateIndex(DatabaseName string, TableName string, IndexName string, Keys []string, Options *IndexOptions) error {
+	// Checks the options.
+	if Options == nil {
+		Options = &IndexOptions{}
+	}
+	err := Options.Validate()
+	if err != nil {
+		return err
+	}
+	err = ValidateIndexKeys(Keys)
+	if err != nil {
+		return err
+	}
+
 	// Gets the table lock.
 	lock := d.GetTableLock(DatabaseName, TableName)
 	lock.Lock()
@@ -528,18 +696,24 @@ func (d *DBCore) CreateIndex(DatabaseName string, TableName string, IndexName st
 					}
 
 					i := Index{
-						Name:            IndexName,
-						Keys:            Keys,
-						IndexLock:       nil,
-						MapPreload:      nil,
-						CurrentIndexDoc: 0,
+						Name:      IndexName,
+						Keys:      Keys,
+						Type:      Options.Type,
+						Unique:    Options.Unique,
+						MultiKey:  Options.MultiKey,
+						Filter:    Options.Filter,
+						IndexLock: nil,
+						Build:     NewIndexBuild(),
 					}
 					table.Indexes = append(table.Indexes, &i)
-					i.Init(d.Base, DatabaseName, TableName)
+					i.Init(d.Engine, DatabaseName, TableName)
 
 					d.ArrayLock.Unlock()
 					lock.Unlock()
 					d.SaveStructure()
+
+					// Adds the records already in the table in the background.
+					go d.BuildIndex(DatabaseName, TableName, &i)
 					return nil
 				}
 			}
@@ -557,7 +731,7 @@ func (d *DBCore) CreateIndex(DatabaseName string, TableName string, IndexName st
 	lock.Unlock()
 
 	// Throw an error.
-	err := errors.New(`The database "` + DatabaseName + `" does not exist.`)
+	err = errors.New(`The database "` + DatabaseName + `" does not exist.`)
 	return err
 }
 
@@ -582,10 +756,8 @@ func (d *DBCore) DeleteTable(DatabaseName string, TableName string) error {
 					db.Tables = NewTableArray
 					d.ArrayLock.Unlock()
 					d.SaveStructure()
-					err := os.RemoveAll(path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName)))
-					if err != nil {
-						panic(err)
-					}
+					d.Engine.DeleteTable(DatabaseName, TableName)
+					d.Expiry.DropTable(DatabaseName, TableName)
 					return nil
 				}
 			}
@@ -620,10 +792,8 @@ func (d *DBCore) DeleteDatabase(DatabaseName string) error {
 			d.Structure = &NewDBArray
 			d.ArrayLock.Unlock()
 			d.SaveStructure()
-			err := os.RemoveAll(path.Join(d.Base, "dbs", B64FSEncode(DatabaseName)))
-			if err != nil {
-				panic(err)
-			}
+			d.Engine.DeleteDatabase(DatabaseName)
+			d.Expiry.DropDatabase(DatabaseName)
 			return nil
 		}
 	}
@@ -634,21 +804,200 @@ func (d *DBCore) DeleteDatabase(DatabaseName string) error {
 	return err
 }
 
-// Gets all table keys.
+// Gets all table keys. Records which have expired are left out.
 func (d *DBCore) TableKeys(DatabaseName string, TableName string) ([]string, error) {
 	if d.Table(DatabaseName, TableName) == nil {
 		err := errors.New(`The table "` + TableName + `" does not exist.`)
 		return nil, err
 	}
-	files, err := ioutil.ReadDir(path.Join(d.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "r"))
+	Keys := d.Engine.RecordKeys(DatabaseName, TableName)
+	Now := NowMillis()
+	Live := make([]string, 0, len(Keys))
+	for _, k := range Keys {
+		if !d.Expiry.Expired(DatabaseName, TableName, k, Now) {
+			Live = append(Live, k)
+		}
+	}
+	return Live, nil
+}
+
+// Sets the default TTL (in seconds) of records written to a table. 0 means records don't expire by default.
+func (d *DBCore) SetTableTTL(DatabaseName string, TableName string, TTL int64) error {
+	if TTL < 0 {
+		return errors.New("The TTL cannot be negative.")
+	}
+
+	// Locks the array.
+	d.ArrayLock.Lock()
+
+	for _, db := range *d.Structure {
+		if db.Name == DatabaseName {
+			for _, table := range db.Tables {
+				if table.Name == TableName {
+					table.DefaultTTL = TTL
+					d.ArrayLock.Unlock()
+					d.SaveStructure()
+					return nil
+				}
+			}
+			d.ArrayLock.Unlock()
+			err := errors.New(`The table "` + TableName + `" does not exist.`)
+			return err
+		}
+	}
+
+	// Returns an error.
+	d.ArrayLock.Unlock()
+	err := errors.New(`The database "` + DatabaseName + `" does not exist.`)
+	return err
+}
+
+// Defines a record which was found using a index. Sort is the key the record is stored under in a ordered index, which is used to merge the records from each shard.
+type IndexRecord struct {
+	Key     string       `json:"key"`
+	Data    *interface{} `json:"data"`
+	Version uint64       `json:"version"`
+	Sort    []byte       `json:"sort,omitempty"`
+}
+
+// Gets a index on a table.
+func (d *DBCore) FindIndex(DatabaseName string, TableName string, IndexName string) (*Index, error) {
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return nil, err
+	}
+	for _, v := range Table.Indexes {
+		if v.Name == IndexName {
+			return v, nil
+		}
+	}
+	err := errors.New(`The index "` + IndexName + `" does not exist.`)
+	return nil, err
+}
+
+// Gets a index which can be queried. Indexes which are still being built or failed to build can't be.
+func (d *DBCore) QueryableIndex(DatabaseName string, TableName string, IndexName string) (*Index, error) {
+	TableIndex, err := d.FindIndex(DatabaseName, TableName, IndexName)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if Failure := d.IndexBuildFailure(DatabaseName, TableName, TableIndex); Failure != "" {
+		err := errors.New(`The index "` + IndexName + `" could not be built: ` + Failure)
+		return nil, err
+	}
+	if d.IndexBuilding(DatabaseName, TableName, TableIndex) {
+		err := errors.New(`The index "` + IndexName + `" is still being built.`)
+		return nil, err
+	}
+	return TableIndex, nil
+}
+
+// Gets the records in a table which match a query on a index. If the query limit is above 0, no more than that many records are returned.
+// On a hash index, the records are sorted by key and the cursor is the key of the last record. On a ordered index, the records are sorted by the values of the index keys and the cursor comes from EncodeOrderedCursor.
+func (d *DBCore) GetAllByIndex(DatabaseName string, TableName string, IndexName string, Query *IndexQuery) ([]*IndexRecord, error) {
+	// Gets the index.
+	TableIndex, err := d.QueryableIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return nil, err
+	}
+	Fields, err := ParseProjection(Query.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if TableIndex.FullText() {
+		err := errors.New(`The index "` + IndexName + `" is a full-text index, so it can only be searched.`)
+		return nil, err
+	}
+	if TableIndex.Ordered() {
+		return d.GetRangeByIndex(DatabaseName, TableName, TableIndex, Query)
+	}
+	if Query.HasRange() || Query.Reverse {
+		err := errors.New(`The index "` + IndexName + `" is not ordered, so it can only be queried by exact values.`)
+		return nil, err
+	}
+
+	// Gets the keys of the records in the index.
+	IndexKey, err := TableIndex.KeyForValues(Query.Values)
+	if err != nil {
+		return nil, err
 	}
-	FileArr := make([]string, len(files))
-	for i, v := range files {
-		FileArr[i] = B64FSDecode(v.Name())
+	Keys := TableIndex.Get(d.Engine, DatabaseName, TableName, IndexKey)
+	if Keys == nil {
+		return []*IndexRecord{}, nil
 	}
-	return FileArr, nil
+	Sorted := make([]string, 0, len(*Keys))
+	for _, k := range *Keys {
+		if k > Query.After {
+			Sorted = append(Sorted, k)
+		}
+	}
+	sort.Strings(Sorted)
+
+	// Reads the records. Records which have gone or changed since the index was read are skipped.
+	Records := make([]*IndexRecord, 0)
+	for i, k := range Sorted {
+		if Query.Limit > 0 && len(Records) == Query.Limit {
+			break
+		}
+		if i != 0 && Sorted[i-1] == k {
+			continue
+		}
+		Item, Meta, err := d.GetWithMeta(DatabaseName, TableName, k)
+		if err != nil {
+			continue
+		}
+		if !TableIndex.HasKey(Item, IndexKey) {
+			continue
+		}
+		Records = append(Records, &IndexRecord{Key: k, Data: Fields.Apply(Item), Version: Meta.Version})
+	}
+	return Records, nil
 }
 
-// TODO: GetAllByIndex
+// Gets the records in a range of a ordered index.
+func (d *DBCore) GetRangeByIndex(DatabaseName string, TableName string, TableIndex *Index, Query *IndexQuery) ([]*IndexRecord, error) {
+	// Works out where to start.
+	Bounds, err := TableIndex.OrderedBounds(Query)
+	if err != nil {
+		return nil, err
+	}
+	Fields, err := ParseProjection(Query.Fields)
+	if err != nil {
+		return nil, err
+	}
+	var After *IndexEntry
+	if Query.After != "" {
+		After, err = DecodeOrderedCursor(Query.After)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Reads the entries a page at a time. The index isn't locked while the records are read so writes can't deadlock with us.
+	Records := make([]*IndexRecord, 0)
+	for {
+		Wanted := Query.Limit - len(Records)
+		if Query.Limit <= 0 {
+			Wanted = 1000
+		}
+		Entries := TableIndex.OrderedRange(Bounds, Query.Reverse, After, Wanted)
+		for _, e := range Entries {
+			// Records which have gone or changed since the index was read are skipped.
+			Item, Meta, err := d.GetWithMeta(DatabaseName, TableName, e.Record)
+			if err != nil {
+				continue
+			}
+
+			// Each record is only returned at the first of its keys in the range, so the page has no repeats and the cursor always points at the same entry for it.
+			if First, ok := TableIndex.FirstKeyInRange(Item, Bounds, Query.Reverse); !ok || First != e.Key {
+				continue
+			}
+			Records = append(Records, &IndexRecord{Key: e.Record, Data: Fields.Apply(Item), Version: Meta.Version, Sort: []byte(e.Key)})
+		}
+		if len(Entries) < Wanted || (Query.Limit > 0 && len(Records) >= Query.Limit) {
+			return Records, nil
+		}
+		After = Entries[len(Entries)-1]
+	}
+}
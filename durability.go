@@ -0,0 +1,149 @@
+// This handles getting files on to the disk safely. How hard we try is set with the DURABILITY environment variable:
+//   - always (the default): The write-ahead log and segments are flushed to disk before a write returns.
+//   - batched: Flushes are grouped together and done in the background every DurabilityFlushInterval. A crash can lose the writes from the last interval.
+//   - none: Nothing is flushed. The operating system decides when things hit the disk.
+// Whatever the mode is, files are always replaced atomically (written to a temporary file, flushed, renamed over the old one and then the folder flushed). This means a crash can never leave a empty or half written file behind.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Defines the durability modes.
+const (
+	DurabilityAlways  = "always"
+	DurabilityBatched = "batched"
+	DurabilityNone    = "none"
+)
+
+// Defines the durability mode which should be used.
+var DurabilityMode = os.Getenv("DURABILITY")
+
+// How often files are flushed in the batched mode.
+var DurabilityFlushInterval = 50 * time.Millisecond
+
+// Checks the durability mode is valid.
+func CheckDurabilityMode() {
+	switch DurabilityMode {
+	case "":
+		DurabilityMode = DurabilityAlways
+	case DurabilityAlways, DurabilityBatched, DurabilityNone:
+	default:
+		panic(`The durability mode "` + DurabilityMode + `" does not exist.`)
+	}
+}
+
+// Checks if anything should be flushed to disk.
+func DurabilityFlushes() bool {
+	return DurabilityMode != DurabilityNone
+}
+
+// Defines the files which are waiting to be flushed in the batched mode.
+type BatchedFlusher struct {
+	Lock    *sync.Mutex
+	Pending map[*os.File]bool
+	Started bool
+}
+
+// Defines the flusher used in the batched mode.
+var Flusher = &BatchedFlusher{
+	Lock:    &sync.Mutex{},
+	Pending: map[*os.File]bool{},
+}
+
+// Adds a file to be flushed on the next interval.
+func (b *BatchedFlusher) Add(f *os.File) {
+	b.Lock.Lock()
+	b.Pending[f] = true
+	if !b.Started {
+		b.Started = true
+		go b.Loop()
+	}
+	b.Lock.Unlock()
+}
+
+// Flushes all the files which are waiting. Files which were closed since they were added are skipped.
+func (b *BatchedFlusher) Flush() {
+	b.Lock.Lock()
+	Pending := b.Pending
+	b.Pending = map[*os.File]bool{}
+	b.Lock.Unlock()
+	for f := range Pending {
+		err := f.Sync()
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			panic(err)
+		}
+	}
+}
+
+// Flushes the waiting files every interval.
+func (b *BatchedFlusher) Loop() {
+	for {
+		time.Sleep(DurabilityFlushInterval)
+		b.Flush()
+	}
+}
+
+// Flushes a file which was just written to. Depending on the durability mode, this happens now, on the next interval or not at all.
+func SyncFile(f *os.File) {
+	switch DurabilityMode {
+	case DurabilityBatched:
+		Flusher.Add(f)
+	case DurabilityNone:
+	default:
+		err := f.Sync()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Flushes a folder so that files which were created, renamed or removed inside of it stay that way.
+func SyncDir(Dir string) error {
+	f, err := os.Open(Dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	_ = f.Close()
+	return err
+}
+
+// Atomically replaces a file. The data is written to a temporary file in the same folder which is then renamed over the file. If Sync is true, the temporary file is flushed before the rename and the folder is flushed after it.
+func AtomicWriteFile(FullPath string, Data []byte, Sync bool) error {
+	// Writes the temporary file.
+	Dir := path.Dir(FullPath)
+	f, err := ioutil.TempFile(Dir, "."+path.Base(FullPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(Data)
+	if err == nil && Sync {
+		err = f.Sync()
+	}
+	CloseErr := f.Close()
+	if err == nil {
+		err = CloseErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	// Renames it over the file.
+	err = os.Rename(f.Name(), FullPath)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if Sync {
+		return SyncDir(Dir)
+	}
+	return nil
+}
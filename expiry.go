@@ -0,0 +1,167 @@
+// This handles records which expire. The time each expiring record expires at is kept in memory so that expired records can be hidden straight away and so the reaper knows what to remove.
+// Only tables which have had a expiring record written to them are scanned when the DB core starts up.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Defines how often the reaper looks for expired records.
+var ExpiryReapInterval = time.Second
+
+// Defines a record which has expired.
+type ExpiredRecord struct {
+	DB    string
+	Table string
+	Key   string
+}
+
+// Keeps track of when records expire.
+type ExpiryTracker struct {
+	Lock      *sync.RWMutex
+	Databases map[string]map[string]map[string]int64
+}
+
+// Creates the expiry tracker.
+func NewExpiryTracker() *ExpiryTracker {
+	return &ExpiryTracker{
+		Lock:      &sync.RWMutex{},
+		Databases: map[string]map[string]map[string]int64{},
+	}
+}
+
+// Sets when a record expires. 0 means the record doesn't expire.
+func (e *ExpiryTracker) Set(DatabaseName string, TableName string, Key string, Expires int64) {
+	e.Lock.Lock()
+	defer e.Lock.Unlock()
+	db := e.Databases[DatabaseName]
+	if Expires == 0 {
+		if db != nil && db[TableName] != nil {
+			delete(db[TableName], Key)
+		}
+		return
+	}
+	if db == nil {
+		db = map[string]map[string]int64{}
+		e.Databases[DatabaseName] = db
+	}
+	if db[TableName] == nil {
+		db[TableName] = map[string]int64{}
+	}
+	db[TableName][Key] = Expires
+}
+
+// Checks if a record has expired.
+func (e *ExpiryTracker) Expired(DatabaseName string, TableName string, Key string, Now int64) bool {
+	e.Lock.RLock()
+	defer e.Lock.RUnlock()
+	Expires := e.Databases[DatabaseName][TableName][Key]
+	return Expires != 0 && Now >= Expires
+}
+
+// Gets all the records which have expired.
+func (e *ExpiryTracker) Due(Now int64) []ExpiredRecord {
+	e.Lock.RLock()
+	defer e.Lock.RUnlock()
+	Records := []ExpiredRecord{}
+	for DatabaseName, db := range e.Databases {
+		for TableName, table := range db {
+			for Key, Expires := range table {
+				if Now >= Expires {
+					Records = append(Records, ExpiredRecord{DB: DatabaseName, Table: TableName, Key: Key})
+				}
+			}
+		}
+	}
+	return Records
+}
+
+// Forgets all of the records in a table.
+func (e *ExpiryTracker) DropTable(DatabaseName string, TableName string) {
+	e.Lock.Lock()
+	if e.Databases[DatabaseName] != nil {
+		delete(e.Databases[DatabaseName], TableName)
+	}
+	e.Lock.Unlock()
+}
+
+// Forgets all of the records in a database.
+func (e *ExpiryTracker) DropDatabase(DatabaseName string) {
+	e.Lock.Lock()
+	delete(e.Databases, DatabaseName)
+	e.Lock.Unlock()
+}
+
+// Loads when the records in a table expire from the storage engine.
+func (d *DBCore) LoadExpiries(DatabaseName string, TableName string) {
+	for _, Key := range d.Engine.RecordKeys(DatabaseName, TableName) {
+		data := d.Engine.ReadRecord(DatabaseName, TableName, Key)
+		if data == nil {
+			continue
+		}
+		Meta, _ := DecodeRecord(data)
+		d.Expiry.Set(DatabaseName, TableName, Key, Meta.Expires)
+	}
+}
+
+// Marks a table as having expiring records so the expiries are loaded when the DB core starts up. The table lock must be held when this is called.
+func (d *DBCore) MarkTableExpiringNonThreadSafe(DatabaseName string, TableName string) {
+	Changed := false
+	d.ArrayLock.Lock()
+	for _, db := range *d.Structure {
+		if db.Name == DatabaseName {
+			for _, table := range db.Tables {
+				if table.Name == TableName && !table.Expiring {
+					table.Expiring = true
+					Changed = true
+				}
+			}
+		}
+	}
+	d.ArrayLock.Unlock()
+	if Changed {
+		d.SaveStructure()
+	}
+}
+
+// Removes a record if it has expired. The expiry is checked again under the table lock in case the record was written again since it was found.
+func (d *DBCore) Reap(DatabaseName string, TableName string, Key string) {
+	// Gets the table.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		d.Expiry.DropTable(DatabaseName, TableName)
+		return
+	}
+
+	// Locks the table.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Checks the record has expired.
+	Meta, Old := d.ReadRecordNonThreadSafe(DatabaseName, TableName, Key)
+	if Old == nil {
+		d.Expiry.Set(DatabaseName, TableName, Key, 0)
+		return
+	}
+	if !Meta.Expired(NowMillis()) {
+		d.Expiry.Set(DatabaseName, TableName, Key, Meta.Expires)
+		return
+	}
+
+	// Removes the record from the storage engine, the indexes and the cache.
+	d.Engine.DeleteRecord(DatabaseName, TableName, Key)
+	d.AfterDeleteNonThreadSafe(Table, DatabaseName, TableName, Key, Old)
+}
+
+// Removes expired records in the background.
+func (d *DBCore) ExpiryReaper() {
+	for {
+		time.Sleep(ExpiryReapInterval)
+		for _, v := range d.Expiry.Due(NowMillis()) {
+			d.Reap(v.DB, v.Table, v.Key)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// This is the filesystem storage engine. Every record is stored as its own file and every change goes through the write-ahead log.
+// The layout is:
+//   - structure: The DB structure.
+//   - dbs/<database>/<table>/r/<key>: A record.
+//   - dbs/<database>/<table>/i/<index>/<file>: A index file.
+// All database, table, key, index and file names are encoded with B64FSEncode.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Defines the filesystem storage engine.
+type FilesystemEngine struct {
+	Base string
+	WAL  *WriteAheadLog
+}
+
+// Creates the filesystem storage engine inside the base folder.
+func NewFilesystemEngine(Base string) *FilesystemEngine {
+	if _, err := os.Stat(Base); os.IsNotExist(err) {
+		// Folder doesn't exist. Make the folder.
+		err := os.Mkdir(Base, 0777)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if _, err := os.Stat(path.Join(Base, "dbs")); os.IsNotExist(err) {
+		// Folder doesn't exist. Make the folder.
+		err := os.Mkdir(path.Join(Base, "dbs"), 0777)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Opens the write-ahead log. This replays anything left over from a crash before we load anything else.
+	return &FilesystemEngine{
+		Base: Base,
+		WAL:  NewWriteAheadLog(Base),
+	}
+}
+
+// Gets the path to a table.
+func (f *FilesystemEngine) TablePath(DatabaseName string, TableName string) string {
+	return path.Join(f.Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName))
+}
+
+// Gets the path to a index.
+func (f *FilesystemEngine) IndexPath(DatabaseName string, TableName string, IndexName string) string {
+	return path.Join(f.TablePath(DatabaseName, TableName), "i", B64FSEncode(IndexName))
+}
+
+// Reads a file, returning nil if it doesn't exist.
+func ReadFileIfExists(FilePath string) []byte {
+	data, err := ioutil.ReadFile(FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		panic(err)
+	}
+	return data
+}
+
+// Lists a folder and decodes the names, returning a empty array if it doesn't exist. Temporary files are skipped.
+func ReadEncodedDir(DirPath string) []string {
+	files, err := ioutil.ReadDir(DirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}
+		}
+		panic(err)
+	}
+	FileArr := make([]string, 0, len(files))
+	for _, v := range files {
+		if strings.HasPrefix(v.Name(), ".") {
+			// This is a temporary file from a atomic write. Encoded names never start with a dot.
+			continue
+		}
+		FileArr = append(FileArr, B64FSDecode(v.Name()))
+	}
+	return FileArr
+}
+
+// Loads the DB structure.
+func (f *FilesystemEngine) LoadStructure() []byte {
+	return ReadFileIfExists(path.Join(f.Base, "structure"))
+}
+
+// Saves the DB structure.
+func (f *FilesystemEngine) SaveStructure(Data []byte) {
+	f.WAL.WriteFile(path.Join(f.Base, "structure"), Data)
+}
+
+// Creates the folder for a database.
+func (f *FilesystemEngine) CreateDatabase(DatabaseName string) {
+	f.WAL.Mkdir(path.Join(f.Base, "dbs", B64FSEncode(DatabaseName)))
+}
+
+// Deletes the folder for a database.
+func (f *FilesystemEngine) DeleteDatabase(DatabaseName string) {
+	f.WAL.RemoveAll(path.Join(f.Base, "dbs", B64FSEncode(DatabaseName)))
+}
+
+// Creates the folders for a table.
+func (f *FilesystemEngine) CreateTable(DatabaseName string, TableName string) {
+	TableDir := f.TablePath(DatabaseName, TableName)
+	f.WAL.Commit([]*WALEntry{
+		{Op: WALMkdir, Path: f.WAL.Relative(path.Join(TableDir, "r"))},
+		{Op: WALMkdir, Path: f.WAL.Relative(path.Join(TableDir, "i"))},
+	})
+}
+
+// Deletes the folder for a table.
+func (f *FilesystemEngine) DeleteTable(DatabaseName string, TableName string) {
+	f.WAL.RemoveAll(f.TablePath(DatabaseName, TableName))
+}
+
+// Reads a record file.
+func (f *FilesystemEngine) ReadRecord(DatabaseName string, TableName string, Key string) []byte {
+	return ReadFileIfExists(path.Join(f.TablePath(DatabaseName, TableName), "r", B64FSEncode(Key)))
+}
+
+// Writes a record file.
+func (f *FilesystemEngine) WriteRecord(DatabaseName string, TableName string, Key string, Data []byte) {
+	f.WAL.WriteFile(path.Join(f.TablePath(DatabaseName, TableName), "r", B64FSEncode(Key)), Data)
+}
+
+// Deletes a record file.
+func (f *FilesystemEngine) DeleteRecord(DatabaseName string, TableName string, Key string) {
+	f.WAL.Remove(path.Join(f.TablePath(DatabaseName, TableName), "r", B64FSEncode(Key)))
+}
+
+// Writes and deletes a batch of record files in one write-ahead log commit.
+func (f *FilesystemEngine) ApplyBatch(Changes []*RecordChange) {
+	Batch := make([]*WALEntry, len(Changes))
+	for i, v := range Changes {
+		RecordPath := f.WAL.Relative(path.Join(f.TablePath(v.DB, v.Table), "r", B64FSEncode(v.Key)))
+		if v.Data == nil {
+			Batch[i] = &WALEntry{Op: WALRemove, Path: RecordPath}
+		} else {
+			Batch[i] = &WALEntry{Op: WALWrite, Path: RecordPath, Data: v.Data}
+		}
+	}
+	f.WAL.Commit(Batch)
+}
+
+// Lists the record files in a table.
+func (f *FilesystemEngine) RecordKeys(DatabaseName string, TableName string) []string {
+	return ReadEncodedDir(path.Join(f.TablePath(DatabaseName, TableName), "r"))
+}
+
+// Creates the folder for a index.
+func (f *FilesystemEngine) CreateIndex(DatabaseName string, TableName string, IndexName string) {
+	IndexDir := f.IndexPath(DatabaseName, TableName, IndexName)
+	if _, err := os.Stat(IndexDir); os.IsNotExist(err) {
+		f.WAL.Mkdir(IndexDir)
+	}
+}
+
+// Deletes the folder for a index.
+func (f *FilesystemEngine) DeleteIndex(DatabaseName string, TableName string, IndexName string) {
+	f.WAL.RemoveAll(f.IndexPath(DatabaseName, TableName, IndexName))
+}
+
+// Lists the files in a index.
+func (f *FilesystemEngine) IndexFiles(DatabaseName string, TableName string, IndexName string) []string {
+	return ReadEncodedDir(f.IndexPath(DatabaseName, TableName, IndexName))
+}
+
+// Reads a index file.
+func (f *FilesystemEngine) ReadIndexFile(DatabaseName string, TableName string, IndexName string, File string) []byte {
+	return ReadFileIfExists(path.Join(f.IndexPath(DatabaseName, TableName, IndexName), B64FSEncode(File)))
+}
+
+// Writes a index file.
+func (f *FilesystemEngine) WriteIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte) {
+	f.WAL.WriteFile(path.Join(f.IndexPath(DatabaseName, TableName, IndexName), B64FSEncode(File)), Data)
+}
+
+// Appends to a index file.
+func (f *FilesystemEngine) AppendIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte) {
+	f.WAL.AppendFile(path.Join(f.IndexPath(DatabaseName, TableName, IndexName), B64FSEncode(File)), Data)
+}
+
+// Deletes a index file.
+func (f *FilesystemEngine) DeleteIndexFile(DatabaseName string, TableName string, IndexName string, File string) {
+	f.WAL.Remove(path.Join(f.IndexPath(DatabaseName, TableName, IndexName), B64FSEncode(File)))
+}
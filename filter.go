@@ -0,0 +1,248 @@
+// This handles filters, which pick out the records a partial index holds. A filter is a JSON object like {"status": "open", "total": {"$gt": 100}}:
+//   - Each field is a index key path (see index_path.go) and every field has to match.
+//   - A plain value has to be equal to the value in the record.
+//   - A object of operators compares the value in the record: $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin and $exists. Ranges compare numbers with numbers and strings with strings.
+//   - $and and $or hold arrays of filters, and $not holds a filter.
+// A field which the record doesn't have only matches $ne, $nin and {"$exists": false}.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Defines the operators which can be used on a field in a filter.
+const (
+	FilterEq     = "$eq"
+	FilterNe     = "$ne"
+	FilterGt     = "$gt"
+	FilterGte    = "$gte"
+	FilterLt     = "$lt"
+	FilterLte    = "$lte"
+	FilterIn     = "$in"
+	FilterNin    = "$nin"
+	FilterExists = "$exists"
+)
+
+// Defines a comparison of one field in a filter.
+type FilterClause struct {
+	Key   string
+	Op    string
+	Value interface{}
+}
+
+// Defines a parsed filter. Everything in it has to match.
+type Filter struct {
+	Clauses []*FilterClause
+	And     []*Filter
+	Or      []*Filter
+	Not     *Filter
+}
+
+// Parses a filter from its JSON.
+func ParseFilter(Raw interface{}) (*Filter, error) {
+	Object, ok := Raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("A filter must be a JSON object.")
+	}
+	f := &Filter{Clauses: []*FilterClause{}}
+	for k, v := range Object {
+		switch k {
+		case "$and", "$or":
+			Array, ok := v.([]interface{})
+			if !ok || len(Array) == 0 {
+				return nil, errors.New(`The "` + k + `" in a filter must be a array of filters which is not empty.`)
+			}
+			for _, e := range Array {
+				Child, err := ParseFilter(e)
+				if err != nil {
+					return nil, err
+				}
+				if k == "$and" {
+					f.And = append(f.And, Child)
+				} else {
+					f.Or = append(f.Or, Child)
+				}
+			}
+		case "$not":
+			Child, err := ParseFilter(v)
+			if err != nil {
+				return nil, err
+			}
+			f.Not = Child
+		default:
+			if strings.HasPrefix(k, "$") {
+				return nil, errors.New(`The filter operator "` + k + `" does not exist.`)
+			}
+			if _, err := ParseIndexPath(k); err != nil {
+				return nil, err
+			}
+			Clauses, err := ParseFilterCondition(k, v)
+			if err != nil {
+				return nil, err
+			}
+			f.Clauses = append(f.Clauses, Clauses...)
+		}
+	}
+
+	// Sorts the clauses so the same filter always gives the same clauses.
+	sort.Slice(f.Clauses, func(a, b int) bool {
+		if f.Clauses[a].Key != f.Clauses[b].Key {
+			return f.Clauses[a].Key < f.Clauses[b].Key
+		}
+		return f.Clauses[a].Op < f.Clauses[b].Op
+	})
+	return f, nil
+}
+
+// Parses the condition on one field of a filter. A object of operators gives a clause for each operator, and anything else is compared with $eq.
+func ParseFilterCondition(Key string, Condition interface{}) ([]*FilterClause, error) {
+	Operators, ok := Condition.(map[string]interface{})
+	if !ok || len(Operators) == 0 {
+		return []*FilterClause{{Key: Key, Op: FilterEq, Value: Condition}}, nil
+	}
+	for Op := range Operators {
+		if !strings.HasPrefix(Op, "$") {
+			// This is a object to compare with, not a object of operators.
+			return []*FilterClause{{Key: Key, Op: FilterEq, Value: Condition}}, nil
+		}
+	}
+	Clauses := make([]*FilterClause, 0, len(Operators))
+	for Op, Value := range Operators {
+		switch Op {
+		case FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte:
+		case FilterIn, FilterNin:
+			if _, ok := Value.([]interface{}); !ok {
+				return nil, errors.New(`The "` + Op + `" on "` + Key + `" must be a array.`)
+			}
+		case FilterExists:
+			if _, ok := Value.(bool); !ok {
+				return nil, errors.New(`The "` + Op + `" on "` + Key + `" must be true or false.`)
+			}
+		default:
+			return nil, errors.New(`The filter operator "` + Op + `" does not exist.`)
+		}
+		Clauses = append(Clauses, &FilterClause{Key: Key, Op: Op, Value: Value})
+	}
+	return Clauses, nil
+}
+
+// Checks if two JSON values are equal.
+func FilterEqual(A interface{}, B interface{}) bool {
+	switch a := A.(type) {
+	case nil:
+		return B == nil
+	case string:
+		b, ok := B.(string)
+		return ok && a == b
+	case float64:
+		b, ok := B.(float64)
+		return ok && a == b
+	case bool:
+		b, ok := B.(bool)
+		return ok && a == b
+	}
+	return JSONEqual(A, B)
+}
+
+// Compares two values for a range. The boolean is false if they can't be compared.
+func FilterCompare(A interface{}, B interface{}) (int, bool) {
+	switch a := A.(type) {
+	case float64:
+		b, ok := B.(float64)
+		if !ok {
+			return 0, false
+		}
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := B.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// Checks if a record matches the clause.
+func (c *FilterClause) Matches(Record map[string]interface{}) bool {
+	Value, Exists := LookupIndexKey(Record, c.Key)
+	switch c.Op {
+	case FilterExists:
+		return Exists == c.Value.(bool)
+	case FilterNe:
+		return !Exists || !FilterEqual(Value, c.Value)
+	case FilterNin:
+		if !Exists {
+			return true
+		}
+		for _, v := range c.Value.([]interface{}) {
+			if FilterEqual(Value, v) {
+				return false
+			}
+		}
+		return true
+	}
+	if !Exists {
+		return false
+	}
+	switch c.Op {
+	case FilterEq:
+		return FilterEqual(Value, c.Value)
+	case FilterIn:
+		for _, v := range c.Value.([]interface{}) {
+			if FilterEqual(Value, v) {
+				return true
+			}
+		}
+		return false
+	}
+	Compared, ok := FilterCompare(Value, c.Value)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case FilterGt:
+		return Compared > 0
+	case FilterGte:
+		return Compared >= 0
+	case FilterLt:
+		return Compared < 0
+	default:
+		return Compared <= 0
+	}
+}
+
+// Checks if a record matches the filter.
+func (f *Filter) Matches(Record map[string]interface{}) bool {
+	for _, c := range f.Clauses {
+		if !c.Matches(Record) {
+			return false
+		}
+	}
+	for _, v := range f.And {
+		if !v.Matches(Record) {
+			return false
+		}
+	}
+	if len(f.Or) != 0 {
+		Matched := false
+		for _, v := range f.Or {
+			if v.Matches(Record) {
+				Matched = true
+				break
+			}
+		}
+		if !Matched {
+			return false
+		}
+	}
+	return f.Not == nil || !f.Not.Matches(Record)
+}
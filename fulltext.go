@@ -0,0 +1,477 @@
+// This handles full-text indexes. A full-text index splits the strings in its keys into words, lowercases and stems them (see stemmer.go), and keeps a inverted index of where each term is in each record.
+// The index uses the same B-tree and files as the other indexes (see index_store.go). Each word in a record is one entry, stored under the term and its position, so:
+//   - The records holding a term are found by reading the entries which start with the term.
+//   - The positions let a phrase be matched by checking the terms come one after another.
+//   - The number of words in a record is the number of entries it has, which BM25 needs.
+// Searches are ranked with BM25. Since the records are split across shards, the shard layer gets the document counts from every shard first so each shard scores with the same numbers.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The BM25 parameters. K1 is how quickly more of the same term stops raising the score and B is how much long records are penalised.
+const (
+	BM25K1 = 1.2
+	BM25B  = 0.75
+)
+
+// The number of results returned by a search if no limit is given.
+const SearchDefaultLimit = 20
+
+// The most results which can be returned by a search.
+const SearchMaxLimit = 1000
+
+// How deep into the results a search can page. Every shard scores and sends back the results up to the end of the page, so the offset plus the limit can't go past this.
+const SearchMaxDepth = SearchMaxLimit * 10
+
+// Splits text into lowercase words and stems them.
+func Tokenize(Text string) []string {
+	Words := strings.FieldsFunc(strings.ToLower(Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range Words {
+		Words[i] = PorterStem(w)
+	}
+	return Words
+}
+
+// Gets the key a word is stored under in a full-text index. The position is big endian so the entries for a term are sorted by position.
+func FullTextKey(Term string, Position int) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(Position))
+	return Term + "\x00" + string(b)
+}
+
+// Gets the term and position back from a key in a full-text index.
+func SplitFullTextKey(Key string) (string, int) {
+	Split := len(Key) - 5
+	if Split < 0 || Key[Split] != 0 {
+		return Key, 0
+	}
+	return Key[:Split], int(binary.BigEndian.Uint32([]byte(Key[Split+1:])))
+}
+
+// Checks if the index is a full-text index.
+func (i *Index) FullText() bool {
+	return i.Type == IndexTypeFullText
+}
+
+// Gets the keys a record is stored under in a full-text index. Strings and arrays of strings are indexed. A position is skipped between each value so a phrase can't match across two of them.
+func (i *Index) FullTextKeysFor(Record map[string]interface{}) []string {
+	Keys := make([]string, 0)
+	Position := 0
+	Add := func(Value interface{}) {
+		Text, ok := Value.(string)
+		if !ok {
+			return
+		}
+		for _, Term := range Tokenize(Text) {
+			Keys = append(Keys, FullTextKey(Term, Position))
+			Position++
+		}
+		Position++
+	}
+	for _, k := range i.Keys {
+		Value := IndexKeyValue(Record, k)
+		if Array, ok := Value.([]interface{}); ok {
+			for _, e := range Array {
+				Add(e)
+			}
+		} else {
+			Add(Value)
+		}
+	}
+	if len(Keys) == 0 {
+		return nil
+	}
+	sort.Strings(Keys)
+	return Keys
+}
+
+// Gets the positions of a term in each record which has it. The index lock should be held when this is called.
+func (i *Index) PostingsNonThreadSafe(Term string) map[string][]int {
+	Postings := map[string][]int{}
+	Prefix := Term + "\x00"
+	i.Tree.Ascend(&IndexEntry{Key: Prefix}, func(Entry *IndexEntry) bool {
+		if !strings.HasPrefix(Entry.Key, Prefix) {
+			return false
+		}
+		_, Position := SplitFullTextKey(Entry.Key)
+		Postings[Entry.Record] = append(Postings[Entry.Record], Position)
+		return true
+	})
+	return Postings
+}
+
+// Defines a search on a full-text index. Words in double quotes are a phrase which records have to contain. Other words are optional, but a record has to contain one of them if there are no phrases.
+type SearchQuery struct {
+	Query  string `json:"query"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// Defines a search query after it has been split into terms.
+type ParsedSearch struct {
+	Terms   []string
+	Phrases [][]string
+}
+
+// Splits a search query into its terms and phrases. A quote which isn't closed runs to the end of the query.
+func ParseSearchQuery(Query string) (*ParsedSearch, error) {
+	Parsed := &ParsedSearch{Terms: []string{}, Phrases: [][]string{}}
+	for i, Part := range strings.Split(Query, `"`) {
+		Terms := Tokenize(Part)
+		if i%2 == 0 {
+			Parsed.Terms = append(Parsed.Terms, Terms...)
+		} else if len(Terms) != 0 {
+			Parsed.Phrases = append(Parsed.Phrases, Terms)
+		}
+	}
+	if len(Parsed.Terms) == 0 && len(Parsed.Phrases) == 0 {
+		return nil, errors.New("The search query has no words in it.")
+	}
+	return Parsed, nil
+}
+
+// Gets every term in the search once.
+func (p *ParsedSearch) AllTerms() []string {
+	Seen := map[string]bool{}
+	All := make([]string, 0)
+	Add := func(Terms []string) {
+		for _, t := range Terms {
+			if !Seen[t] {
+				Seen[t] = true
+				All = append(All, t)
+			}
+		}
+	}
+	Add(p.Terms)
+	for _, v := range p.Phrases {
+		Add(v)
+	}
+	return All
+}
+
+// Defines the numbers BM25 needs about a full-text index. Frequencies is how many records have each term.
+type FullTextStats struct {
+	Documents   int            `json:"documents"`
+	Tokens      int            `json:"tokens"`
+	Frequencies map[string]int `json:"frequencies"`
+}
+
+// Adds the numbers from another shard.
+func (s *FullTextStats) Add(Other *FullTextStats) {
+	s.Documents += Other.Documents
+	s.Tokens += Other.Tokens
+	for k, v := range Other.Frequencies {
+		s.Frequencies[k] += v
+	}
+}
+
+// Gets the BM25 score of a term which is in a record Count times.
+func (s *FullTextStats) Score(Term string, Count int, Length int) float64 {
+	Frequency := float64(s.Frequencies[Term])
+	IDF := math.Log(1 + (float64(s.Documents)-Frequency+0.5)/(Frequency+0.5))
+	Average := 1.0
+	if s.Documents != 0 {
+		Average = float64(s.Tokens) / float64(s.Documents)
+	}
+	c := float64(Count)
+	return IDF * c * (BM25K1 + 1) / (c + BM25K1*(1-BM25B+BM25B*float64(Length)/Average))
+}
+
+// Defines a record found by a search.
+type SearchResult struct {
+	Key     string       `json:"key"`
+	Data    *interface{} `json:"data"`
+	Version uint64       `json:"version"`
+	Score   float64      `json:"score"`
+}
+
+// Gets a full-text index which can be searched.
+func (d *DBCore) SearchableIndex(DatabaseName string, TableName string, IndexName string) (*Index, error) {
+	TableIndex, err := d.QueryableIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return nil, err
+	}
+	if !TableIndex.FullText() {
+		err := errors.New(`The index "` + IndexName + `" is not a full-text index.`)
+		return nil, err
+	}
+	return TableIndex, nil
+}
+
+// Gets the numbers BM25 needs for the terms in a search from a full-text index on this shard.
+func (d *DBCore) SearchStats(DatabaseName string, TableName string, IndexName string, Query string) (*FullTextStats, error) {
+	TableIndex, err := d.SearchableIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return nil, err
+	}
+	Parsed, err := ParseSearchQuery(Query)
+	if err != nil {
+		return nil, err
+	}
+	Stats := &FullTextStats{Frequencies: map[string]int{}}
+	TableIndex.IndexLock.RLock()
+	Stats.Documents = len(TableIndex.Records)
+	Stats.Tokens = TableIndex.Tree.Length
+	for _, t := range Parsed.AllTerms() {
+		Stats.Frequencies[t] = len(TableIndex.PostingsNonThreadSafe(t))
+	}
+	TableIndex.IndexLock.RUnlock()
+	return Stats, nil
+}
+
+// Checks if the terms of a phrase come one after another somewhere in a record.
+func PhraseMatches(Phrase []string, Postings map[string]map[string][]int, Record string) bool {
+	for _, Start := range Postings[Phrase[0]][Record] {
+		Matched := true
+		for x, t := range Phrase[1:] {
+			Positions := Postings[t][Record]
+			i := sort.SearchInts(Positions, Start+x+1)
+			if i == len(Positions) || Positions[i] != Start+x+1 {
+				Matched = false
+				break
+			}
+		}
+		if Matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Searches a full-text index on this shard, returning the best Offset+Limit results from the highest score down.
+// The scores use the stats given, which should be for the whole cluster. If they are nil, the stats for this shard are used.
+func (d *DBCore) Search(DatabaseName string, TableName string, IndexName string, Query *SearchQuery, Stats *FullTextStats) ([]*SearchResult, error) {
+	TableIndex, err := d.SearchableIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return nil, err
+	}
+	Parsed, err := ParseSearchQuery(Query.Query)
+	if err != nil {
+		return nil, err
+	}
+	if Stats == nil {
+		Stats, err = d.SearchStats(DatabaseName, TableName, IndexName, Query.Query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Gets the postings for each term and scores the records which match.
+	TableIndex.IndexLock.RLock()
+	Postings := map[string]map[string][]int{}
+	for _, t := range Parsed.AllTerms() {
+		Postings[t] = TableIndex.PostingsNonThreadSafe(t)
+	}
+	Candidates := map[string]bool{}
+	if len(Parsed.Phrases) != 0 {
+		for r := range Postings[Parsed.Phrases[0][0]] {
+			Candidates[r] = true
+		}
+	} else {
+		for _, t := range Parsed.Terms {
+			for r := range Postings[t] {
+				Candidates[r] = true
+			}
+		}
+	}
+	Results := make([]*SearchResult, 0)
+	for r := range Candidates {
+		Matched := true
+		for _, Phrase := range Parsed.Phrases {
+			if !PhraseMatches(Phrase, Postings, r) {
+				Matched = false
+				break
+			}
+		}
+		if !Matched {
+			continue
+		}
+		Length := len(TableIndex.Records[r])
+		Score := 0.0
+		for t, p := range Postings {
+			if Count := len(p[r]); Count != 0 {
+				Score += Stats.Score(t, Count, Length)
+			}
+		}
+		Results = append(Results, &SearchResult{Key: r, Score: Score})
+	}
+	TableIndex.IndexLock.RUnlock()
+
+	// Sorts the results and cuts them down to the page.
+	SortSearchResults(Results)
+	if Query.Limit > 0 && len(Results) > Query.Offset+Query.Limit {
+		Results = Results[:Query.Offset+Query.Limit]
+	}
+
+	// Reads the records. Records which have gone since the index was read are skipped.
+	Found := make([]*SearchResult, 0, len(Results))
+	for _, v := range Results {
+		Item, Meta, err := d.GetWithMeta(DatabaseName, TableName, v.Key)
+		if err != nil {
+			continue
+		}
+		v.Data = Item
+		v.Version = Meta.Version
+		Found = append(Found, v)
+	}
+	return Found, nil
+}
+
+// Sorts search results from the highest score down. Results with the same score are sorted by key.
+func SortSearchResults(Results []*SearchResult) {
+	sort.Slice(Results, func(a, b int) bool {
+		if Results[a].Score != Results[b].Score {
+			return Results[a].Score > Results[b].Score
+		}
+		return Results[a].Key < Results[b].Key
+	})
+}
+
+// Defines a page of search results. Next is the offset to get the next page from, or nil if this is the last page.
+type SearchPage struct {
+	Results []*SearchResult `json:"results"`
+	Next    *int            `json:"next"`
+}
+
+// The remote search structure. If StatsOnly is true, the shard only returns its stats.
+type RemoteSearchStructure struct {
+	SearchQuery
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Index string `json:"index"`
+	Stats *FullTextStats `json:"stats,omitempty"`
+	StatsOnly bool `json:"stats_only,omitempty"`
+}
+
+// The response from a remote shard after a search.
+type RemoteSearchResponse struct {
+	Err *string `json:"error"`
+	Stats *FullTextStats `json:"stats,omitempty"`
+	Results []*SearchResult `json:"results,omitempty"`
+}
+
+// Searches a full-text index on one shard, or gets its stats if StatsOnly is true.
+func (s *Shard) SearchOnShard(ShardID string, Query *RemoteSearchStructure) (*RemoteSearchResponse, error) {
+	var Response RemoteSearchResponse
+	if s.ShardURLS[ShardID] == "" {
+		var err error
+		if Query.StatsOnly {
+			Response.Stats, err = Core.SearchStats(Query.DB, Query.Table, Query.Index, Query.Query)
+		} else {
+			Response.Results, err = Core.Search(Query.DB, Query.Table, Query.Index, &Query.SearchQuery, Query.Stats)
+		}
+		return &Response, err
+	}
+	PostToShard(s.ShardURLS[ShardID], "/_shard/search", Query, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return &Response, nil
+}
+
+// Asks every shard in parallel. The function is called with each response while a lock is held.
+func (s *Shard) SearchAllShards(Query *RemoteSearchStructure, Handler func(*RemoteSearchResponse)) error {
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Response, err := s.SearchOnShard(ShardID, Query)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			} else {
+				Handler(Response)
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	return Failed
+}
+
+// Gets a page of the records which match a search on a full-text index, from the highest score down.
+// The stats from every shard are added up first and sent with the search, so the scores from each shard can be compared. Replicas are counted in the stats as well, which raises every count by about the same amount and so barely changes the order.
+// Replicas of the same record are only returned once (the newest version wins).
+func (s *Shard) Search(DatabaseName string, TableName string, IndexName string, Query *SearchQuery) (*SearchPage, error) {
+	if Query.Offset < 0 || Query.Limit < 0 || Query.Limit > SearchMaxDepth || Query.Offset > SearchMaxDepth-Query.Limit {
+		return nil, errors.New("The offset and limit of a search can't go past the first " + strconv.Itoa(SearchMaxDepth) + " results.")
+	}
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before searching indexes.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Gets the stats for the whole cluster.
+	ShardQuery := &RemoteSearchStructure{
+		SearchQuery: *Query,
+		DB: DatabaseName,
+		Table: TableName,
+		Index: IndexName,
+		StatsOnly: true,
+	}
+	Stats := &FullTextStats{Frequencies: map[string]int{}}
+	err := s.SearchAllShards(ShardQuery, func(Response *RemoteSearchResponse) {
+		if Response.Stats != nil {
+			Stats.Add(Response.Stats)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Asks each shard for the results up to one past the end of the page. If there is more than that after merging, there is another page.
+	ShardQuery.StatsOnly = false
+	ShardQuery.Stats = Stats
+	ShardQuery.Offset = 0
+	ShardQuery.Limit = Query.Offset + Query.Limit + 1
+	Merged := map[string]*SearchResult{}
+	err = s.SearchAllShards(ShardQuery, func(Response *RemoteSearchResponse) {
+		for _, v := range Response.Results {
+			if Merged[v.Key] == nil || Merged[v.Key].Version < v.Version {
+				Merged[v.Key] = v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorts the results and cuts them down to the page.
+	Results := make([]*SearchResult, 0, len(Merged))
+	for _, v := range Merged {
+		Results = append(Results, v)
+	}
+	SortSearchResults(Results)
+	Page := &SearchPage{Results: []*SearchResult{}}
+	if len(Results) > Query.Offset {
+		Results = Results[Query.Offset:]
+		if len(Results) > Query.Limit {
+			Results = Results[:Query.Limit]
+			Next := Query.Offset + Query.Limit
+			if Next < SearchMaxDepth {
+				Page.Next = &Next
+			}
+		}
+		Page.Results = Results
+	}
+	return Page, nil
+}
@@ -2,232 +2,251 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path"
+	"errors"
+	"sort"
+	"strconv"
 	"sync"
 )
 
+// Defines the types of index.
+const (
+	// Looks records up by the exact values of the keys. Indexes saved before types existed are this type.
+	IndexTypeHash = "hash"
+
+	// Keeps the records sorted by the values of the keys so they can be looked up by range.
+	IndexTypeOrdered = "ordered"
+
+	// Splits the strings in the keys into words so records can be searched (see fulltext.go).
+	IndexTypeFullText = "fulltext"
+)
+
 // Defines the index structure.
 type Index struct {
 	Name string `json:"n"`
+
+	// The fields the index is on. These can be paths into nested records (see index_path.go).
 	Keys []string `json:"k"`
+	Type string `json:"t,omitempty"`
+	Unique bool `json:"u,omitempty"`
+	MultiKey bool `json:"m,omitempty"`
 	IndexLock *sync.RWMutex `json:"-"`
-	MapPreload *map[string]*[]string `json:"-"`
-	CurrentIndexDoc int `json:"-"`
+
+	// The filter records have to match to be in the index (see filter.go). Nil if every record is in the index.
+	Filter interface{} `json:"f,omitempty"`
+	Matcher *Filter `json:"-"`
+
+	// Set while the index is being built from the records already in the table.
+	Build *IndexBuild `json:"build,omitempty"`
+
+	// The entries in the index. Records maps each record to the keys it is stored under.
+	Tree *BTree `json:"-"`
+	Records map[string][]string `json:"-"`
+
+	// How many changes are in the log since the index was last compacted (see index_store.go).
+	LogLength int `json:"-"`
+}
+
+// Defines the options a index is created with.
+type IndexOptions struct {
+	// The type of index (IndexTypeHash, IndexTypeOrdered or IndexTypeFullText). Defaults to IndexTypeHash.
+	Type string `json:"type,omitempty"`
+
+	// If true, two records can't have the same values for the keys.
+	Unique bool `json:"unique,omitempty"`
+
+	// If true, a key holding a array adds a entry for each element instead of one entry for the whole array.
+	MultiKey bool `json:"multikey,omitempty"`
+
+	// If this is set, only records which match this filter are in the index (see filter.go).
+	Filter interface{} `json:"filter,omitempty"`
+}
+
+// Checks the options are valid.
+func (o *IndexOptions) Validate() error {
+	if o.Filter != nil {
+		_, err := ParseFilter(o.Filter)
+		if err != nil {
+			return err
+		}
+	}
+	switch o.Type {
+	case "", IndexTypeHash, IndexTypeOrdered:
+		return nil
+	case IndexTypeFullText:
+		if o.Unique {
+			return errors.New("A full-text index cannot be unique.")
+		}
+		return nil
+	default:
+		return errors.New(`The index type "` + o.Type + `" does not exist.`)
+	}
+}
+
+// Gets the options the index was created with.
+func (i *Index) Options() *IndexOptions {
+	return &IndexOptions{Type: i.Type, Unique: i.Unique, MultiKey: i.MultiKey, Filter: i.Filter}
+}
+
+// Checks if the index is ordered.
+func (i *Index) Ordered() bool {
+	return i.Type == IndexTypeOrdered
 }
 
 // Initialises the index.
-func (i *Index) Init(Base string, DatabaseName string, TableName string) {
+func (i *Index) Init(Engine StorageEngine, DatabaseName string, TableName string) {
 	if i.IndexLock == nil {
 		i.IndexLock = &sync.RWMutex{}
 	}
-	if i.MapPreload == nil {
-		i.IndexLock.Lock()
-		i.MapPreload = &map[string]*[]string{}
-		IndexDir := path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name))
-		if _, err := os.Stat(IndexDir); os.IsNotExist(err) {
-			err = os.Mkdir(IndexDir, 0777)
-			if err != nil {
-				panic(err)
-			}
-		}
-		f, _ := ioutil.ReadDir(IndexDir)
-		i.CurrentIndexDoc = len(f)
-		if i.CurrentIndexDoc != 0 {
-			data, err := ioutil.ReadFile(path.Join(IndexDir, "0"))
-			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(data, i.MapPreload)
-			if err != nil {
-				panic(err)
-			}
+	if i.Filter != nil && i.Matcher == nil {
+		Matcher, err := ParseFilter(i.Filter)
+		if err != nil {
+			panic(err)
 		}
+		i.Matcher = Matcher
+	}
+	if i.Tree == nil {
+		i.IndexLock.Lock()
+		Engine.CreateIndex(DatabaseName, TableName, i.Name)
+		i.LoadNonThreadSafe(Engine, DatabaseName, TableName)
 		i.IndexLock.Unlock()
 	}
 }
 
-// Insets into a index.
-func (i *Index) Insert(Base string, DatabaseName string, TableName string, Key string, Item string) {
-	IndexFile := "0"
-	var IndexFilePath string
-	var MapSave *map[string]*[]string
-	i.IndexLock.Lock()
-
-	if len(*i.MapPreload) == 50000 {
-		// Load the last part of the index from disk. If it's also the length of 50,000, make a new index file.
-		var DiskLoad map[string]*[]string
-		IndexFile = string(i.CurrentIndexDoc - 1)
-		IndexFilePath = path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode(IndexFile))
-		f, err := ioutil.ReadFile(IndexFilePath)
-		if err != nil {
-			panic(err)
+// Gets the keys a item is stored under in this index. Returns nil if the item does not have all of the keys this index uses.
+// A item has one key, unless the index is multi-key and some of the values are arrays. Then the item has a key for each element (or each combination of elements if more than one of the values is a array).
+// In a full-text index, the item has a key for each word instead (see FullTextKeysFor). In a partial index, items which don't match the filter have no keys.
+func (i *Index) KeysFor(Item *interface{}) []string {
+	if Item == nil {
+		return nil
+	}
+	cast, ok := (*Item).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if i.Matcher != nil && !i.Matcher.Matches(cast) {
+		return nil
+	}
+	if i.FullText() {
+		return i.FullTextKeysFor(cast)
+	}
+	Combinations := [][]interface{}{{}}
+	for _, k := range i.Keys {
+		Value := IndexKeyValue(cast, k)
+		if Value == nil {
+			return nil
 		}
-		err = json.Unmarshal(f, &DiskLoad)
-		if err != nil {
-			panic(err)
+
+		// Gets the values this key can have.
+		Choices := []interface{}{Value}
+		if Array, ok := Value.([]interface{}); ok && i.MultiKey {
+			Choices = make([]interface{}, 0, len(Array))
+			for _, e := range Array {
+				if e != nil {
+					Choices = append(Choices, e)
+				}
+			}
 		}
-		if len(DiskLoad) == 50000 {
-			MapSave = &map[string]*[]string{}
-			IndexFile = string(i.CurrentIndexDoc)
-			i.CurrentIndexDoc++
-		} else {
-			MapSave = &DiskLoad
+
+		// Adds each value to each combination so far.
+		Next := make([][]interface{}, 0, len(Combinations)*len(Choices))
+		for _, c := range Combinations {
+			for _, e := range Choices {
+				Next = append(Next, append(append([]interface{}{}, c...), e))
+			}
 		}
-	} else {
-		// This is in memory! Grab the preload.
-		MapSave = i.MapPreload
-		IndexFilePath = path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode(IndexFile))
+		Combinations = Next
 	}
 
-	if (*MapSave)[Key] == nil {
-		(*MapSave)[Key] = &[]string{}
+	// Encodes the combinations. Elements which are in a array twice only get one key.
+	Keys := make([]string, 0, len(Combinations))
+	for _, c := range Combinations {
+		Keys = append(Keys, i.EncodeKey(c))
+	}
+	sort.Strings(Keys)
+	Unique := make([]string, 0, len(Keys))
+	for x, k := range Keys {
+		if x == 0 || Keys[x-1] != k {
+			Unique = append(Unique, k)
+		}
+	}
+	if len(Unique) == 0 {
+		return nil
 	}
-	Appended := append(*(*MapSave)[Key], Item)
-	(*MapSave)[Key] = &Appended
+	return Unique
+}
 
-	b, err := json.Marshal(MapSave)
-	if err != nil {
-		panic(err)
+// Checks if a item is stored under the key given in this index.
+func (i *Index) HasKey(Item *interface{}, Key string) bool {
+	for _, k := range i.KeysFor(Item) {
+		if k == Key {
+			return true
+		}
 	}
-	f, err := os.Create(IndexFilePath)
-	if err != nil {
-		panic(err)
+	return false
+}
+
+// Encodes the values of the keys into the key they are stored under.
+func (i *Index) EncodeKey(Values []interface{}) string {
+	if i.Ordered() {
+		return EncodeOrderedValues(Values)
 	}
-	_, err = f.Write(b)
+
+	// Why? Fuck knows. Go dislikes having interface{} [] as a type for a map key apparently.
+	j, err := json.Marshal(Values)
 	if err != nil {
 		panic(err)
 	}
-	i.IndexLock.Unlock()
+	return string(j)
 }
 
-// Deletes an item from this index.
-func (i *Index) DeleteItem(Base string, DatabaseName string, TableName string, Item string) {
-	// Locks the index lock.
+// Inserts into a index under the keys given. If the item is already in the index, it is moved to the new keys.
+func (i *Index) Insert(Engine StorageEngine, DatabaseName string, TableName string, Keys []string, Item string) {
 	i.IndexLock.Lock()
-
-	// We will check preload first.
-	for k, v := range *i.MapPreload {
-		for index, x := range *v {
-			if x == Item {
-				Data := make([]string, len(*v) - 1)
-				z := 0
-				for CurrentIndex, d := range *v {
-					if index == CurrentIndex {
-						continue
-					}
-					Data[z] = d
-					z++
-				}
-				(*i.MapPreload)[k] = &Data
-				IndexFilePath := path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode("0"))
-				f, err := os.Create(IndexFilePath)
-				if err != nil {
-					panic(err)
-				}
-				b, err := json.Marshal(i.MapPreload)
-				if err != nil {
-					panic(err)
-				}
-				_, err = f.Write(b)
-				if err != nil {
-					panic(err)
-				}
-				i.IndexLock.Unlock()
-				return
-			}
+	i.SetNonThreadSafe(Keys, Item)
+	Entry := &IndexLogEntry{Op: IndexLogInsert, Record: Item}
+	if len(Keys) == 1 {
+		Entry.Key = []byte(Keys[0])
+	} else {
+		Entry.Op = IndexLogSet
+		for _, k := range Keys {
+			Entry.Keys = append(Entry.Keys, []byte(k))
 		}
 	}
+	i.AppendLogNonThreadSafe(Engine, DatabaseName, TableName, Entry)
+	i.IndexLock.Unlock()
+}
 
-	// No luck with the preloaded data, lets open the other index files if they exist.
-	if i.CurrentIndexDoc > 1 {
-		x := 1
-		for i.CurrentIndexDoc != x {
-			IndexFilePath := path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode(string(x)))
-			var Loaded map[string]*[]string
-			d, err := ioutil.ReadFile(IndexFilePath)
-			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(d, &Loaded)
-			if err != nil {
-				panic(err)
-			}
-			for k, v := range Loaded {
-				for index, x := range *v {
-					if x == Item {
-						Data := make([]string, len(*v) - 1)
-						z := 0
-						for CurrentIndex, d := range *v {
-							if index == CurrentIndex {
-								continue
-							}
-							Data[z] = d
-							z++
-						}
-						Loaded[k] = &Data
-						IndexFilePath := path.Join(Base, "dbs", DatabaseName, TableName, "i", i.Name, x)
-						f, err := os.Create(IndexFilePath)
-						if err != nil {
-							panic(err)
-						}
-						b, err := json.Marshal(&Loaded)
-						if err != nil {
-							panic(err)
-						}
-						_, err = f.Write(b)
-						if err != nil {
-							panic(err)
-						}
-						i.IndexLock.Unlock()
-						return
-					}
-				}
-			}
-			x++
-		}
+// Deletes an item from this index.
+func (i *Index) DeleteItem(Engine StorageEngine, DatabaseName string, TableName string, Item string) {
+	i.IndexLock.Lock()
+	if i.RemoveNonThreadSafe(Item) {
+		i.AppendLogNonThreadSafe(Engine, DatabaseName, TableName, &IndexLogEntry{Op: IndexLogDelete, Record: Item})
 	}
-
-	// Unlocks the index lock.
 	i.IndexLock.Unlock()
 }
 
+// Gets the key the values given are stored under in this index. The values are in the same order as the keys this index uses.
+func (i *Index) KeyForValues(Values []interface{}) (string, error) {
+	if len(Values) != len(i.Keys) {
+		return "", errors.New(`The index "` + i.Name + `" needs ` + strconv.Itoa(len(i.Keys)) + " values.")
+	}
+	return i.EncodeKey(Values), nil
+}
 
-// Gets a index.
-func (i *Index) Get(Base string, DatabaseName string, TableName string, Key string) *[]string {
-	IndexFile := "0"
-	var IndexFilePath string
-	var MapSave *map[string]*[]string
+// Gets the keys of the records stored under the key given in this index. Returns nil if there are none.
+func (i *Index) Get(Engine StorageEngine, DatabaseName string, TableName string, Key string) *[]string {
+	Result := make([]string, 0)
 	i.IndexLock.RLock()
-
-	if len(*i.MapPreload) == 50000 {
-		// Load the last part of the index from disk. If it's also the length of 50,000, make a new index file.
-		var DiskLoad map[string]*[]string
-		IndexFile = string(i.CurrentIndexDoc - 1)
-		IndexFilePath = path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode(IndexFile))
-		f, err := ioutil.ReadFile(IndexFilePath)
-		if err != nil {
-			panic(err)
-		}
-		err = json.Unmarshal(f, &DiskLoad)
-		if err != nil {
-			panic(err)
+	i.Tree.Ascend(&IndexEntry{Key: Key}, func(Entry *IndexEntry) bool {
+		if Entry.Key != Key {
+			return false
 		}
-		if len(DiskLoad) == 50000 {
-			MapSave = &map[string]*[]string{}
-			IndexFile = string(i.CurrentIndexDoc)
-			i.CurrentIndexDoc++
-		} else {
-			MapSave = &DiskLoad
-		}
-	} else {
-		// This is in memory! Grab the preload.
-		MapSave = i.MapPreload
-		IndexFilePath = path.Join(Base, "dbs", B64FSEncode(DatabaseName), B64FSEncode(TableName), "i", B64FSEncode(i.Name), B64FSEncode(IndexFile))
-	}
+		Result = append(Result, Entry.Record)
+		return true
+	})
 	i.IndexLock.RUnlock()
-
-	IndexRes := (*MapSave)[Key]
-	return IndexRes
+	if len(Result) == 0 {
+		return nil
+	}
+	return &Result
 }
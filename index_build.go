@@ -0,0 +1,278 @@
+// This handles building a index from the records which were already in the table when the index was created. The index is built in the background while the table stays online:
+//   - Writes to the table put the record in the index while it is being built, even if its indexed fields didn't change. The records they touch are remembered so the build doesn't add them a second time.
+//   - The build reads each record with the table locked, so a write can never happen half way through a record being added.
+// The index can't be queried until it has been built. If the process dies during the build, the index is cleared and built again on boot.
+// A unique index fails to build if two records have the same value. It stays in the table so the failure can be seen, and is tried again on boot.
+// Every shard builds the index from its own records, so the progress shown for a table is added up from every shard.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Defines the progress of a index which is being built.
+type IndexBuild struct {
+	Lock    *sync.Mutex
+	Done    int
+	Total   int
+	Touched map[string]bool
+
+	// Why the build failed. Empty if it hasn't failed.
+	Failure string
+}
+
+// Creates the progress for a index which is about to be built.
+func NewIndexBuild() *IndexBuild {
+	return &IndexBuild{
+		Lock:    &sync.Mutex{},
+		Touched: map[string]bool{},
+	}
+}
+
+// Marshals the progress of the build.
+func (b *IndexBuild) MarshalJSON() ([]byte, error) {
+	Progress := map[string]interface{}{}
+	if b.Lock != nil {
+		b.Lock.Lock()
+		Progress["done"] = b.Done
+		Progress["total"] = b.Total
+		if b.Failure != "" {
+			Progress["error"] = b.Failure
+		}
+		b.Lock.Unlock()
+	}
+	return json.Marshal(Progress)
+}
+
+// Remembers that a record was written while the index was being built.
+func (b *IndexBuild) Touch(Key string) {
+	b.Lock.Lock()
+	b.Touched[Key] = true
+	b.Lock.Unlock()
+}
+
+// Checks if a record was written while the index was being built.
+func (b *IndexBuild) WasTouched(Key string) bool {
+	b.Lock.Lock()
+	Touched := b.Touched[Key]
+	b.Lock.Unlock()
+	return Touched
+}
+
+// Checks if a index is still being built.
+func (d *DBCore) IndexBuilding(DatabaseName string, TableName string, TableIndex *Index) bool {
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.RLock()
+	Building := TableIndex.Build != nil
+	lock.RUnlock()
+	return Building
+}
+
+// Gets why a index failed to build. Returns a empty string if it hasn't failed.
+func (d *DBCore) IndexBuildFailure(DatabaseName string, TableName string, TableIndex *Index) string {
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.RLock()
+	Failure := d.IndexBuildFailureNonThreadSafe(TableIndex)
+	lock.RUnlock()
+	return Failure
+}
+
+// Gets why a index failed to build. The table lock should be held when this is called.
+func (d *DBCore) IndexBuildFailureNonThreadSafe(TableIndex *Index) string {
+	if TableIndex.Build == nil {
+		return ""
+	}
+	TableIndex.Build.Lock.Lock()
+	Failure := TableIndex.Build.Failure
+	TableIndex.Build.Lock.Unlock()
+	return Failure
+}
+
+// Checks if the index is in the table. The table lock should be held when this is called.
+func (d *DBCore) IndexInTableNonThreadSafe(DatabaseName string, TableName string, TableIndex *Index) bool {
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		return false
+	}
+	for _, v := range Table.Indexes {
+		if v == TableIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds all of the records in the table to a index which is being built and then marks it as built. Stops if the index is deleted.
+func (d *DBCore) BuildIndex(DatabaseName string, TableName string, TableIndex *Index) {
+	// Gets the records in the table. Records which are written after this are added by the write.
+	Build := TableIndex.Build
+	Keys := d.Engine.RecordKeys(DatabaseName, TableName)
+	Build.Lock.Lock()
+	Build.Total = len(Keys)
+	Build.Lock.Unlock()
+
+	// Adds each record.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	for _, k := range Keys {
+		lock.Lock()
+		if !d.IndexInTableNonThreadSafe(DatabaseName, TableName, TableIndex) {
+			lock.Unlock()
+			return
+		}
+		if !Build.WasTouched(k) {
+			Meta, Item := d.ReadRecordNonThreadSafe(DatabaseName, TableName, k)
+			if LiveMeta(Meta) != nil {
+				if IndexKeys := TableIndex.KeysFor(Item); len(IndexKeys) != 0 {
+					for _, IndexKey := range IndexKeys {
+						if !TableIndex.Unique {
+							break
+						}
+
+						// Stops if another record already has the value.
+						if Holders := d.UniqueHoldersNonThreadSafe(TableIndex, DatabaseName, TableName, IndexKey, k); len(Holders) != 0 {
+							Build.Lock.Lock()
+							Build.Failure = `The records "` + Holders[0] + `" and "` + k + `" have the same value.`
+							Build.Lock.Unlock()
+							lock.Unlock()
+							println("[" + DatabaseName + "/" + TableName + "] The unique index \"" + TableIndex.Name + "\" could not be built: " + Build.Failure)
+							return
+						}
+					}
+					TableIndex.Insert(d.Engine, DatabaseName, TableName, IndexKeys, k)
+				}
+			}
+		}
+		lock.Unlock()
+		Build.Lock.Lock()
+		Build.Done++
+		Build.Lock.Unlock()
+	}
+
+	// Marks the index as built. The table is locked so no write is half way through touching the build.
+	lock.Lock()
+	d.ArrayLock.Lock()
+	TableIndex.Build = nil
+	d.ArrayLock.Unlock()
+	lock.Unlock()
+	d.SaveStructure()
+	println("[" + DatabaseName + "/" + TableName + "] Built the index \"" + TableIndex.Name + "\".")
+}
+
+// Clears a index which was being built when the process died and starts building it again.
+func (d *DBCore) RestartIndexBuild(DatabaseName string, TableName string, TableIndex *Index) {
+	d.Engine.DeleteIndex(DatabaseName, TableName, TableIndex.Name)
+	TableIndex.Build = NewIndexBuild()
+	TableIndex.Init(d.Engine, DatabaseName, TableName)
+	go d.BuildIndex(DatabaseName, TableName, TableIndex)
+}
+
+// Defines the progress of building a index on one shard, as it is sent between shards.
+type IndexBuildProgress struct {
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Error string `json:"error,omitempty"`
+}
+
+// Gets the progress of each index which is being built in a table on this shard, by the name of the index.
+func (d *DBCore) IndexBuilds(DatabaseName string, TableName string) (map[string]*IndexBuildProgress, error) {
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return nil, err
+	}
+	Builds := map[string]*IndexBuildProgress{}
+	d.ArrayLock.RLock()
+	for _, v := range Table.Indexes {
+		if v.Build == nil {
+			continue
+		}
+		v.Build.Lock.Lock()
+		Builds[v.Name] = &IndexBuildProgress{Done: v.Build.Done, Total: v.Build.Total, Error: v.Build.Failure}
+		v.Build.Lock.Unlock()
+	}
+	d.ArrayLock.RUnlock()
+	return Builds, nil
+}
+
+// The remote index builds structure.
+type RemoteIndexBuildsStructure struct {
+	DB string `json:"db"`
+	Table string `json:"table"`
+}
+
+// The response from a remote shard with the progress of its index builds.
+type RemoteIndexBuildsResponse struct {
+	Err *string `json:"error"`
+	Builds map[string]*IndexBuildProgress `json:"builds"`
+}
+
+// Gets the progress of the index builds in a table on one shard.
+func (s *Shard) IndexBuildsOnShard(ShardID string, Query *RemoteIndexBuildsStructure) (map[string]*IndexBuildProgress, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.IndexBuilds(Query.DB, Query.Table)
+	}
+	var Response RemoteIndexBuildsResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/index_builds", Query, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Builds, nil
+}
+
+// Gets the progress of the index builds in a table across every shard. Each shard builds the index from its own records, and the index can't be queried until every shard has built it.
+// The done and total counts are added up, and a failure on any shard fails the build.
+func (s *Shard) IndexBuilds(DatabaseName string, TableName string) (map[string]*IndexBuildProgress, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before getting the progress of index builds.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	Query := &RemoteIndexBuildsStructure{DB: DatabaseName, Table: TableName}
+	Results := map[string]map[string]*IndexBuildProgress{}
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Builds, err := s.IndexBuildsOnShard(ShardID, Query)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			} else {
+				Results[ShardID] = Builds
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+
+	// Combines the progress from each shard. The shards are gone through in order so the same failure is always reported.
+	Combined := map[string]*IndexBuildProgress{}
+	for _, ShardID := range s.Shards {
+		for Name, v := range Results[ShardID] {
+			Progress := Combined[Name]
+			if Progress == nil {
+				Progress = &IndexBuildProgress{}
+				Combined[Name] = Progress
+			}
+			Progress.Done += v.Done
+			Progress.Total += v.Total
+			if Progress.Error == "" {
+				Progress.Error = v.Error
+			}
+		}
+	}
+	return Combined, nil
+}
@@ -0,0 +1,265 @@
+// This checks indexes against the records in their table. A write updates the record and its indexes one after another, so if the process dies or panics half way through, the two can drift apart. The check finds:
+//   - Missing entries: a record has a value which isn't in the index.
+//   - Stale entries: the index has a value for a record which is gone or no longer has that value.
+//   - Duplicate entries: the index has a record more times than it should, such as under two values in a index which isn't multi-key.
+// Each record is checked with the table locked, so writes carry on while the check runs and a write can't be reported half way through.
+// A index which has drifted can be rebuilt. It is cleared and built again in the background (see index_build.go) while the table stays online. Writes which give a record a value in a unique index are turned away until it has been rebuilt (see unique.go).
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// The most records listed under each problem in a index check. The counts include every record.
+const IndexCheckMaxListed = 1000
+
+// Defines the records with one kind of problem in a index.
+type IndexCheckProblem struct {
+	Count   int      `json:"count"`
+	Records []string `json:"records"`
+}
+
+// Adds a record to the problem.
+func (p *IndexCheckProblem) Add(Record string) {
+	p.Count++
+	if len(p.Records) < IndexCheckMaxListed {
+		p.Records = append(p.Records, Record)
+	}
+}
+
+// Defines the result of checking a index on one shard.
+type IndexCheckReport struct {
+	Index      string             `json:"index"`
+	Checked    int                `json:"checked"`
+	Missing    *IndexCheckProblem `json:"missing"`
+	Stale      *IndexCheckProblem `json:"stale"`
+	Duplicate  *IndexCheckProblem `json:"duplicate"`
+	Consistent bool               `json:"consistent"`
+	Rebuilding bool               `json:"rebuilding"`
+}
+
+// Checks the entries for one record against the keys it should have. The index lock should be held when this is called.
+// Found is the keys the tree held for the record when the check started, which finds entries the index has lost track of.
+func (i *Index) CheckRecordNonThreadSafe(Record string, Expected []string, Found []string) (Missing bool, Stale bool, Duplicate bool) {
+	Listed := i.Records[Record]
+	Should := map[string]bool{}
+	for _, k := range Expected {
+		Should[k] = true
+	}
+
+	// Checks each value the record should have is in the tree.
+	Has := map[string]bool{}
+	for _, k := range Listed {
+		if Has[k] {
+			Duplicate = true
+		}
+		Has[k] = true
+	}
+	for _, k := range Expected {
+		if !Has[k] || !i.Tree.Has(&IndexEntry{Key: k, Record: Record}) {
+			Missing = true
+		}
+	}
+
+	// Checks the index has nothing the record shouldn't have.
+	for _, k := range Listed {
+		if !Should[k] {
+			Stale = true
+		}
+	}
+	for _, k := range Found {
+		if !Has[k] && i.Tree.Has(&IndexEntry{Key: k, Record: Record}) {
+			Stale = true
+		}
+	}
+
+	// Only multi-key and full-text indexes can have a record more than once.
+	if !i.MultiKey && !i.FullText() && len(Has) > 1 {
+		Duplicate = true
+	}
+	return
+}
+
+// Checks a index on this shard against the records in the table.
+func (d *DBCore) CheckIndex(DatabaseName string, TableName string, IndexName string) (*IndexCheckReport, error) {
+	TableIndex, err := d.FindIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return nil, err
+	}
+	if d.IndexBuilding(DatabaseName, TableName, TableIndex) && d.IndexBuildFailure(DatabaseName, TableName, TableIndex) == "" {
+		err := errors.New(`The index "` + IndexName + `" is still being built.`)
+		return nil, err
+	}
+
+	// Gets every record in the tree as well as the ones in the table, so entries for records which are gone are checked too.
+	Found := map[string][]string{}
+	TableIndex.IndexLock.RLock()
+	TableIndex.Tree.Ascend(nil, func(Entry *IndexEntry) bool {
+		Found[Entry.Record] = append(Found[Entry.Record], Entry.Key)
+		return true
+	})
+	for k := range TableIndex.Records {
+		if _, ok := Found[k]; !ok {
+			Found[k] = nil
+		}
+	}
+	TableIndex.IndexLock.RUnlock()
+	for _, k := range d.Engine.RecordKeys(DatabaseName, TableName) {
+		if _, ok := Found[k]; !ok {
+			Found[k] = nil
+		}
+	}
+	Keys := make([]string, 0, len(Found))
+	for k := range Found {
+		Keys = append(Keys, k)
+	}
+	sort.Strings(Keys)
+
+	// Checks each record. Records which have expired but haven't been removed yet are still in the index.
+	Report := &IndexCheckReport{
+		Index:     IndexName,
+		Missing:   &IndexCheckProblem{Records: []string{}},
+		Stale:     &IndexCheckProblem{Records: []string{}},
+		Duplicate: &IndexCheckProblem{Records: []string{}},
+	}
+	lock := d.GetTableLock(DatabaseName, TableName)
+	for _, k := range Keys {
+		lock.RLock()
+		Meta, Item := d.ReadRecordNonThreadSafe(DatabaseName, TableName, k)
+		var Expected []string
+		if Meta != nil {
+			Expected = TableIndex.KeysFor(Item)
+		}
+		TableIndex.IndexLock.RLock()
+		Missing, Stale, Duplicate := TableIndex.CheckRecordNonThreadSafe(k, Expected, Found[k])
+		TableIndex.IndexLock.RUnlock()
+		lock.RUnlock()
+		if Meta != nil {
+			Report.Checked++
+		}
+		if Missing {
+			Report.Missing.Add(k)
+		}
+		if Stale {
+			Report.Stale.Add(k)
+		}
+		if Duplicate {
+			Report.Duplicate.Add(k)
+		}
+	}
+	Report.Consistent = Report.Missing.Count == 0 && Report.Stale.Count == 0 && Report.Duplicate.Count == 0
+	return Report, nil
+}
+
+// Clears a index on this shard and builds it again from the records in the table. The index can't be queried until it has been built.
+func (d *DBCore) RebuildIndex(DatabaseName string, TableName string, IndexName string) error {
+	TableIndex, err := d.FindIndex(DatabaseName, TableName, IndexName)
+	if err != nil {
+		return err
+	}
+
+	// Clears the index. The table is locked so no write can change it while it is cleared.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.Lock()
+	if TableIndex.Build != nil && d.IndexBuildFailureNonThreadSafe(TableIndex) == "" {
+		lock.Unlock()
+		err := errors.New(`The index "` + IndexName + `" is still being built.`)
+		return err
+	}
+	TableIndex.IndexLock.Lock()
+	d.Engine.DeleteIndex(DatabaseName, TableName, IndexName)
+	d.Engine.CreateIndex(DatabaseName, TableName, IndexName)
+	TableIndex.LoadNonThreadSafe(d.Engine, DatabaseName, TableName)
+	TableIndex.IndexLock.Unlock()
+	d.ArrayLock.Lock()
+	TableIndex.Build = NewIndexBuild()
+	d.ArrayLock.Unlock()
+	lock.Unlock()
+	d.SaveStructure()
+
+	// Adds the records in the background.
+	go d.BuildIndex(DatabaseName, TableName, TableIndex)
+	println("[" + DatabaseName + "/" + TableName + "] Rebuilding the index \"" + IndexName + "\".")
+	return nil
+}
+
+// The remote index check structure.
+type RemoteIndexCheckStructure struct {
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Index string `json:"index"`
+	Rebuild bool `json:"rebuild"`
+}
+
+// The response from a remote shard after a index check.
+type RemoteIndexCheckResponse struct {
+	Err *string `json:"error"`
+	Report *IndexCheckReport `json:"report"`
+}
+
+// Checks a index on the local DB and rebuilds it if asked to.
+func RunLocalIndexCheck(Check *RemoteIndexCheckStructure) (*IndexCheckReport, error) {
+	Report, err := Core.CheckIndex(Check.DB, Check.Table, Check.Index)
+	if err != nil || !Check.Rebuild {
+		return Report, err
+	}
+	err = Core.RebuildIndex(Check.DB, Check.Table, Check.Index)
+	if err != nil {
+		return nil, err
+	}
+	Report.Rebuilding = true
+	return Report, nil
+}
+
+// Checks a index on one shard.
+func (s *Shard) CheckIndexOnShard(ShardID string, Check *RemoteIndexCheckStructure) (*IndexCheckReport, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return RunLocalIndexCheck(Check)
+	}
+	var Response RemoteIndexCheckResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/index_check", Check, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Report, nil
+}
+
+// Checks a index on every shard in parallel, rebuilding it on each shard if asked to. Returns the report from each shard by its ID.
+func (s *Shard) CheckIndex(DatabaseName string, TableName string, IndexName string, Rebuild bool) (map[string]*IndexCheckReport, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before checking indexes.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	Check := &RemoteIndexCheckStructure{DB: DatabaseName, Table: TableName, Index: IndexName, Rebuild: Rebuild}
+	Reports := map[string]*IndexCheckReport{}
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Report, err := s.CheckIndexOnShard(ShardID, Check)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			} else {
+				Reports[ShardID] = Report
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+	return Reports, nil
+}
@@ -0,0 +1,114 @@
+// This handles the paths index keys can use to reach values inside nested records. A key can be:
+//   - The name of a top level field, like "name". This is always checked first, so indexes on fields with dots in their names keep working.
+//   - A dotted path, like "profile.address.city" or "tags[0]". Array elements are picked with brackets.
+//   - A JSON Pointer (RFC 6901), like "/profile/address/city" or "/tags/0". This can reach fields with dots or brackets in their names.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Parses a index key into the segments of its path. A key with no path in it is one segment.
+func ParseIndexPath(Key string) ([]string, error) {
+	if Key == "" {
+		return nil, errors.New("A index key cannot be empty.")
+	}
+
+	// Parses a JSON Pointer.
+	if strings.HasPrefix(Key, "/") {
+		Segments := strings.Split(Key[1:], "/")
+		for i, v := range Segments {
+			Segments[i] = strings.Replace(strings.Replace(v, "~1", "/", -1), "~0", "~", -1)
+		}
+		return Segments, nil
+	}
+
+	// Parses a dotted path.
+	Segments := make([]string, 0)
+	for _, Part := range strings.Split(Key, ".") {
+		Bracket := strings.IndexByte(Part, '[')
+		Name := Part
+		if Bracket != -1 {
+			Name = Part[:Bracket]
+		}
+		if Name == "" && (Bracket != 0 || len(Segments) == 0) {
+			return nil, errors.New(`The index key "` + Key + `" has a empty field in its path.`)
+		}
+		if Name != "" {
+			Segments = append(Segments, Name)
+		}
+
+		// Parses the array elements after the field.
+		for Rest := Part[len(Name):]; Rest != ""; {
+			End := strings.IndexByte(Rest, ']')
+			if Rest[0] != '[' || End == -1 {
+				return nil, errors.New(`The index key "` + Key + `" has a bracket which isn't closed.`)
+			}
+			if _, err := strconv.Atoi(Rest[1:End]); err != nil {
+				return nil, errors.New(`The index key "` + Key + `" has a array element which isn't a number.`)
+			}
+			Segments = append(Segments, Rest[1:End])
+			Rest = Rest[End+1:]
+		}
+	}
+	return Segments, nil
+}
+
+// Checks all of the keys of a index can be parsed.
+func ValidateIndexKeys(Keys []string) error {
+	if len(Keys) == 0 {
+		return errors.New("A index needs at least one key.")
+	}
+	for _, k := range Keys {
+		_, err := ParseIndexPath(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the value at the end of a path inside a item. The boolean is false if the path doesn't exist in the item.
+func ResolveIndexPath(Item interface{}, Segments []string) (interface{}, bool) {
+	Current := Item
+	for _, s := range Segments {
+		switch v := Current.(type) {
+		case map[string]interface{}:
+			Next, ok := v[s]
+			if !ok {
+				return nil, false
+			}
+			Current = Next
+		case []interface{}:
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			Current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return Current, true
+}
+
+// Gets the value of a index key in a record. Returns nil if the record doesn't have it.
+func IndexKeyValue(Record map[string]interface{}, Key string) interface{} {
+	v, _ := LookupIndexKey(Record, Key)
+	return v
+}
+
+// Gets the value of a index key in a record. The boolean is false if the record doesn't have it, which tells a missing key apart from a null.
+func LookupIndexKey(Record map[string]interface{}, Key string) (interface{}, bool) {
+	if v, ok := Record[Key]; ok {
+		return v, true
+	}
+	Segments, err := ParseIndexPath(Key)
+	if err != nil {
+		return nil, false
+	}
+	return ResolveIndexPath(Record, Segments)
+}
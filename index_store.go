@@ -0,0 +1,206 @@
+// This handles how indexes are stored. Every index is kept in memory in a B-tree (see btree.go) and is stored in two files:
+//   - The run holds every entry in the index in order. It is only written when the index is compacted.
+//   - The log holds the changes made since the run was written. Each insert or delete appends one line to it, so a change costs the same however big the index is.
+// When the log has more entries than the run (and at least IndexLogMinimum), the index is compacted: the run is written again from the tree and the log is emptied.
+// Replaying the log over a run is harmless since each line just sets (or removes) the keys of one record, so if the process dies between the run and log being written, loading the index still gives the right entries.
+// Indexes which were saved before this format existed are loaded from their old files and compacted into the new format.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+const (
+	// The file holding the sorted entries.
+	IndexRunFile = "run"
+
+	// The file holding the changes since the run was written.
+	IndexLogFile = "log"
+
+	// The least number of entries the log can hold before the index is compacted.
+	IndexLogMinimum = 1024
+)
+
+// Defines the operations which can be in the index log.
+const (
+	// Sets the key of a record.
+	IndexLogInsert = "+"
+
+	// Sets all of the keys of a record in a multi-key index.
+	IndexLogSet = "="
+
+	// Removes a record.
+	IndexLogDelete = "-"
+)
+
+// Defines how a entry in a index is saved. The key is bytes since the keys of ordered indexes are not valid UTF-8.
+type StoredIndexEntry struct {
+	Key    []byte `json:"k"`
+	Record string `json:"r"`
+}
+
+// Defines a line in the index log. The key is only used by inserts and the keys are only used by sets.
+type IndexLogEntry struct {
+	Op     string   `json:"o"`
+	Key    []byte   `json:"k,omitempty"`
+	Keys   [][]byte `json:"ks,omitempty"`
+	Record string   `json:"r"`
+}
+
+// Loads a index into its B-tree. The index lock should be held when this is called.
+func (i *Index) LoadNonThreadSafe(Engine StorageEngine, DatabaseName string, TableName string) {
+	i.Tree = NewBTree()
+	i.Records = map[string][]string{}
+	i.LogLength = 0
+
+	// Gets the run. A index which has never been compacted has no run.
+	Run := Engine.ReadIndexFile(DatabaseName, TableName, i.Name, IndexRunFile)
+	if Run == nil {
+		// The old files are only deleted once the run has been written, so the entries can't be lost half way through.
+		Legacy := i.LoadLegacyNonThreadSafe(Engine, DatabaseName, TableName)
+		if len(Legacy) != 0 {
+			i.CompactNonThreadSafe(Engine, DatabaseName, TableName)
+			for _, File := range Legacy {
+				Engine.DeleteIndexFile(DatabaseName, TableName, i.Name, File)
+			}
+			return
+		}
+	} else {
+		var Stored []*StoredIndexEntry
+		err := json.Unmarshal(Run, &Stored)
+		if err != nil {
+			panic(err)
+		}
+		for _, v := range Stored {
+			i.AddNonThreadSafe(string(v.Key), v.Record)
+		}
+	}
+
+	// Replays the log over the run.
+	Log := Engine.ReadIndexFile(DatabaseName, TableName, i.Name, IndexLogFile)
+	for _, Line := range bytes.Split(Log, []byte("\n")) {
+		if len(Line) == 0 {
+			continue
+		}
+		var Entry IndexLogEntry
+		err := json.Unmarshal(Line, &Entry)
+		if err != nil {
+			panic(err)
+		}
+		switch Entry.Op {
+		case IndexLogInsert:
+			i.SetNonThreadSafe([]string{string(Entry.Key)}, Entry.Record)
+		case IndexLogSet:
+			Keys := make([]string, len(Entry.Keys))
+			for x, k := range Entry.Keys {
+				Keys[x] = string(k)
+			}
+			i.SetNonThreadSafe(Keys, Entry.Record)
+		default:
+			i.RemoveNonThreadSafe(Entry.Record)
+		}
+		i.LogLength++
+	}
+}
+
+// Loads the entries from a index which was saved before the run and log existed. Returns the files which were loaded. The index lock should be held when this is called.
+func (i *Index) LoadLegacyNonThreadSafe(Engine StorageEngine, DatabaseName string, TableName string) []string {
+	Files := Engine.IndexFiles(DatabaseName, TableName, i.Name)
+	Loaded := make([]string, 0)
+	for _, File := range Files {
+		if File == IndexLogFile {
+			continue
+		}
+		data := Engine.ReadIndexFile(DatabaseName, TableName, i.Name, File)
+		if data == nil {
+			continue
+		}
+		if i.Ordered() {
+			// Ordered indexes were saved as a list of entries.
+			var Stored []*StoredIndexEntry
+			err := json.Unmarshal(data, &Stored)
+			if err != nil {
+				panic(err)
+			}
+			for _, v := range Stored {
+				i.SetNonThreadSafe([]string{string(v.Key)}, v.Record)
+			}
+		} else {
+			// Hash indexes were saved as maps of keys to records, split into files of 50,000 keys.
+			var Chunk map[string]*[]string
+			err := json.Unmarshal(data, &Chunk)
+			if err != nil {
+				panic(err)
+			}
+			for k, v := range Chunk {
+				if v == nil {
+					continue
+				}
+				for _, Record := range *v {
+					i.SetNonThreadSafe([]string{k}, Record)
+				}
+			}
+		}
+		Loaded = append(Loaded, File)
+	}
+	return Loaded
+}
+
+// Sets the keys a record is stored under in the tree. The index lock should be held when this is called.
+func (i *Index) SetNonThreadSafe(Keys []string, Record string) {
+	i.RemoveNonThreadSafe(Record)
+	for _, k := range Keys {
+		i.AddNonThreadSafe(k, Record)
+	}
+}
+
+// Adds a key to the keys a record is stored under in the tree. The index lock should be held when this is called.
+func (i *Index) AddNonThreadSafe(Key string, Record string) {
+	if i.Tree.Insert(&IndexEntry{Key: Key, Record: Record}) {
+		i.Records[Record] = append(i.Records[Record], Key)
+	}
+}
+
+// Removes a record from the tree. Returns false if it wasn't there. The index lock should be held when this is called.
+func (i *Index) RemoveNonThreadSafe(Record string) bool {
+	Keys, ok := i.Records[Record]
+	if !ok {
+		return false
+	}
+	for _, k := range Keys {
+		i.Tree.Remove(&IndexEntry{Key: k, Record: Record})
+	}
+	delete(i.Records, Record)
+	return true
+}
+
+// Appends a change to the log, compacting the index if the log is too big. The index lock should be held when this is called.
+func (i *Index) AppendLogNonThreadSafe(Engine StorageEngine, DatabaseName string, TableName string, Entry *IndexLogEntry) {
+	if i.LogLength >= IndexLogMinimum && i.LogLength >= i.Tree.Length {
+		i.CompactNonThreadSafe(Engine, DatabaseName, TableName)
+	}
+	b, err := json.Marshal(Entry)
+	if err != nil {
+		panic(err)
+	}
+	Engine.AppendIndexFile(DatabaseName, TableName, i.Name, IndexLogFile, append(b, '\n'))
+	i.LogLength++
+}
+
+// Writes the run from the tree and empties the log. The index lock should be held when this is called.
+func (i *Index) CompactNonThreadSafe(Engine StorageEngine, DatabaseName string, TableName string) {
+	Stored := make([]*StoredIndexEntry, 0, i.Tree.Length)
+	i.Tree.Ascend(nil, func(Entry *IndexEntry) bool {
+		Stored = append(Stored, &StoredIndexEntry{Key: []byte(Entry.Key), Record: Entry.Record})
+		return true
+	})
+	b, err := json.Marshal(Stored)
+	if err != nil {
+		panic(err)
+	}
+	Engine.WriteIndexFile(DatabaseName, TableName, i.Name, IndexRunFile, b)
+	Engine.WriteIndexFile(DatabaseName, TableName, i.Name, IndexLogFile, []byte{})
+	i.LogLength = 0
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
 	"github.com/buaazp/fasthttprouter"
 	"github.com/valyala/fasthttp"
 )
@@ -65,33 +66,329 @@ func ReadyShardHTTP(ctx *fasthttp.RequestCtx) {
 	ctx.Response.SetStatusCode(204)
 }
 
-// Inserts data into a database.
+// Writes data into a database with the options given.
 func InsertDataHTTP(ctx *fasthttp.RequestCtx) {
 	var Item RemoteInsertStructure
 	err := json.Unmarshal(ctx.Request.Body(), &Item)
 	if err != nil {
 		panic(err)
 	}
-	err = Core.Insert(Item.DB, Item.Table, Item.Key, &Item.Item)
+	Meta, err := Core.Write(Item.DB, Item.Table, Item.Key, &Item.Item, &Item.WriteOptions)
 	ctx.Response.SetStatusCode(200)
-	var Response *string
+	ctx.Response.Header.SetContentType("application/json")
+	b, err := json.Marshal(NewRemoteWriteResponse(Meta, nil, err))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetBody(b)
+}
+
+// Patches a item in the local DB. The patched item is sent back so it can be written to the other replicas.
+func PatchDataHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemotePatchStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	Meta, New, err := Core.Patch(Item.DB, Item.Table, Item.Key, Item.Type, Item.Patch, &Item.WriteOptions)
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	b, err := json.Marshal(NewRemoteWriteResponse(Meta, New, err))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetBody(b)
+}
+
+// Deletes a item from the local DB if the preconditions are met.
+func DeleteDataHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemoteDeleteStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	err = Core.Delete(Item.DB, Item.Table, Item.Key, &Item.WriteOptions)
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	b, err := json.Marshal(NewRemoteWriteResponse(nil, nil, err))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetBody(b)
+}
+
+// Prepares a transaction on the local DB.
+func PrepareTransactionHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemoteTransactionStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteTransactionResponse
+	Response.Results, err = Core.PrepareTransaction(Item.ID, Item.DB, Item.Operations)
 	if err != nil {
 		e := err.Error()
-		Response = &e
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Commits a prepared transaction on the local DB.
+func CommitTransactionHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemoteTransactionStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteTransactionResponse
+	err = Core.CommitTransaction(Item.ID, Item.Versions)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
 	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Aborts a prepared transaction on the local DB.
+func AbortTransactionHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemoteTransactionStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	Core.AbortTransaction(Item.ID)
+	b, err := json.Marshal(&RemoteTransactionResponse{})
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Runs a batch on the local DB.
+func BatchHTTP(ctx *fasthttp.RequestCtx) {
+	var Item RemoteBatchStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	b, err := json.Marshal(&RemoteBatchResponse{
+		Results: RunLocalBatch(Item.Op, Item.DB, Item.Table, Item.Items, Item.Fields),
+	})
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
 	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Queries a index on the local DB.
+func IndexQueryHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteIndexQueryStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteIndexQueryResponse
+	Response.Records, err = Core.GetAllByIndex(Query.DB, Query.Table, Query.Index, &Query.IndexQuery)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
 	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Searches a full-text index on the local DB, or gets its stats.
+func SearchHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteSearchStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteSearchResponse
+	if Query.StatsOnly {
+		Response.Stats, err = Core.SearchStats(Query.DB, Query.Table, Query.Index, Query.Query)
+	} else {
+		Response.Results, err = Core.Search(Query.DB, Query.Table, Query.Index, &Query.SearchQuery, Query.Stats)
+	}
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Checks a index on the local DB and rebuilds it if asked to.
+func IndexCheckHTTP(ctx *fasthttp.RequestCtx) {
+	var Check RemoteIndexCheckStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Check)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteIndexCheckResponse
+	Response.Report, err = RunLocalIndexCheck(&Check)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Gets the progress of the index builds in a table on this shard.
+func IndexBuildsHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteIndexBuildsStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteIndexBuildsResponse
+	Response.Builds, err = Core.IndexBuilds(Query.DB, Query.Table)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Runs a filter query on the local DB.
+func QueryHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteQueryStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	b, err := json.Marshal(RunLocalQuery(&Query))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Runs a aggregation on this shard.
+func AggregateHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteAggregateStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteAggregateResponse
+	Response.Partials, err = Core.Aggregate(Query.DB, Query.Table, &Query.AggregateQuery, Query.Owner)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Checks if another record on this shard has a value in a unique index.
+func UniqueCheckHTTP(ctx *fasthttp.RequestCtx) {
+	var Check RemoteUniqueCheckStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Check)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteUniqueCheckResponse
+	Response.Conflict, err = Core.UniqueConflict(Check.DB, Check.Table, Check.Index, Check.IndexKey, Check.Key)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(b)
+}
+
+// Releases a unique claim on the local DB if it still holds the owner token.
+func UniqueReleaseHTTP(ctx *fasthttp.RequestCtx) {
+	var Release RemoteUniqueReleaseStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Release)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteUniqueReleaseResponse
+	err = Core.ReleaseUniqueClaim(Release.Key, Release.Owner)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Response.SetStatusCode(200)
+	ctx.Response.Header.SetContentType("application/json")
 	ctx.Response.SetBody(b)
 }
 
 // Gets a item from the local DB.
 func GetDataHTTP(ctx *fasthttp.RequestCtx) {
-	d, err := Core.Get(ctx.UserValue("db").(string), ctx.UserValue("table").(string), ctx.UserValue("item").(string))
+	var Item RemoteGetStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Item)
+	if err != nil {
+		panic(err)
+	}
+	d, Meta, err := Core.GetWithMeta(Item.DB, Item.Table, Item.Key)
+	var Fields *Projection
+	if err == nil {
+		// Only sends back the fields asked for.
+		Fields, err = ParseProjection(Item.Fields)
+	}
 	var Response RemoteShardGetResponse
 	if err == nil {
 		Response = RemoteShardGetResponse{
 			Err:  nil,
-			Data: d,
+			Data: Fields.Apply(d),
+			Meta: Meta,
 		}
 	} else {
 		e := err.Error()
@@ -118,11 +415,18 @@ func NewDBHTTP(ctx *fasthttp.RequestCtx) {
 // Creates a index (errors can be suppressed, if there was a caught issue, it would happen on the local shard first).
 func NewIndexHTTP(ctx *fasthttp.RequestCtx) {
 	var keys []string
-	err := json.Unmarshal(ctx.UserValue("keys").([]byte), &keys)
+	err := json.Unmarshal(ctx.QueryArgs().Peek("keys"), &keys)
 	if err != nil {
 		panic(err)
 	}
-	_ = Core.CreateIndex(ctx.UserValue("db").(string), ctx.UserValue("table").(string), ctx.UserValue("index").(string), keys)
+	var Options IndexOptions
+	if ctx.QueryArgs().Has("options") {
+		err = json.Unmarshal(ctx.QueryArgs().Peek("options"), &Options)
+		if err != nil {
+			panic(err)
+		}
+	}
+	_ = Core.CreateIndex(ctx.UserValue("db").(string), ctx.UserValue("table").(string), ctx.UserValue("index").(string), keys, &Options)
 	ctx.Response.SetStatusCode(204)
 }
 
@@ -144,25 +448,36 @@ func DeleteIndexHTTP(ctx *fasthttp.RequestCtx) {
 	ctx.Response.SetStatusCode(204)
 }
 
-// Deletes a index (errors can be suppressed, if there was a caught issue, it would happen on the local shard first).
-func DeleteRecordHTTP(ctx *fasthttp.RequestCtx) {
-	_ = Core.DeleteRecord(ctx.UserValue("db").(string), ctx.UserValue("table").(string), ctx.UserValue("key").(string))
-	ctx.Response.SetStatusCode(204)
-}
-
 // Deletes a table (errors can be suppressed, if there was a caught issue, it would happen on the local shard first).
 func DeleteTableHTTP(ctx *fasthttp.RequestCtx) {
 	_ = Core.DeleteTable(ctx.UserValue("db").(string), ctx.UserValue("table").(string))
 	ctx.Response.SetStatusCode(204)
 }
 
-// Gets all table keys.
-func TableKeysHTTP(ctx *fasthttp.RequestCtx) {
-	keys, err := Core.TableKeys(ctx.UserValue("db").(string), ctx.UserValue("table").(string))
+// Sets the default TTL of a table (errors can be suppressed, if there was a caught issue, it would happen on the local shard first).
+func TableTTLHTTP(ctx *fasthttp.RequestCtx) {
+	TTL, err := strconv.ParseInt(ctx.UserValue("ttl").(string), 10, 64)
 	if err != nil {
 		panic(err)
 	}
-	b, err := json.Marshal(&keys)
+	_ = Core.SetTableTTL(ctx.UserValue("db").(string), ctx.UserValue("table").(string), TTL)
+	ctx.Response.SetStatusCode(204)
+}
+
+// Lists the keys in a table on this shard.
+func ListKeysHTTP(ctx *fasthttp.RequestCtx) {
+	var Query RemoteKeyListStructure
+	err := json.Unmarshal(ctx.Request.Body(), &Query)
+	if err != nil {
+		panic(err)
+	}
+	var Response RemoteKeyListResponse
+	Response.Keys, err = Core.ListKeys(Query.DB, Query.Table, &Query.KeyListQuery)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+	}
+	b, err := json.Marshal(&Response)
 	if err != nil {
 		panic(err)
 	}
@@ -179,13 +494,27 @@ func InnerClusterRoutesInit(router *fasthttprouter.Router) {
 	router.POST("/_shard/new", CheckClusterAuthorization(NewShardHTTP))
 	router.GET("/_shard/ready/:shard", CheckClusterAuthorization(ReadyShardHTTP))
 	router.POST("/_shard/insert", CheckClusterAuthorization(InsertDataHTTP))
-	router.GET("/_shard/get/:db/:table/:item", CheckClusterAuthorization(GetDataHTTP))
+	router.POST("/_shard/patch", CheckClusterAuthorization(PatchDataHTTP))
+	router.POST("/_shard/delete", CheckClusterAuthorization(DeleteDataHTTP))
+	router.POST("/_shard/batch", CheckClusterAuthorization(BatchHTTP))
+	router.POST("/_shard/index_query", CheckClusterAuthorization(IndexQueryHTTP))
+	router.POST("/_shard/unique_check", CheckClusterAuthorization(UniqueCheckHTTP))
+	router.POST("/_shard/unique_release", CheckClusterAuthorization(UniqueReleaseHTTP))
+	router.POST("/_shard/search", CheckClusterAuthorization(SearchHTTP))
+	router.POST("/_shard/index_check", CheckClusterAuthorization(IndexCheckHTTP))
+	router.POST("/_shard/index_builds", CheckClusterAuthorization(IndexBuildsHTTP))
+	router.POST("/_shard/query", CheckClusterAuthorization(QueryHTTP))
+	router.POST("/_shard/aggregate", CheckClusterAuthorization(AggregateHTTP))
+	router.POST("/_shard/list_keys", CheckClusterAuthorization(ListKeysHTTP))
+	router.POST("/_shard/transaction/prepare", CheckClusterAuthorization(PrepareTransactionHTTP))
+	router.POST("/_shard/transaction/commit", CheckClusterAuthorization(CommitTransactionHTTP))
+	router.POST("/_shard/transaction/abort", CheckClusterAuthorization(AbortTransactionHTTP))
+	router.POST("/_shard/get", CheckClusterAuthorization(GetDataHTTP))
 	router.GET("/_shard/new_db/:db", CheckClusterAuthorization(NewDBHTTP))
-	router.GET("/_shard/new_index/:db/:table/:index/:keys", CheckClusterAuthorization(NewIndexHTTP))
+	router.GET("/_shard/new_index/:db/:table/:index", CheckClusterAuthorization(NewIndexHTTP))
 	router.GET("/_shard/new_table/:db/:table", CheckClusterAuthorization(NewTableHTTP))
 	router.GET("/_shard/delete_db/:db", CheckClusterAuthorization(DeleteDBHTTP))
 	router.GET("/_shard/delete_index/:db/:table/:index", CheckClusterAuthorization(DeleteIndexHTTP))
-	router.GET("/_shard/delete_record/:db/:table/:key", CheckClusterAuthorization(DeleteRecordHTTP))
 	router.GET("/_shard/delete_table/:db/:table", CheckClusterAuthorization(DeleteTableHTTP))
-	router.GET("/_shard/table_keys/:db/:table", CheckClusterAuthorization(TableKeysHTTP))
+	router.GET("/_shard/table_ttl/:db/:table/:ttl", CheckClusterAuthorization(TableTTLHTTP))
 }
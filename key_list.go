@@ -0,0 +1,147 @@
+// This handles listing the keys in a table a page at a time. The keys are sorted, and can be narrowed down to a prefix or a range:
+//   - Prefix only lists the keys starting with it.
+//   - Start is the first key which can be listed and End is the key the list stops before.
+// The cursor is the last key on the page, so a page always carries on from where the last one stopped even if keys are written in between.
+// Each shard lists its own keys in order, so the shard asking only needs the start of each list to make a page. A key held by more than one replica is only listed once.
+// The storage engines don't keep keys in order, so each page goes through every key in the table on each shard. The keys outside the prefix, the range and the cursor are dropped first, so only the rest are sorted: a page costs O(n + m log m) for n keys in the table and m keys after the cursor.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The default number of keys on a page.
+const KeyListDefaultLimit = 1000
+
+// The most keys which can be on a page.
+const KeyListMaxLimit = 10000
+
+// Defines a query for the keys in a table.
+type KeyListQuery struct {
+	Prefix string `json:"prefix,omitempty"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+
+	// The cursor from the last page.
+	After string `json:"after,omitempty"`
+
+	// The most keys to return. 0 means there is no limit.
+	Limit int `json:"limit"`
+}
+
+// Checks if a key matches the query and comes after the cursor.
+func (q *KeyListQuery) Matches(Key string) bool {
+	return strings.HasPrefix(Key, q.Prefix) && Key >= q.Start && (q.End == "" || Key < q.End) && Key > q.After
+}
+
+// Lists the keys on this shard which match the query, in order.
+func (d *DBCore) ListKeys(DatabaseName string, TableName string, Query *KeyListQuery) ([]string, error) {
+	if d.Table(DatabaseName, TableName) == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return nil, err
+	}
+
+	// Drops the keys which don't match before sorting the rest. Expired records which haven't been removed yet are skipped.
+	Now := NowMillis()
+	Listed := make([]string, 0)
+	for _, k := range d.Engine.RecordKeys(DatabaseName, TableName) {
+		if Query.Matches(k) && !d.Expiry.Expired(DatabaseName, TableName, k, Now) {
+			Listed = append(Listed, k)
+		}
+	}
+	sort.Strings(Listed)
+	if Query.Limit > 0 && len(Listed) > Query.Limit {
+		Listed = Listed[:Query.Limit]
+	}
+	return Listed, nil
+}
+
+// Defines a page of keys. Next is the cursor to pass as after to get the next page, or nil if this is the last page.
+type KeyPage struct {
+	Keys []string `json:"keys"`
+	Next *string `json:"next"`
+}
+
+// The remote key list structure.
+type RemoteKeyListStructure struct {
+	KeyListQuery
+	DB string `json:"db"`
+	Table string `json:"table"`
+}
+
+// The response from a remote shard after listing keys.
+type RemoteKeyListResponse struct {
+	Err *string `json:"error"`
+	Keys []string `json:"keys"`
+}
+
+// Lists the keys on one shard.
+func (s *Shard) ListKeysOnShard(ShardID string, Query *RemoteKeyListStructure) ([]string, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.ListKeys(Query.DB, Query.Table, &Query.KeyListQuery)
+	}
+	var Response RemoteKeyListResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/list_keys", Query, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Keys, nil
+}
+
+// Gets a page of the keys in a table. Every shard is asked in parallel and the keys are merged, so each key is only listed once.
+func (s *Shard) ListKeys(DatabaseName string, TableName string, Query *KeyListQuery) (*KeyPage, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before getting table keys.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Asks each shard for one more key than the limit. If there is more than the limit after merging, there is another page.
+	ShardQuery := &RemoteKeyListStructure{KeyListQuery: *Query, DB: DatabaseName, Table: TableName}
+	if Query.Limit > 0 {
+		ShardQuery.Limit = Query.Limit + 1
+	}
+	Merged := map[string]bool{}
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Keys, err := s.ListKeysOnShard(ShardID, ShardQuery)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			}
+			for _, k := range Keys {
+				Merged[k] = true
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+
+	// Sorts the keys and cuts them down to the limit.
+	Page := &KeyPage{Keys: make([]string, 0, len(Merged))}
+	for k := range Merged {
+		Page.Keys = append(Page.Keys, k)
+	}
+	sort.Strings(Page.Keys)
+	if Query.Limit > 0 && len(Page.Keys) > Query.Limit {
+		Page.Keys = Page.Keys[:Query.Limit]
+		Next := Page.Keys[Query.Limit-1]
+		Page.Next = &Next
+	}
+	return Page, nil
+}
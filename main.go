@@ -1,6 +1,12 @@
 package main
 
+import "os"
+
 func main() {
+	if len(os.Args) > 1 {
+		// Runs a command instead of starting the database (see cli.go).
+		os.Exit(RunCommand(os.Args[1:]))
+	}
 	println("RemixDB. Copyright (C) Jake Gealer 2019.")
 	NewMemoryCache()
 	println("Created a in-memory cache with a maximum usage of 100MB.")
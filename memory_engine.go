@@ -0,0 +1,244 @@
+// This is the in-memory storage engine. Nothing is written to disk, so everything is lost when the process exits.
+// This is useful for running quick ephemeral clusters (for example, in tests).
+
+package main
+
+import "sync"
+
+// Defines a table in the memory engine.
+type MemoryTable struct {
+	Records map[string][]byte
+	Indexes map[string]map[string][]byte
+}
+
+// Defines the in-memory storage engine.
+type MemoryEngine struct {
+	Lock      *sync.RWMutex
+	Structure []byte
+	Databases map[string]map[string]*MemoryTable
+}
+
+// Creates the in-memory storage engine.
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		Lock:      &sync.RWMutex{},
+		Structure: nil,
+		Databases: map[string]map[string]*MemoryTable{},
+	}
+}
+
+// Copies a byte array so the caller can't change what is stored.
+func CopyBytes(Data []byte) []byte {
+	if Data == nil {
+		return nil
+	}
+	Copy := make([]byte, len(Data))
+	copy(Copy, Data)
+	return Copy
+}
+
+// Gets a table. The lock should be held when this is called.
+func (m *MemoryEngine) Table(DatabaseName string, TableName string) *MemoryTable {
+	db := m.Databases[DatabaseName]
+	if db == nil {
+		return nil
+	}
+	return db[TableName]
+}
+
+// Loads the DB structure.
+func (m *MemoryEngine) LoadStructure() []byte {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	return CopyBytes(m.Structure)
+}
+
+// Saves the DB structure.
+func (m *MemoryEngine) SaveStructure(Data []byte) {
+	m.Lock.Lock()
+	m.Structure = CopyBytes(Data)
+	m.Lock.Unlock()
+}
+
+// Creates a database.
+func (m *MemoryEngine) CreateDatabase(DatabaseName string) {
+	m.Lock.Lock()
+	if m.Databases[DatabaseName] == nil {
+		m.Databases[DatabaseName] = map[string]*MemoryTable{}
+	}
+	m.Lock.Unlock()
+}
+
+// Deletes a database.
+func (m *MemoryEngine) DeleteDatabase(DatabaseName string) {
+	m.Lock.Lock()
+	delete(m.Databases, DatabaseName)
+	m.Lock.Unlock()
+}
+
+// Creates a table.
+func (m *MemoryEngine) CreateTable(DatabaseName string, TableName string) {
+	m.Lock.Lock()
+	if m.Databases[DatabaseName] == nil {
+		m.Databases[DatabaseName] = map[string]*MemoryTable{}
+	}
+	m.Databases[DatabaseName][TableName] = &MemoryTable{
+		Records: map[string][]byte{},
+		Indexes: map[string]map[string][]byte{},
+	}
+	m.Lock.Unlock()
+}
+
+// Deletes a table.
+func (m *MemoryEngine) DeleteTable(DatabaseName string, TableName string) {
+	m.Lock.Lock()
+	if m.Databases[DatabaseName] != nil {
+		delete(m.Databases[DatabaseName], TableName)
+	}
+	m.Lock.Unlock()
+}
+
+// Reads a record.
+func (m *MemoryEngine) ReadRecord(DatabaseName string, TableName string, Key string) []byte {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	t := m.Table(DatabaseName, TableName)
+	if t == nil {
+		return nil
+	}
+	return CopyBytes(t.Records[Key])
+}
+
+// Writes a record.
+func (m *MemoryEngine) WriteRecord(DatabaseName string, TableName string, Key string, Data []byte) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil {
+		t.Records[Key] = CopyBytes(Data)
+	}
+	m.Lock.Unlock()
+}
+
+// Deletes a record.
+func (m *MemoryEngine) DeleteRecord(DatabaseName string, TableName string, Key string) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil {
+		delete(t.Records, Key)
+	}
+	m.Lock.Unlock()
+}
+
+// Applies a batch of record changes while the lock is held.
+func (m *MemoryEngine) ApplyBatch(Changes []*RecordChange) {
+	m.Lock.Lock()
+	for _, v := range Changes {
+		t := m.Table(v.DB, v.Table)
+		if t == nil {
+			continue
+		}
+		if v.Data == nil {
+			delete(t.Records, v.Key)
+		} else {
+			t.Records[v.Key] = CopyBytes(v.Data)
+		}
+	}
+	m.Lock.Unlock()
+}
+
+// Gets all the record keys in a table.
+func (m *MemoryEngine) RecordKeys(DatabaseName string, TableName string) []string {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	t := m.Table(DatabaseName, TableName)
+	if t == nil {
+		return []string{}
+	}
+	Keys := make([]string, 0, len(t.Records))
+	for k := range t.Records {
+		Keys = append(Keys, k)
+	}
+	return Keys
+}
+
+// Creates a index.
+func (m *MemoryEngine) CreateIndex(DatabaseName string, TableName string, IndexName string) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil && t.Indexes[IndexName] == nil {
+		t.Indexes[IndexName] = map[string][]byte{}
+	}
+	m.Lock.Unlock()
+}
+
+// Deletes a index.
+func (m *MemoryEngine) DeleteIndex(DatabaseName string, TableName string, IndexName string) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil {
+		delete(t.Indexes, IndexName)
+	}
+	m.Lock.Unlock()
+}
+
+// Gets all the files in a index.
+func (m *MemoryEngine) IndexFiles(DatabaseName string, TableName string, IndexName string) []string {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	t := m.Table(DatabaseName, TableName)
+	if t == nil {
+		return []string{}
+	}
+	Files := make([]string, 0, len(t.Indexes[IndexName]))
+	for k := range t.Indexes[IndexName] {
+		Files = append(Files, k)
+	}
+	return Files
+}
+
+// Reads a index file.
+func (m *MemoryEngine) ReadIndexFile(DatabaseName string, TableName string, IndexName string, File string) []byte {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	t := m.Table(DatabaseName, TableName)
+	if t == nil || t.Indexes[IndexName] == nil {
+		return nil
+	}
+	return CopyBytes(t.Indexes[IndexName][File])
+}
+
+// Writes a index file.
+func (m *MemoryEngine) WriteIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil {
+		if t.Indexes[IndexName] == nil {
+			t.Indexes[IndexName] = map[string][]byte{}
+		}
+		t.Indexes[IndexName][File] = CopyBytes(Data)
+	}
+	m.Lock.Unlock()
+}
+
+// Appends to a index file.
+func (m *MemoryEngine) AppendIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil {
+		if t.Indexes[IndexName] == nil {
+			t.Indexes[IndexName] = map[string][]byte{}
+		}
+		t.Indexes[IndexName][File] = append(t.Indexes[IndexName][File], Data...)
+	}
+	m.Lock.Unlock()
+}
+
+// Deletes a index file.
+func (m *MemoryEngine) DeleteIndexFile(DatabaseName string, TableName string, IndexName string, File string) {
+	m.Lock.Lock()
+	t := m.Table(DatabaseName, TableName)
+	if t != nil && t.Indexes[IndexName] != nil {
+		delete(t.Indexes[IndexName], File)
+	}
+	m.Lock.Unlock()
+}
@@ -0,0 +1,269 @@
+// This handles ordered indexes. A ordered index keeps its entries in a B-tree sorted by the values of its keys, so it can answer range queries (>, >=, <, <=, between and string prefixes) and return records in order.
+// The values are encoded so that comparing the encoded bytes gives the same order as comparing the values. Each value starts with a tag so values of different types sort as null < booleans < numbers < strings < anything else.
+// The encoding of each value knows where it ends, so the encoded values of the keys can just be put one after the other.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Defines the tags which start each encoded value.
+const (
+	OrderedNull   = 1
+	OrderedFalse  = 2
+	OrderedTrue   = 3
+	OrderedNumber = 4
+	OrderedString = 5
+	OrderedOther  = 6
+)
+
+// Escapes a string so it can be put in a encoded key. Null bytes are escaped so the terminator (a null byte followed by 0x01) can never appear inside the string.
+func EscapeOrderedString(Value string) string {
+	return strings.Replace(Value, "\x00", "\x00\xff", -1)
+}
+
+// Encodes a value so that the encoded values sort in the same order as the values.
+func EncodeOrderedValue(Value interface{}) string {
+	switch v := Value.(type) {
+	case nil:
+		return string([]byte{OrderedNull})
+	case bool:
+		if v {
+			return string([]byte{OrderedTrue})
+		}
+		return string([]byte{OrderedFalse})
+	case float64:
+		return EncodeOrderedNumber(v)
+	case int:
+		return EncodeOrderedNumber(float64(v))
+	case int64:
+		return EncodeOrderedNumber(float64(v))
+	case string:
+		return string([]byte{OrderedString}) + EscapeOrderedString(v) + "\x00\x01"
+	default:
+		j, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		return string([]byte{OrderedOther}) + EscapeOrderedString(string(j)) + "\x00\x01"
+	}
+}
+
+// Encodes a number. Flipping the sign bit of positive numbers and every bit of negative numbers makes the bytes sort in the same order as the numbers.
+func EncodeOrderedNumber(Value float64) string {
+	Bits := math.Float64bits(Value)
+	if Value == 0 {
+		// Makes sure -0 and 0 are the same.
+		Bits = 0
+	}
+	if Bits&(1<<63) != 0 {
+		Bits = ^Bits
+	} else {
+		Bits |= 1 << 63
+	}
+	b := make([]byte, 9)
+	b[0] = OrderedNumber
+	binary.BigEndian.PutUint64(b[1:], Bits)
+	return string(b)
+}
+
+// Encodes a list of values one after the other.
+func EncodeOrderedValues(Values []interface{}) string {
+	Encoded := ""
+	for _, v := range Values {
+		Encoded += EncodeOrderedValue(v)
+	}
+	return Encoded
+}
+
+// Defines a query against a index. Values are the values of the first keys of the index. On a ordered index, the next key can then be limited to a range or a string prefix.
+type IndexQuery struct {
+	Values []interface{} `json:"values"`
+	Gt     interface{}   `json:"gt,omitempty"`
+	Gte    interface{}   `json:"gte,omitempty"`
+	Lt     interface{}   `json:"lt,omitempty"`
+	Lte    interface{}   `json:"lte,omitempty"`
+	Prefix *string       `json:"prefix,omitempty"`
+
+	// Returns the records in reverse order. Only used on ordered indexes.
+	Reverse bool `json:"reverse,omitempty"`
+
+	// The cursor from the last page.
+	After string `json:"after,omitempty"`
+
+	// The most records to return. 0 means there is no limit.
+	Limit int `json:"limit"`
+
+	// The fields of each record to return (see projection.go). The whole record is returned if this is empty.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Checks if the query has a range or prefix on it.
+func (q *IndexQuery) HasRange() bool {
+	return q.Gt != nil || q.Gte != nil || q.Lt != nil || q.Lte != nil || q.Prefix != nil
+}
+
+// Defines where a range starts and ends in a ordered index.
+type OrderedBounds struct {
+	// Every key in the range starts with this.
+	Base string
+
+	// The range starts at this key. If Exclusive is true, keys starting with it are not in the range.
+	Start          string
+	StartExclusive bool
+
+	// The range ends at this key. If Exclusive is true, keys starting with it are not in the range.
+	End          string
+	EndExclusive bool
+	HasEnd       bool
+}
+
+// Works out the bounds of a query on a ordered index.
+func (i *Index) OrderedBounds(Query *IndexQuery) (*OrderedBounds, error) {
+	Size := len(Query.Values)
+	if Query.HasRange() {
+		Size++
+	}
+	if Size > len(i.Keys) {
+		return nil, errors.New(`The index "` + i.Name + `" only has ` + strconv.Itoa(len(i.Keys)) + " keys.")
+	}
+	if Query.Gt != nil && Query.Gte != nil || Query.Lt != nil && Query.Lte != nil {
+		return nil, errors.New("A range can only have one lower and one upper bound.")
+	}
+	if Query.Prefix != nil && (Query.Gt != nil || Query.Gte != nil || Query.Lt != nil || Query.Lte != nil) {
+		return nil, errors.New("A prefix cannot be used with a range.")
+	}
+
+	Base := EncodeOrderedValues(Query.Values)
+	Bounds := &OrderedBounds{Base: Base, Start: Base}
+	if Query.Prefix != nil {
+		// The terminator is left off so every string starting with the prefix matches.
+		Bounds.Base += string([]byte{OrderedString}) + EscapeOrderedString(*Query.Prefix)
+		Bounds.Start = Bounds.Base
+	}
+	if Query.Gte != nil {
+		Bounds.Start = Base + EncodeOrderedValue(Query.Gte)
+	}
+	if Query.Gt != nil {
+		Bounds.Start = Base + EncodeOrderedValue(Query.Gt)
+		Bounds.StartExclusive = true
+	}
+	if Query.Lte != nil {
+		Bounds.End = Base + EncodeOrderedValue(Query.Lte)
+		Bounds.HasEnd = true
+	}
+	if Query.Lt != nil {
+		Bounds.End = Base + EncodeOrderedValue(Query.Lt)
+		Bounds.EndExclusive = true
+		Bounds.HasEnd = true
+	}
+	return Bounds, nil
+}
+
+// Checks if a key is after the start of the range.
+func (b *OrderedBounds) AfterStart(Key string) bool {
+	if b.StartExclusive {
+		return Key > b.Start && !strings.HasPrefix(Key, b.Start)
+	}
+	return Key >= b.Start
+}
+
+// Checks if a key is before the end of the range.
+func (b *OrderedBounds) BeforeEnd(Key string) bool {
+	if !b.HasEnd {
+		return true
+	}
+	if b.EndExclusive {
+		return Key < b.End
+	}
+	return Key <= b.End || strings.HasPrefix(Key, b.End)
+}
+
+// Checks if a key is in the range.
+func (b *OrderedBounds) Contains(Key string) bool {
+	return strings.HasPrefix(Key, b.Base) && b.AfterStart(Key) && b.BeforeEnd(Key)
+}
+
+// Gets the key of a item which a range reaches first: the lowest key in the range, or the highest if the range is read in reverse. The boolean is false if the item has no key in the range.
+// A multi-key index can have a record under several keys in the range, and it is only returned at this one.
+func (i *Index) FirstKeyInRange(Item *interface{}, Bounds *OrderedBounds, Reverse bool) (string, bool) {
+	First := ""
+	Found := false
+	for _, k := range i.KeysFor(Item) {
+		if !Bounds.Contains(k) {
+			continue
+		}
+		if !Found || (Reverse && k > First) || (!Reverse && k < First) {
+			First = k
+			Found = true
+		}
+	}
+	return First, Found
+}
+
+// Makes the cursor which points at a entry in a ordered index.
+func EncodeOrderedCursor(Key string, Record string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(Key)) + "." + Record
+}
+
+// Gets the entry a cursor from a ordered index points at.
+func DecodeOrderedCursor(Cursor string) (*IndexEntry, error) {
+	Dot := strings.IndexByte(Cursor, '.')
+	if Dot == -1 {
+		return nil, errors.New("The cursor is not valid.")
+	}
+	Key, err := base64.RawURLEncoding.DecodeString(Cursor[:Dot])
+	if err != nil {
+		return nil, errors.New("The cursor is not valid.")
+	}
+	return &IndexEntry{Key: string(Key), Record: Cursor[Dot+1:]}, nil
+}
+
+// Gets up to Limit entries in the range from a ordered index, starting after the entry given (or at the start of the range if it is nil).
+func (i *Index) OrderedRange(Bounds *OrderedBounds, Reverse bool, After *IndexEntry, Limit int) []*IndexEntry {
+	Entries := make([]*IndexEntry, 0)
+	Handler := func(Entry *IndexEntry) bool {
+		if After != nil && !After.Less(Entry) && !Entry.Less(After) {
+			// This is the entry the last page ended on.
+			return true
+		}
+		if !Bounds.Contains(Entry.Key) {
+			// Skips the keys outside the side of the range we started from and stops at the first key past the other side.
+			if Reverse {
+				return strings.HasPrefix(Entry.Key, Bounds.Base) && !Bounds.BeforeEnd(Entry.Key)
+			}
+			return strings.HasPrefix(Entry.Key, Bounds.Base) && !Bounds.AfterStart(Entry.Key)
+		}
+		Entries = append(Entries, Entry)
+		return Limit <= 0 || len(Entries) < Limit
+	}
+
+	i.IndexLock.RLock()
+	if Reverse {
+		From := After
+		if From == nil {
+			// Starts at the very end of the range. No key can contain 0xff after a tag, so this sorts after every key in the range.
+			End := Bounds.Base + "\xff"
+			if Bounds.HasEnd {
+				End = Bounds.End + "\xff"
+			}
+			From = &IndexEntry{Key: End}
+		}
+		i.Tree.Descend(From, Handler)
+	} else {
+		From := After
+		if From == nil {
+			From = &IndexEntry{Key: Bounds.Start}
+		}
+		i.Tree.Ascend(From, Handler)
+	}
+	i.IndexLock.RUnlock()
+	return Entries
+}
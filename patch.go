@@ -0,0 +1,317 @@
+// This handles patching records with JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) documents.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Defines the types of patch which can be applied to a record.
+const (
+	PatchMerge = "merge"
+	PatchJSON  = "json"
+)
+
+// Applies a patch of the type given to a item. The item given is not modified.
+func ApplyPatch(Item interface{}, PatchType string, Patch interface{}) (interface{}, error) {
+	switch PatchType {
+	case PatchMerge:
+		return MergePatch(DeepCopy(Item), Patch), nil
+	case PatchJSON:
+		Operations, ok := Patch.([]interface{})
+		if !ok {
+			return nil, errors.New("A JSON patch must be an array of operations.")
+		}
+		return JSONPatch(DeepCopy(Item), Operations)
+	default:
+		return nil, errors.New(`The patch type "` + PatchType + `" is not supported.`)
+	}
+}
+
+// Makes a deep copy of a decoded JSON value.
+func DeepCopy(Item interface{}) interface{} {
+	switch v := Item.(type) {
+	case map[string]interface{}:
+		Copy := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			Copy[k] = DeepCopy(x)
+		}
+		return Copy
+	case []interface{}:
+		Copy := make([]interface{}, len(v))
+		for i, x := range v {
+			Copy[i] = DeepCopy(x)
+		}
+		return Copy
+	default:
+		return v
+	}
+}
+
+// Applies a JSON Merge Patch (RFC 7396) to the target.
+func MergePatch(Target interface{}, Patch interface{}) interface{} {
+	PatchMap, ok := Patch.(map[string]interface{})
+	if !ok {
+		// Anything which isn't a object replaces the target outright.
+		return Patch
+	}
+	TargetMap, ok := Target.(map[string]interface{})
+	if !ok {
+		TargetMap = map[string]interface{}{}
+	}
+	for k, v := range PatchMap {
+		if v == nil {
+			delete(TargetMap, k)
+		} else {
+			TargetMap[k] = MergePatch(TargetMap[k], v)
+		}
+	}
+	return TargetMap
+}
+
+// Splits a JSON Pointer (RFC 6901) into the tokens which make it up.
+func ParseJSONPointer(Pointer string) ([]string, error) {
+	if Pointer == "" {
+		return []string{}, nil
+	}
+	if Pointer[0] != '/' {
+		return nil, errors.New(`The JSON pointer "` + Pointer + `" must start with a "/".`)
+	}
+	Tokens := strings.Split(Pointer[1:], "/")
+	for i, v := range Tokens {
+		Tokens[i] = strings.Replace(strings.Replace(v, "~1", "/", -1), "~0", "~", -1)
+	}
+	return Tokens, nil
+}
+
+// Parses the index of a array from a pointer token. If AllowEnd is true, "-" is the length of the array.
+func ParseArrayIndex(Token string, Length int, AllowEnd bool) (int, error) {
+	if Token == "-" && AllowEnd {
+		return Length, nil
+	}
+	i, err := strconv.Atoi(Token)
+	if err != nil || i < 0 || (Token != "0" && Token[0] == '0') {
+		return 0, errors.New(`"` + Token + `" is not a valid array index.`)
+	}
+	Max := Length - 1
+	if AllowEnd {
+		Max = Length
+	}
+	if i > Max {
+		return 0, errors.New("The array index " + Token + " is out of bounds.")
+	}
+	return i, nil
+}
+
+// Gets the value a JSON pointer points to.
+func GetJSONPointer(Document interface{}, Tokens []string) (interface{}, error) {
+	Current := Document
+	for _, t := range Tokens {
+		switch v := Current.(type) {
+		case map[string]interface{}:
+			x, ok := v[t]
+			if !ok {
+				return nil, errors.New(`The member "` + t + `" does not exist.`)
+			}
+			Current = x
+		case []interface{}:
+			i, err := ParseArrayIndex(t, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			Current = v[i]
+		default:
+			return nil, errors.New(`The path "` + t + `" goes through a value which is not a object or array.`)
+		}
+	}
+	return Current, nil
+}
+
+// Changes the parent of the last token in a JSON pointer. The function given gets the parent and the last token and returns the new parent.
+func UpdateJSONPointerParent(Document interface{}, Tokens []string, Update func(Parent interface{}, Token string) (interface{}, error)) (interface{}, error) {
+	if len(Tokens) == 1 {
+		return Update(Document, Tokens[0])
+	}
+	switch v := Document.(type) {
+	case map[string]interface{}:
+		x, ok := v[Tokens[0]]
+		if !ok {
+			return nil, errors.New(`The member "` + Tokens[0] + `" does not exist.`)
+		}
+		NewChild, err := UpdateJSONPointerParent(x, Tokens[1:], Update)
+		if err != nil {
+			return nil, err
+		}
+		v[Tokens[0]] = NewChild
+		return v, nil
+	case []interface{}:
+		i, err := ParseArrayIndex(Tokens[0], len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		NewChild, err := UpdateJSONPointerParent(v[i], Tokens[1:], Update)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = NewChild
+		return v, nil
+	default:
+		return nil, errors.New(`The path "` + Tokens[0] + `" goes through a value which is not a object or array.`)
+	}
+}
+
+// Adds a value at the location of the JSON pointer.
+func AddJSONPointer(Document interface{}, Tokens []string, Value interface{}) (interface{}, error) {
+	if len(Tokens) == 0 {
+		return Value, nil
+	}
+	return UpdateJSONPointerParent(Document, Tokens, func(Parent interface{}, Token string) (interface{}, error) {
+		switch v := Parent.(type) {
+		case map[string]interface{}:
+			v[Token] = Value
+			return v, nil
+		case []interface{}:
+			i, err := ParseArrayIndex(Token, len(v), true)
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = Value
+			return v, nil
+		default:
+			return nil, errors.New(`The path "` + Token + `" goes through a value which is not a object or array.`)
+		}
+	})
+}
+
+// Removes the value at the location of the JSON pointer.
+func RemoveJSONPointer(Document interface{}, Tokens []string) (interface{}, error) {
+	if len(Tokens) == 0 {
+		return nil, errors.New("The whole document cannot be removed.")
+	}
+	return UpdateJSONPointerParent(Document, Tokens, func(Parent interface{}, Token string) (interface{}, error) {
+		switch v := Parent.(type) {
+		case map[string]interface{}:
+			if _, ok := v[Token]; !ok {
+				return nil, errors.New(`The member "` + Token + `" does not exist.`)
+			}
+			delete(v, Token)
+			return v, nil
+		case []interface{}:
+			i, err := ParseArrayIndex(Token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		default:
+			return nil, errors.New(`The path "` + Token + `" goes through a value which is not a object or array.`)
+		}
+	})
+}
+
+// Applies a JSON Patch (RFC 6902) to the document. If any of the operations fail, a error is returned and the patch should be thrown away.
+func JSONPatch(Document interface{}, Operations []interface{}) (interface{}, error) {
+	for _, o := range Operations {
+		Operation, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("A JSON patch operation must be a object.")
+		}
+		Op, _ := Operation["op"].(string)
+		PathStr, ok := Operation["path"].(string)
+		if !ok {
+			return nil, errors.New(`A JSON patch operation must have a "path".`)
+		}
+		Path, err := ParseJSONPointer(PathStr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Gets the value and from fields if this operation needs them.
+		Value, HasValue := Operation["value"]
+		var From []string
+		if Op == "move" || Op == "copy" {
+			FromStr, ok := Operation["from"].(string)
+			if !ok {
+				return nil, errors.New(`The "` + Op + `" operation must have a "from".`)
+			}
+			From, err = ParseJSONPointer(FromStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if (Op == "add" || Op == "replace" || Op == "test") && !HasValue {
+			return nil, errors.New(`The "` + Op + `" operation must have a "value".`)
+		}
+
+		switch Op {
+		case "add":
+			Document, err = AddJSONPointer(Document, Path, DeepCopy(Value))
+		case "remove":
+			Document, err = RemoveJSONPointer(Document, Path)
+		case "replace":
+			_, err = GetJSONPointer(Document, Path)
+			if err == nil {
+				if len(Path) == 0 {
+					Document = DeepCopy(Value)
+				} else {
+					Document, err = RemoveJSONPointer(Document, Path)
+					if err == nil {
+						Document, err = AddJSONPointer(Document, Path, DeepCopy(Value))
+					}
+				}
+			}
+		case "move":
+			if strings.HasPrefix(PathStr+"/", Operation["from"].(string)+"/") && PathStr != Operation["from"].(string) {
+				return nil, errors.New("A value cannot be moved into one of its children.")
+			}
+			var Moved interface{}
+			Moved, err = GetJSONPointer(Document, From)
+			if err == nil {
+				Document, err = RemoveJSONPointer(Document, From)
+				if err == nil {
+					Document, err = AddJSONPointer(Document, Path, Moved)
+				}
+			}
+		case "copy":
+			var Copied interface{}
+			Copied, err = GetJSONPointer(Document, From)
+			if err == nil {
+				Document, err = AddJSONPointer(Document, Path, DeepCopy(Copied))
+			}
+		case "test":
+			var Current interface{}
+			Current, err = GetJSONPointer(Document, Path)
+			if err == nil && !JSONEqual(Current, Value) {
+				err = errors.New(`The test at "` + PathStr + `" failed.`)
+			}
+		default:
+			return nil, errors.New(`The JSON patch operation "` + Op + `" is not supported.`)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Document, nil
+}
+
+// Checks if two decoded JSON values are equal.
+func JSONEqual(A interface{}, B interface{}) bool {
+	// Round tripping through JSON makes sure numbers are all float64's and maps are compared by value.
+	a, err := json.Marshal(A)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(B)
+	if err != nil {
+		return false
+	}
+	var x, y interface{}
+	_ = json.Unmarshal(a, &x)
+	_ = json.Unmarshal(b, &y)
+	return reflect.DeepEqual(x, y)
+}
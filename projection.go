@@ -0,0 +1,189 @@
+// This handles projections, which pick the fields of a record to send back instead of the whole record. A projection is a list of fields, such as "name,address.city,-address.secret" in a query string:
+//   - Each field is a index key path (see index_path.go), so nested fields and array elements can be picked.
+//   - A field starting with "-" is excluded. The rest of the record is kept.
+//   - If there are fields which aren't excluded, only those are kept, and then the excluded fields are taken out of them.
+// A record which isn't a object is sent back as it is. Projections are applied on the shard which holds the record, so the fields which aren't needed never cross the network.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The most fields a projection can have.
+const ProjectionMaxFields = 100
+
+// Defines a parsed projection.
+type Projection struct {
+	Include []string
+	Exclude []string
+}
+
+// Splits the fields in a query string. Returns nil if there are none.
+func SplitProjectionFields(Raw string) []string {
+	if Raw == "" {
+		return nil
+	}
+	return strings.Split(Raw, ",")
+}
+
+// Parses the fields of a projection. Returns nil if there are no fields, which keeps the whole record.
+func ParseProjection(Fields []string) (*Projection, error) {
+	if len(Fields) == 0 {
+		return nil, nil
+	}
+	if len(Fields) > ProjectionMaxFields {
+		return nil, errors.New("A projection can have at most " + strconv.Itoa(ProjectionMaxFields) + " fields.")
+	}
+	p := &Projection{Include: []string{}, Exclude: []string{}}
+	for _, v := range Fields {
+		Exclude := strings.HasPrefix(v, "-")
+		if Exclude {
+			v = v[1:]
+		}
+		if v == "" {
+			return nil, errors.New("A field in a projection cannot be empty.")
+		}
+		if _, err := ParseIndexPath(v); err != nil {
+			return nil, err
+		}
+		if Exclude {
+			p.Exclude = append(p.Exclude, v)
+		} else {
+			p.Include = append(p.Include, v)
+		}
+	}
+	return p, nil
+}
+
+// Defines a tree of the paths in a projection. Leaf is true if a path ends at this node.
+type ProjectionNode struct {
+	Leaf     bool
+	Children map[string]*ProjectionNode
+}
+
+// Builds the tree of paths for a record. Like index keys, a field which is the name of a top level field in the record is never split into a path.
+func BuildProjectionTree(Record map[string]interface{}, Fields []string) *ProjectionNode {
+	Root := &ProjectionNode{Children: map[string]*ProjectionNode{}}
+	for _, f := range Fields {
+		Segments := []string{f}
+		if _, ok := Record[f]; !ok {
+			// The fields were checked when the projection was parsed.
+			Segments, _ = ParseIndexPath(f)
+		}
+		Node := Root
+		for _, s := range Segments {
+			if Node.Leaf {
+				break
+			}
+			Child := Node.Children[s]
+			if Child == nil {
+				Child = &ProjectionNode{Children: map[string]*ProjectionNode{}}
+				Node.Children[s] = Child
+			}
+			Node = Child
+		}
+		Node.Leaf = true
+	}
+	return Root
+}
+
+// Gets the array elements a node picks, in order. Elements which aren't in the array are skipped.
+func (n *ProjectionNode) Elements(Length int) []int {
+	Elements := make([]int, 0, len(n.Children))
+	for k := range n.Children {
+		i, err := strconv.Atoi(k)
+		if err == nil && i >= 0 && i < Length {
+			Elements = append(Elements, i)
+		}
+	}
+	sort.Ints(Elements)
+	return Elements
+}
+
+// Copies the parts of a value the node picks. The boolean is false if the value has none of them.
+func (n *ProjectionNode) Pick(Value interface{}) (interface{}, bool) {
+	if n.Leaf {
+		return Value, true
+	}
+	switch v := Value.(type) {
+	case map[string]interface{}:
+		Picked := map[string]interface{}{}
+		for k, Child := range n.Children {
+			if Field, ok := v[k]; ok {
+				if p, ok := Child.Pick(Field); ok {
+					Picked[k] = p
+				}
+			}
+		}
+		return Picked, len(Picked) != 0
+	case []interface{}:
+		Picked := make([]interface{}, 0)
+		for _, i := range n.Elements(len(v)) {
+			if p, ok := n.Children[strconv.Itoa(i)].Pick(v[i]); ok {
+				Picked = append(Picked, p)
+			}
+		}
+		return Picked, len(Picked) != 0
+	}
+	return nil, false
+}
+
+// Copies a value without the parts the node picks. The value given is never changed.
+func (n *ProjectionNode) Remove(Value interface{}) interface{} {
+	switch v := Value.(type) {
+	case map[string]interface{}:
+		Kept := make(map[string]interface{}, len(v))
+		for k, Field := range v {
+			Kept[k] = Field
+		}
+		for k, Child := range n.Children {
+			if Field, ok := v[k]; ok {
+				if Child.Leaf {
+					delete(Kept, k)
+				} else {
+					Kept[k] = Child.Remove(Field)
+				}
+			}
+		}
+		return Kept
+	case []interface{}:
+		Kept := make([]interface{}, 0, len(v))
+		for i, Element := range v {
+			Child := n.Children[strconv.Itoa(i)]
+			if Child == nil {
+				Kept = append(Kept, Element)
+			} else if !Child.Leaf {
+				Kept = append(Kept, Child.Remove(Element))
+			}
+		}
+		return Kept
+	}
+	return Value
+}
+
+// Applies the projection to a item. The item given is never changed, since it can be shared with the cache.
+func (p *Projection) Apply(Item *interface{}) *interface{} {
+	if p == nil || Item == nil {
+		return Item
+	}
+	Record, ok := (*Item).(map[string]interface{})
+	if !ok {
+		return Item
+	}
+	var Result interface{} = Record
+	if len(p.Include) != 0 {
+		Picked, _ := BuildProjectionTree(Record, p.Include).Pick(Record)
+		if Picked == nil {
+			Picked = map[string]interface{}{}
+		}
+		Result = Picked
+	}
+	if len(p.Exclude) != 0 {
+		Result = BuildProjectionTree(Record, p.Exclude).Remove(Result)
+	}
+	return &Result
+}
@@ -0,0 +1,518 @@
+// This handles filter queries, which find the records in a table matching a filter (see filter.go). Each shard plans the query against its own indexes:
+//   - A hash index can be used if the filter has $eq (or $in) on every key of the index.
+//   - A ordered index can be used if the filter has $eq on its first keys, and can then have a range on the next key.
+//   - A partial index can only be used if the filter has every clause of the index's filter, since otherwise the index could be missing records which match.
+// Each index which can be used is estimated by counting the entries it would read. The cheapest is picked, or the whole table is scanned if that would read fewer records.
+// The index only narrows down the records. Every record is still checked against the whole filter, so a index never has to match the filter exactly.
+// The records are returned sorted by key and the cursor is the key of the last record, so the pages from each shard can be merged.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The most lookups a hash index can be used for. Each combination of $in values is one lookup.
+const QueryMaxLookups = 100
+
+// The most entries counted when estimating how many records a index would read.
+const QueryEstimateLimit = 10000
+
+// Defines a filter query.
+type FilterQuery struct {
+	Filter interface{} `json:"filter"`
+
+	// The cursor from the last page.
+	After string `json:"after,omitempty"`
+
+	// The most records to return. 0 means there is no limit.
+	Limit int `json:"limit"`
+
+	// If true, the page says how each shard ran the query (see query_explain.go).
+	Explain bool `json:"explain,omitempty"`
+
+	// The fields of each record to return (see projection.go). The whole record is returned if this is empty.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Defines how a query will be run on a shard. If the index is nil, the table is scanned.
+type QueryPlan struct {
+	Index *Index
+
+	// The keys looked up in a hash index.
+	Keys []string
+
+	// The range read from a ordered index.
+	Bounds *OrderedBounds
+
+	// How many records the plan is expected to read.
+	Estimated int
+
+	// Every index on the table and whether it could have been used.
+	Considered []*QueryCandidate
+}
+
+// Gets the values the filter allows for a key. The boolean is false if the filter doesn't limit the key to a list of values.
+func (f *Filter) ValuesFor(Key string, AllowIn bool) ([]interface{}, bool) {
+	var Values []interface{}
+	for _, c := range f.Clauses {
+		if c.Key != Key {
+			continue
+		}
+		if c.Op == FilterEq {
+			return []interface{}{c.Value}, true
+		}
+		if c.Op == FilterIn && AllowIn {
+			Values = c.Value.([]interface{})
+		}
+	}
+	return Values, Values != nil
+}
+
+// Gets the clause with one of the operators given on a key. Returns nil if there isn't one.
+func (f *Filter) ClauseFor(Key string, Ops ...string) *FilterClause {
+	for _, Op := range Ops {
+		for _, c := range f.Clauses {
+			if c.Key == Key && c.Op == Op {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// Checks if every record matching this filter matches the other filter as well. Only filters made of clauses are checked, so this can be false when it is really true.
+func (f *Filter) Implies(Other *Filter) bool {
+	if len(Other.And) != 0 || len(Other.Or) != 0 || Other.Not != nil {
+		return false
+	}
+	for _, o := range Other.Clauses {
+		Found := false
+		for _, c := range f.Clauses {
+			if c.Key == o.Key && c.Op == o.Op && FilterEqual(c.Value, o.Value) {
+				Found = true
+				break
+			}
+		}
+		if !Found {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if a value can be looked up in the index. Records with null in a key aren't in the index, and a multi-key index has the elements of a array rather than the array.
+func (i *Index) CanLookUp(Value interface{}) bool {
+	if Value == nil {
+		return false
+	}
+	_, IsArray := Value.([]interface{})
+	return !IsArray || !i.MultiKey
+}
+
+// Works out how the index could be used for a filter. Returns nil if it can't be. The index lock doesn't need to be held.
+func (i *Index) PlanFilter(f *Filter) *QueryPlan {
+	if i.FullText() || (i.Matcher != nil && !f.Implies(i.Matcher)) {
+		return nil
+	}
+	if i.Ordered() {
+		return i.PlanOrderedFilter(f)
+	}
+
+	// Gets every combination of the values the keys can have.
+	Combinations := [][]interface{}{{}}
+	for _, k := range i.Keys {
+		Values, ok := f.ValuesFor(k, true)
+		if !ok || len(Combinations)*len(Values) > QueryMaxLookups {
+			return nil
+		}
+		Next := make([][]interface{}, 0, len(Combinations)*len(Values))
+		for _, c := range Combinations {
+			for _, v := range Values {
+				if !i.CanLookUp(v) {
+					return nil
+				}
+				Next = append(Next, append(append([]interface{}{}, c...), v))
+			}
+		}
+		Combinations = Next
+	}
+	Plan := &QueryPlan{Index: i, Keys: make([]string, 0, len(Combinations))}
+	for _, c := range Combinations {
+		Plan.Keys = append(Plan.Keys, i.EncodeKey(c))
+	}
+	return Plan
+}
+
+// Works out how a ordered index could be used for a filter. Returns nil if it can't be.
+func (i *Index) PlanOrderedFilter(f *Filter) *QueryPlan {
+	// Gets the values of the first keys.
+	Query := &IndexQuery{Values: []interface{}{}}
+	for _, k := range i.Keys {
+		Values, ok := f.ValuesFor(k, false)
+		if !ok || !i.CanLookUp(Values[0]) {
+			break
+		}
+		Query.Values = append(Query.Values, Values[0])
+	}
+
+	// Gets the range on the next key.
+	if len(Query.Values) < len(i.Keys) {
+		Key := i.Keys[len(Query.Values)]
+		if c := f.ClauseFor(Key, FilterGt, FilterGte); c != nil {
+			if c.Op == FilterGt {
+				Query.Gt = c.Value
+			} else {
+				Query.Gte = c.Value
+			}
+		}
+		if c := f.ClauseFor(Key, FilterLt, FilterLte); c != nil {
+			if c.Op == FilterLt {
+				Query.Lt = c.Value
+			} else {
+				Query.Lte = c.Value
+			}
+		}
+	}
+	if len(Query.Values) == 0 && !Query.HasRange() {
+		return nil
+	}
+	Bounds, err := i.OrderedBounds(Query)
+	if err != nil {
+		return nil
+	}
+
+	// A range only matches values of the same type, so the range can stop at the end (or start at the start) of the type.
+	Base := EncodeOrderedValues(Query.Values)
+	if Query.HasRange() {
+		Tag := OrderedTypeTag(Query.Gt, Query.Gte, Query.Lt, Query.Lte)
+		if Tag != 0 {
+			if !Bounds.HasEnd {
+				Bounds.End = Base + string([]byte{Tag + 1})
+				Bounds.EndExclusive = true
+				Bounds.HasEnd = true
+			}
+			if Query.Gt == nil && Query.Gte == nil {
+				Bounds.Start = Base + string([]byte{Tag})
+			}
+		}
+	}
+	return &QueryPlan{Index: i, Bounds: Bounds}
+}
+
+// Gets the tag of the bounds of a range if they are all numbers or all strings. Returns 0 otherwise.
+func OrderedTypeTag(Bounds ...interface{}) byte {
+	var Tag byte
+	for _, v := range Bounds {
+		if v == nil {
+			continue
+		}
+		var t byte
+		switch v.(type) {
+		case float64:
+			t = OrderedNumber
+		case string:
+			t = OrderedString
+		default:
+			return 0
+		}
+		if Tag != 0 && Tag != t {
+			return 0
+		}
+		Tag = t
+	}
+	return Tag
+}
+
+// Calls the function for each entry the plan reads from the index. Stops when the function returns false. The index lock should be held when this is called.
+func (p *QueryPlan) EachNonThreadSafe(Handler func(Entry *IndexEntry) bool) {
+	if p.Bounds != nil {
+		p.Index.Tree.Ascend(&IndexEntry{Key: p.Bounds.Start}, func(Entry *IndexEntry) bool {
+			if !p.Bounds.Contains(Entry.Key) {
+				// Skips the keys before the start and stops at the first key past the end.
+				return strings.HasPrefix(Entry.Key, p.Bounds.Base) && !p.Bounds.AfterStart(Entry.Key)
+			}
+			return Handler(Entry)
+		})
+		return
+	}
+	for _, k := range p.Keys {
+		Stopped := false
+		p.Index.Tree.Ascend(&IndexEntry{Key: k}, func(Entry *IndexEntry) bool {
+			if Entry.Key != k {
+				return false
+			}
+			Stopped = !Handler(Entry)
+			return !Stopped
+		})
+		if Stopped {
+			return
+		}
+	}
+}
+
+// Counts the entries the plan would read, stopping at Limit. The index lock should be held when this is called.
+func (p *QueryPlan) CountNonThreadSafe(Limit int) int {
+	Count := 0
+	p.EachNonThreadSafe(func(Entry *IndexEntry) bool {
+		Count++
+		return Count < Limit
+	})
+	return Count
+}
+
+// Gets the records the plan reads from the index, sorted by key.
+func (p *QueryPlan) Records() []string {
+	Found := map[string]bool{}
+	p.Index.IndexLock.RLock()
+	p.EachNonThreadSafe(func(Entry *IndexEntry) bool {
+		Found[Entry.Record] = true
+		return true
+	})
+	p.Index.IndexLock.RUnlock()
+	Keys := make([]string, 0, len(Found))
+	for k := range Found {
+		Keys = append(Keys, k)
+	}
+	sort.Strings(Keys)
+	return Keys
+}
+
+// Works out the cheapest way to run a filter on a table on this shard.
+func (d *DBCore) PlanQuery(DatabaseName string, TableName string, f *Filter) (*QueryPlan, error) {
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return nil, err
+	}
+
+	// Scanning reads every record.
+	Best := &QueryPlan{Estimated: len(d.Engine.RecordKeys(DatabaseName, TableName))}
+	Considered := make([]*QueryCandidate, 0, len(Table.Indexes))
+	for _, v := range Table.Indexes {
+		Candidate := &QueryCandidate{Index: v.Name}
+		Considered = append(Considered, Candidate)
+		if d.IndexBuilding(DatabaseName, TableName, v) {
+			Candidate.Reason = QueryReasonBuilding
+			continue
+		}
+		if v.FullText() {
+			Candidate.Reason = QueryReasonFullText
+			continue
+		}
+		if v.Matcher != nil && !f.Implies(v.Matcher) {
+			Candidate.Reason = QueryReasonPartial
+			continue
+		}
+		Plan := v.PlanFilter(f)
+		if Plan == nil {
+			Candidate.Reason = QueryReasonKeys
+			continue
+		}
+		v.IndexLock.RLock()
+		Plan.Estimated = Plan.CountNonThreadSafe(QueryEstimateLimit)
+		v.IndexLock.RUnlock()
+		Candidate.Estimated = &Plan.Estimated
+		if Plan.Estimated <= Best.Estimated {
+			Best = Plan
+		}
+	}
+	Best.Considered = Considered
+	return Best, nil
+}
+
+// Parses the filter of a query. A query with no filter matches every record.
+func (q *FilterQuery) ParsedFilter() (*Filter, error) {
+	if q.Filter == nil {
+		return &Filter{}, nil
+	}
+	return ParseFilter(q.Filter)
+}
+
+// Gets the sorted keys of the records a plan reads.
+func (d *DBCore) PlanKeys(DatabaseName string, TableName string, Plan *QueryPlan) []string {
+	if Plan.Index != nil {
+		return Plan.Records()
+	}
+	Keys := d.Engine.RecordKeys(DatabaseName, TableName)
+	sort.Strings(Keys)
+	return Keys
+}
+
+// Defines the result of running a query on a shard. Examined is how many records were read.
+type QueryResult struct {
+	Records  []*IndexRecord
+	Plan     *QueryPlan
+	Examined int
+}
+
+// Runs a filter query on this shard. The records are sorted by key.
+func (d *DBCore) Query(DatabaseName string, TableName string, Query *FilterQuery) (*QueryResult, error) {
+	f, err := Query.ParsedFilter()
+	if err != nil {
+		return nil, err
+	}
+	Fields, err := ParseProjection(Query.Fields)
+	if err != nil {
+		return nil, err
+	}
+	Plan, err := d.PlanQuery(DatabaseName, TableName, f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gets the keys of the records to read.
+	Keys := d.PlanKeys(DatabaseName, TableName, Plan)
+	Start := sort.SearchStrings(Keys, Query.After)
+	if Start < len(Keys) && Keys[Start] == Query.After {
+		Start++
+	}
+
+	// Reads the records until the page is full. Records which have gone or expired are skipped.
+	Result := &QueryResult{Records: make([]*IndexRecord, 0), Plan: Plan}
+	for _, k := range Keys[Start:] {
+		if Query.Limit > 0 && len(Result.Records) == Query.Limit {
+			break
+		}
+		Result.Examined++
+		Item, Meta, err := d.GetWithMeta(DatabaseName, TableName, k)
+		if err != nil {
+			continue
+		}
+		Record, ok := (*Item).(map[string]interface{})
+		if !ok || !f.Matches(Record) {
+			continue
+		}
+		Result.Records = append(Result.Records, &IndexRecord{Key: k, Data: Fields.Apply(Item), Version: Meta.Version})
+	}
+	return Result, nil
+}
+
+// The remote query structure.
+type RemoteQueryStructure struct {
+	FilterQuery
+	DB string `json:"db"`
+	Table string `json:"table"`
+}
+
+// The response from a remote shard after a query.
+type RemoteQueryResponse struct {
+	Err *string `json:"error"`
+	Records []*IndexRecord `json:"records"`
+	Explain *QueryExplain `json:"explain,omitempty"`
+}
+
+// Runs a query on the local DB and gets the response a shard sends back.
+func RunLocalQuery(Query *RemoteQueryStructure) *RemoteQueryResponse {
+	var Response RemoteQueryResponse
+	Result, err := Core.Query(Query.DB, Query.Table, &Query.FilterQuery)
+	if err != nil {
+		e := err.Error()
+		Response.Err = &e
+		return &Response
+	}
+	Response.Records = Result.Records
+	if Query.Explain {
+		Response.Explain = Result.Explain()
+	}
+	return &Response
+}
+
+// Runs a query on one shard.
+func (s *Shard) QueryOnShard(ShardID string, Query *RemoteQueryStructure) ([]*IndexRecord, *QueryExplain, error) {
+	var Response *RemoteQueryResponse
+	if s.ShardURLS[ShardID] == "" {
+		Response = RunLocalQuery(Query)
+	} else {
+		Response = &RemoteQueryResponse{}
+		PostToShard(s.ShardURLS[ShardID], "/_shard/query", Query, Response)
+	}
+	if Response.Err != nil {
+		return nil, nil, RemoteError(Response.Err)
+	}
+	if Response.Explain != nil {
+		Response.Explain.Shard = ShardID
+	}
+	return Response.Records, Response.Explain, nil
+}
+
+// Defines a page of records found by a filter query. Explain is only set if the query asked for it, and has how each shard ran the query.
+type QueryPage struct {
+	IndexPage
+	Explain []*QueryExplain `json:"explain,omitempty"`
+}
+
+// Gets a page of the records in a table which match a filter. Any shard could hold some of the records, so every shard is asked in parallel and the results are merged.
+// Replicas of the same record are only returned once (the newest version wins).
+func (s *Shard) Query(DatabaseName string, TableName string, Query *FilterQuery) (*QueryPage, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before querying tables.")
+		}
+	}
+	UptimeMutex.RUnlock()
+	if _, err := Query.ParsedFilter(); err != nil {
+		return nil, err
+	}
+
+	// Asks each shard for one more record than the limit. If there is more than the limit after merging, there is another page.
+	ShardQuery := &RemoteQueryStructure{FilterQuery: *Query, DB: DatabaseName, Table: TableName}
+	if Query.Limit > 0 {
+		ShardQuery.Limit = Query.Limit + 1
+	}
+	Merged := map[string]*IndexRecord{}
+	Explains := make([]*QueryExplain, 0)
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Records, Explain, err := s.QueryOnShard(ShardID, ShardQuery)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			}
+			if Explain != nil {
+				Explains = append(Explains, Explain)
+			}
+			for _, v := range Records {
+				if Merged[v.Key] == nil || Merged[v.Key].Version < v.Version {
+					Merged[v.Key] = v
+				}
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+
+	// Sorts the records and cuts them down to the limit.
+	Page := &QueryPage{IndexPage: IndexPage{Records: make([]*IndexRecord, 0, len(Merged))}}
+	for _, v := range Merged {
+		Page.Records = append(Page.Records, v)
+	}
+	sort.Slice(Page.Records, func(a, b int) bool {
+		return Page.Records[a].Key < Page.Records[b].Key
+	})
+	if Query.Limit > 0 && len(Page.Records) > Query.Limit {
+		Page.Records = Page.Records[:Query.Limit]
+		Next := Page.Records[Query.Limit-1].Key
+		Page.Next = &Next
+	}
+	if Query.Explain {
+		sort.Slice(Explains, func(a, b int) bool {
+			return Explains[a].Shard < Explains[b].Shard
+		})
+		Page.Explain = Explains
+	}
+	return Page, nil
+}
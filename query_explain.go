@@ -0,0 +1,59 @@
+// This handles explaining filter queries. A query with explain set still runs, but the page also says how each shard ran it:
+//   - The index the shard used, or that it scanned every record in the table.
+//   - Every index on the table, with how many records it was estimated to read or why it couldn't be used.
+//   - How many records the shard was estimated to read, how many it really read and how many matched.
+// Every shard holds some of the records, so every shard is contacted for a query and has an explanation in the page.
+// Records are read a page at a time, so a shard can read far fewer records than estimated when the page fills up early.
+
+package main
+
+// Defines why a index couldn't be used for a query.
+const (
+	QueryReasonBuilding = "The index is still being built or failed to build."
+	QueryReasonFullText = "Full-text indexes can only be searched."
+	QueryReasonPartial  = "The filter doesn't include the filter of this partial index, so the index could be missing records which match."
+	QueryReasonKeys     = "The filter doesn't give the values of the keys this index needs."
+)
+
+// Defines a index which was considered for a query. Estimated is how many records it would read (up to QueryEstimateLimit), or nil if it couldn't be used.
+type QueryCandidate struct {
+	Index     string `json:"index"`
+	Estimated *int   `json:"estimated,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Defines how a shard ran a query. Index is nil if the table was scanned.
+type QueryExplain struct {
+	Shard      string            `json:"shard"`
+	Index      *string           `json:"index"`
+	IndexType  string            `json:"index_type,omitempty"`
+	Scan       bool              `json:"scan"`
+	Lookups    int               `json:"lookups,omitempty"`
+	Range      bool              `json:"range,omitempty"`
+	Considered []*QueryCandidate `json:"considered"`
+	Estimated  int               `json:"estimated"`
+	Examined   int               `json:"examined"`
+	Returned   int               `json:"returned"`
+}
+
+// Explains how the query was run. The shard is filled in by the shard layer.
+func (r *QueryResult) Explain() *QueryExplain {
+	Explain := &QueryExplain{
+		Scan:       r.Plan.Index == nil,
+		Considered: r.Plan.Considered,
+		Estimated:  r.Plan.Estimated,
+		Examined:   r.Examined,
+		Returned:   len(r.Records),
+	}
+	if r.Plan.Index != nil {
+		Name := r.Plan.Index.Name
+		Explain.Index = &Name
+		Explain.IndexType = r.Plan.Index.Type
+		if Explain.IndexType == "" {
+			Explain.IndexType = IndexTypeHash
+		}
+		Explain.Lookups = len(r.Plan.Keys)
+		Explain.Range = r.Plan.Bounds != nil
+	}
+	return Explain
+}
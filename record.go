@@ -0,0 +1,160 @@
+// This handles how records are stored. A record is stored as a null byte, a JSON header with the record metadata, a new line and then the JSON of the record itself.
+// Records written before the metadata existed are just the JSON of the record. JSON can never start with a null byte, so these are easy to tell apart.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defines the metadata stored with each record.
+type RecordMeta struct {
+	Version uint64 `json:"v"`
+
+	// When the record expires as a Unix timestamp in milliseconds. 0 means the record never expires.
+	Expires int64 `json:"e,omitempty"`
+}
+
+// Gets the current time as a Unix timestamp in milliseconds.
+func NowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Checks if the record has expired.
+func (m *RecordMeta) Expired(Now int64) bool {
+	return m.Expires != 0 && Now >= m.Expires
+}
+
+// Encodes a record with its metadata.
+func EncodeRecord(Meta *RecordMeta, Data []byte) []byte {
+	Header, err := json.Marshal(Meta)
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 0, len(Header)+len(Data)+2)
+	b = append(b, 0)
+	b = append(b, Header...)
+	b = append(b, '\n')
+	return append(b, Data...)
+}
+
+// Decodes a record into its metadata and the JSON of the record.
+func DecodeRecord(Raw []byte) (*RecordMeta, []byte) {
+	if len(Raw) == 0 || Raw[0] != 0 {
+		// This was written before records had metadata. Treat it as the first version.
+		return &RecordMeta{Version: 1}, Raw
+	}
+	End := bytes.IndexByte(Raw, '\n')
+	if End == -1 {
+		panic("The record header is not terminated.")
+	}
+	var Meta RecordMeta
+	err := json.Unmarshal(Raw[1:End], &Meta)
+	if err != nil {
+		panic(err)
+	}
+	return &Meta, Raw[End+1:]
+}
+
+// The error which is returned when the If-Match or If-None-Match condition on a write is not met.
+var ErrPreconditionFailed = errors.New("The precondition given does not match the current version of the record.")
+
+// Defines the options a record can be written with.
+type WriteOptions struct {
+	// The write mode (WriteInsert, WriteReplace or WriteUpsert).
+	Mode int `json:"mode"`
+
+	// If set, the write only happens if the record version matches. "*" matches any version (the record has to exist).
+	IfMatch string `json:"if_match,omitempty"`
+
+	// If set, the write only happens if the record version does not match. "*" matches any version (the record must not exist).
+	IfNoneMatch string `json:"if_none_match,omitempty"`
+
+	// If set, the record is written with this version instead of the next one. This is used to keep replicas on the same version.
+	Version uint64 `json:"version,omitempty"`
+
+	// If set, the record expires this many seconds after it is written.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// When the record expires as a Unix timestamp in milliseconds. The core uses this as is, so the TTL has to be resolved into this before the write reaches the core.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Resolves the TTL (or the default TTL of the table if the TTL isn't set) into the time the record expires.
+func (o *WriteOptions) ResolveExpiry(DefaultTTL int64) {
+	if o.Expires != 0 {
+		return
+	}
+	TTL := o.TTL
+	if TTL == 0 {
+		TTL = DefaultTTL
+	}
+	if TTL > 0 {
+		o.Expires = NowMillis() + TTL*1000
+	}
+}
+
+// Formats a version as a ETag.
+func FormatETag(Version uint64) string {
+	return `"` + strconv.FormatUint(Version, 10) + `"`
+}
+
+// Gets the condition from a If-Match or If-None-Match header. The header can list several ETags, which become a comma separated list of versions. Weak ETags are treated the same as strong ones.
+func ParseETagCondition(Header string) string {
+	Header = strings.TrimSpace(Header)
+	if Header == "*" {
+		return Header
+	}
+	Versions := make([]string, 0)
+	for _, v := range strings.Split(Header, ",") {
+		v = strings.Trim(strings.TrimPrefix(strings.TrimSpace(v), "W/"), `"`)
+		if v != "" {
+			Versions = append(Versions, v)
+		}
+	}
+	return strings.Join(Versions, ",")
+}
+
+// Checks if a condition matches the current state of the record. The condition matches if any of the versions in it does.
+func ConditionMatches(Condition string, Meta *RecordMeta) bool {
+	if Meta == nil {
+		return false
+	}
+	if Condition == "*" {
+		return true
+	}
+	Version := strconv.FormatUint(Meta.Version, 10)
+	for _, v := range strings.Split(Condition, ",") {
+		if v == Version {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the preconditions on a write are met. Meta is nil if the record doesn't exist.
+func (o *WriteOptions) PreconditionsMet(Meta *RecordMeta) bool {
+	if o.IfMatch != "" && !ConditionMatches(o.IfMatch, Meta) {
+		return false
+	}
+	if o.IfNoneMatch != "" && ConditionMatches(o.IfNoneMatch, Meta) {
+		return false
+	}
+	return true
+}
+
+// Gets the version the record would be written with going by the record alone. The DB core also makes sure it is higher than any version the table has had (see version_clock.go).
+func (o *WriteOptions) NextVersion(Meta *RecordMeta) uint64 {
+	if o.Version != 0 {
+		return o.Version
+	}
+	if Meta == nil {
+		return 1
+	}
+	return Meta.Version + 1
+}
@@ -0,0 +1,653 @@
+// This is the log-structured segment storage engine. It follows the Bitcask design:
+//   - Each table has a folder of append-only segment files. Records are only ever appended to the newest (active) segment. Deletes append a tombstone.
+//   - A in-memory key directory maps every key to where its newest value is, so a read is one seek.
+//   - When a segment is closed, a hint file is written next to it which holds just the keys and where they are. On boot, hint files are loaded instead of scanning the whole segment.
+//   - Compaction runs in the background and rewrites the closed segments without the values which have been overwritten or deleted.
+// The structure and index files are still handled by the filesystem engine.
+// A batch of changes is written to a batch file through the write-ahead log before it is appended to the segments. If the process dies half way through, the batch file is applied again on boot.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The size a segment can grow to before a new one is started.
+	SegmentMaxSize = 64000000
+
+	// The size of the header on each entry in a segment (crc32, flags, key size, value size).
+	SegmentHeaderSize = 13
+
+	// The size of each entry in a hint file (flags, key size, value size, offset) without the key.
+	SegmentHintHeaderSize = 17
+
+	// Compaction will not run on a table with less than this many dead bytes.
+	SegmentCompactionMinimum = 4000000
+
+	// How often the tables are checked to see if they need compacting.
+	SegmentCompactionInterval = time.Minute
+)
+
+// The flag set on a entry which is a tombstone.
+const SegmentTombstone = 1
+
+// Defines where the newest value of a key is.
+type KeydirEntry struct {
+	Segment   uint64
+	Offset    int64
+	KeySize   uint32
+	ValueSize uint32
+}
+
+// Gets the size of the entry on disk.
+func (k *KeydirEntry) Size() int64 {
+	return SegmentHeaderSize + int64(k.KeySize) + int64(k.ValueSize)
+}
+
+// Defines a table in the segment engine.
+type SegmentTable struct {
+	Dir        string
+	Lock       *sync.RWMutex
+	Keydir     map[string]*KeydirEntry
+	Segments   map[uint64]*os.File
+	Active     uint64
+	ActiveSize int64
+	NextID     uint64
+	TotalBytes int64
+	DeadBytes  int64
+	Compacting bool
+	Closed     bool
+}
+
+// Defines the segment storage engine.
+type SegmentEngine struct {
+	*FilesystemEngine
+	TablesLock *sync.Mutex
+	Tables     map[string]*SegmentTable
+	BatchLock  *sync.Mutex
+}
+
+// Creates the segment storage engine inside the base folder.
+func NewSegmentEngine(Base string) *SegmentEngine {
+	s := &SegmentEngine{
+		FilesystemEngine: NewFilesystemEngine(Base),
+		TablesLock:       &sync.Mutex{},
+		Tables:           map[string]*SegmentTable{},
+		BatchLock:        &sync.Mutex{},
+	}
+
+	// Finishes off a batch which was being applied when the process died.
+	Batch := ReadFileIfExists(path.Join(Base, "segment_batch"))
+	if Batch != nil {
+		var Changes []*RecordChange
+		err := json.Unmarshal(Batch, &Changes)
+		if err != nil {
+			panic(err)
+		}
+		s.ApplyChanges(Changes)
+		s.WAL.Remove(path.Join(Base, "segment_batch"))
+	}
+
+	go s.CompactionLoop()
+	return s
+}
+
+// Gets the path to a segment file.
+func SegmentPath(Dir string, ID uint64, Ext string) string {
+	return path.Join(Dir, fmt.Sprintf("%09d", ID)+Ext)
+}
+
+// Encodes a entry for a segment.
+func EncodeSegmentEntry(Key string, Value []byte, Tombstone bool) []byte {
+	b := make([]byte, SegmentHeaderSize+len(Key)+len(Value))
+	if Tombstone {
+		b[4] = SegmentTombstone
+	}
+	binary.LittleEndian.PutUint32(b[5:9], uint32(len(Key)))
+	binary.LittleEndian.PutUint32(b[9:13], uint32(len(Value)))
+	copy(b[SegmentHeaderSize:], Key)
+	copy(b[SegmentHeaderSize+len(Key):], Value)
+	binary.LittleEndian.PutUint32(b[:4], crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// Reads all the valid entries in a segment, calling the function given for each of them. The segment ID on the entries is left for the caller to fill in. Returns the length of the valid part of the segment.
+func ScanSegment(f *os.File, Handler func(Key string, Entry *KeydirEntry, Tombstone bool)) (int64, error) {
+	Info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, 0, Info.Size()))
+	var Offset int64
+	for {
+		Header := make([]byte, SegmentHeaderSize)
+		_, err := io.ReadFull(r, Header)
+		if err != nil {
+			break
+		}
+		KeySize := binary.LittleEndian.Uint32(Header[5:9])
+		ValueSize := binary.LittleEndian.Uint32(Header[9:13])
+		if int64(KeySize)+int64(ValueSize) > Info.Size()-Offset {
+			// This can only be a torn write.
+			break
+		}
+		Body := make([]byte, int(KeySize)+int(ValueSize))
+		_, err = io.ReadFull(r, Body)
+		if err != nil {
+			break
+		}
+		Checksum := crc32.NewIEEE()
+		_, _ = Checksum.Write(Header[4:])
+		_, _ = Checksum.Write(Body)
+		if Checksum.Sum32() != binary.LittleEndian.Uint32(Header[:4]) {
+			break
+		}
+		Entry := &KeydirEntry{Offset: Offset, KeySize: KeySize, ValueSize: ValueSize}
+		Handler(string(Body[:KeySize]), Entry, Header[4]&SegmentTombstone != 0)
+		Offset += Entry.Size()
+	}
+	return Offset, nil
+}
+
+// Writes the hint file for a segment.
+func WriteSegmentHint(Dir string, ID uint64, f *os.File) error {
+	var Hint []byte
+	_, err := ScanSegment(f, func(Key string, Entry *KeydirEntry, Tombstone bool) {
+		b := make([]byte, SegmentHintHeaderSize+len(Key))
+		if Tombstone {
+			b[0] = SegmentTombstone
+		}
+		binary.LittleEndian.PutUint32(b[1:5], Entry.KeySize)
+		binary.LittleEndian.PutUint32(b[5:9], Entry.ValueSize)
+		binary.LittleEndian.PutUint64(b[9:17], uint64(Entry.Offset))
+		copy(b[SegmentHintHeaderSize:], Key)
+		Hint = append(Hint, b...)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Written atomically so a half written hint file can never be loaded.
+	return AtomicWriteFile(SegmentPath(Dir, ID, ".hint"), Hint, DurabilityFlushes())
+}
+
+// Loads a hint file, calling the function given for each entry. Returns false if the hint file doesn't exist.
+func LoadSegmentHint(Dir string, ID uint64, Handler func(Key string, Entry *KeydirEntry, Tombstone bool)) bool {
+	Hint, err := ioutil.ReadFile(SegmentPath(Dir, ID, ".hint"))
+	if err != nil {
+		return false
+	}
+	for len(Hint) >= SegmentHintHeaderSize {
+		KeySize := binary.LittleEndian.Uint32(Hint[1:5])
+		Entry := &KeydirEntry{
+			Segment:   ID,
+			Offset:    int64(binary.LittleEndian.Uint64(Hint[9:17])),
+			KeySize:   KeySize,
+			ValueSize: binary.LittleEndian.Uint32(Hint[5:9]),
+		}
+		Key := string(Hint[SegmentHintHeaderSize : SegmentHintHeaderSize+int(KeySize)])
+		Handler(Key, Entry, Hint[0]&SegmentTombstone != 0)
+		Hint = Hint[SegmentHintHeaderSize+int(KeySize):]
+	}
+	return true
+}
+
+// Opens the segments in a folder and builds the key directory.
+func OpenSegmentTable(Dir string) *SegmentTable {
+	err := os.MkdirAll(Dir, 0777)
+	if err != nil {
+		panic(err)
+	}
+	t := &SegmentTable{
+		Dir:      Dir,
+		Lock:     &sync.RWMutex{},
+		Keydir:   map[string]*KeydirEntry{},
+		Segments: map[uint64]*os.File{},
+		NextID:   1,
+	}
+
+	// Gets all the segment IDs in order.
+	files, err := ioutil.ReadDir(Dir)
+	if err != nil {
+		panic(err)
+	}
+	IDs := make([]uint64, 0)
+	for _, v := range files {
+		if strings.HasSuffix(v.Name(), ".data") {
+			ID, err := strconv.ParseUint(strings.TrimSuffix(v.Name(), ".data"), 10, 64)
+			if err == nil {
+				IDs = append(IDs, ID)
+			}
+		}
+	}
+	sort.Slice(IDs, func(a, b int) bool { return IDs[a] < IDs[b] })
+
+	// Loads each segment in order so newer entries replace older ones.
+	for i, ID := range IDs {
+		f, err := os.OpenFile(SegmentPath(Dir, ID, ".data"), os.O_RDWR, 0666)
+		if err != nil {
+			panic(err)
+		}
+		t.Segments[ID] = f
+		Handler := func(Key string, Entry *KeydirEntry, Tombstone bool) {
+			Entry.Segment = ID
+			t.ApplyNonThreadSafe(Key, Entry, Tombstone)
+		}
+		Last := i == len(IDs)-1
+		if Last || !LoadSegmentHint(Dir, ID, Handler) {
+			Length, err := ScanSegment(f, Handler)
+			if err != nil {
+				panic(err)
+			}
+			if Last {
+				// Cuts off anything which was torn when we crashed.
+				err = f.Truncate(Length)
+				if err != nil {
+					panic(err)
+				}
+				t.ActiveSize = Length
+			}
+		}
+		t.NextID = ID + 1
+	}
+
+	// Opens the active segment.
+	if len(IDs) == 0 {
+		t.OpenActiveNonThreadSafe()
+	} else {
+		t.Active = IDs[len(IDs)-1]
+	}
+	return t
+}
+
+// Applies a entry to the key directory and keeps track of how many bytes are dead. The lock should be held when this is called.
+func (t *SegmentTable) ApplyNonThreadSafe(Key string, Entry *KeydirEntry, Tombstone bool) {
+	Old := t.Keydir[Key]
+	if Old != nil {
+		t.DeadBytes += Old.Size()
+	}
+	t.TotalBytes += Entry.Size()
+	if Tombstone {
+		delete(t.Keydir, Key)
+		t.DeadBytes += Entry.Size()
+	} else {
+		t.Keydir[Key] = Entry
+	}
+}
+
+// Starts a new active segment with the next ID. The lock should be held when this is called.
+func (t *SegmentTable) OpenActiveNonThreadSafe() {
+	ID := t.NextID
+	t.NextID++
+	f, err := os.OpenFile(SegmentPath(t.Dir, ID, ".data"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		panic(err)
+	}
+	t.Segments[ID] = f
+	t.Active = ID
+	t.ActiveSize = 0
+}
+
+// Closes the active segment, writes its hint file and starts a new one. The lock should be held when this is called.
+func (t *SegmentTable) RolloverNonThreadSafe() {
+	err := WriteSegmentHint(t.Dir, t.Active, t.Segments[t.Active])
+	if err != nil {
+		panic(err)
+	}
+	t.OpenActiveNonThreadSafe()
+}
+
+// Appends a entry to the active segment and updates the key directory. The lock should be held when this is called.
+func (t *SegmentTable) AppendNonThreadSafe(Key string, Value []byte, Tombstone bool) {
+	if t.ActiveSize >= SegmentMaxSize {
+		t.RolloverNonThreadSafe()
+	}
+	b := EncodeSegmentEntry(Key, Value, Tombstone)
+	f := t.Segments[t.Active]
+	_, err := f.WriteAt(b, t.ActiveSize)
+	if err != nil {
+		panic(err)
+	}
+	SyncFile(f)
+	Entry := &KeydirEntry{Segment: t.Active, Offset: t.ActiveSize, KeySize: uint32(len(Key)), ValueSize: uint32(len(Value))}
+	t.ActiveSize += int64(len(b))
+	t.ApplyNonThreadSafe(Key, Entry, Tombstone)
+}
+
+// Reads the value of a entry. The lock should be held when this is called.
+func (t *SegmentTable) ReadNonThreadSafe(Entry *KeydirEntry) ([]byte, error) {
+	Value := make([]byte, Entry.ValueSize)
+	_, err := t.Segments[Entry.Segment].ReadAt(Value, Entry.Offset+SegmentHeaderSize+int64(Entry.KeySize))
+	return Value, err
+}
+
+// Closes all the files in the table.
+func (t *SegmentTable) Close() {
+	t.Lock.Lock()
+	for _, f := range t.Segments {
+		_ = f.Close()
+	}
+	t.Segments = map[uint64]*os.File{}
+	t.Closed = true
+	t.Lock.Unlock()
+}
+
+// Gets the folder the segments for a table are kept in.
+func (s *SegmentEngine) SegmentDir(DatabaseName string, TableName string) string {
+	return path.Join(s.TablePath(DatabaseName, TableName), "s")
+}
+
+// Gets a table, opening it if this is the first time it has been used.
+func (s *SegmentEngine) Table(DatabaseName string, TableName string) *SegmentTable {
+	Dir := s.SegmentDir(DatabaseName, TableName)
+	s.TablesLock.Lock()
+	t := s.Tables[Dir]
+	if t == nil {
+		t = OpenSegmentTable(Dir)
+		s.Tables[Dir] = t
+	}
+	s.TablesLock.Unlock()
+	return t
+}
+
+// Closes and forgets all the open tables with the prefix given.
+func (s *SegmentEngine) CloseTables(Prefix string) {
+	s.TablesLock.Lock()
+	for k, t := range s.Tables {
+		if strings.HasPrefix(k, Prefix+"/") {
+			t.Close()
+			delete(s.Tables, k)
+		}
+	}
+	s.TablesLock.Unlock()
+}
+
+// Creates the folders for a table.
+func (s *SegmentEngine) CreateTable(DatabaseName string, TableName string) {
+	TableDir := s.TablePath(DatabaseName, TableName)
+	s.WAL.Commit([]*WALEntry{
+		{Op: WALMkdir, Path: s.WAL.Relative(path.Join(TableDir, "s"))},
+		{Op: WALMkdir, Path: s.WAL.Relative(path.Join(TableDir, "i"))},
+	})
+}
+
+// Deletes a table.
+func (s *SegmentEngine) DeleteTable(DatabaseName string, TableName string) {
+	s.CloseTables(s.TablePath(DatabaseName, TableName))
+	s.FilesystemEngine.DeleteTable(DatabaseName, TableName)
+}
+
+// Deletes a database.
+func (s *SegmentEngine) DeleteDatabase(DatabaseName string) {
+	s.CloseTables(path.Join(s.Base, "dbs", B64FSEncode(DatabaseName)))
+	s.FilesystemEngine.DeleteDatabase(DatabaseName)
+}
+
+// Reads a record from the table's segments.
+func (s *SegmentEngine) ReadRecord(DatabaseName string, TableName string, Key string) []byte {
+	t := s.Table(DatabaseName, TableName)
+	t.Lock.RLock()
+	defer t.Lock.RUnlock()
+	Entry := t.Keydir[Key]
+	if Entry == nil {
+		return nil
+	}
+	Value, err := t.ReadNonThreadSafe(Entry)
+	if err != nil {
+		panic(err)
+	}
+	return Value
+}
+
+// Appends a record to the table's active segment.
+func (s *SegmentEngine) WriteRecord(DatabaseName string, TableName string, Key string, Data []byte) {
+	t := s.Table(DatabaseName, TableName)
+	t.Lock.Lock()
+	t.AppendNonThreadSafe(Key, Data, false)
+	t.Lock.Unlock()
+}
+
+// Appends a tombstone for a record to the table's active segment.
+func (s *SegmentEngine) DeleteRecord(DatabaseName string, TableName string, Key string) {
+	t := s.Table(DatabaseName, TableName)
+	t.Lock.Lock()
+	if t.Keydir[Key] != nil {
+		t.AppendNonThreadSafe(Key, nil, true)
+	}
+	t.Lock.Unlock()
+}
+
+// Appends a batch of changes to the segments. Appending a change more than once is harmless since only the newest value of a key is used.
+func (s *SegmentEngine) ApplyChanges(Changes []*RecordChange) {
+	for _, v := range Changes {
+		if v.Data == nil {
+			s.DeleteRecord(v.DB, v.Table, v.Key)
+		} else {
+			s.WriteRecord(v.DB, v.Table, v.Key, v.Data)
+		}
+	}
+}
+
+// Applies a batch of changes. The batch is saved to the batch file first so it can be finished off if the process dies.
+func (s *SegmentEngine) ApplyBatch(Changes []*RecordChange) {
+	b, err := json.Marshal(Changes)
+	if err != nil {
+		panic(err)
+	}
+	s.BatchLock.Lock()
+	s.WAL.WriteFile(path.Join(s.Base, "segment_batch"), b)
+	s.ApplyChanges(Changes)
+	s.WAL.Remove(path.Join(s.Base, "segment_batch"))
+	s.BatchLock.Unlock()
+}
+
+// Gets all the keys in the table's key directory.
+func (s *SegmentEngine) RecordKeys(DatabaseName string, TableName string) []string {
+	t := s.Table(DatabaseName, TableName)
+	t.Lock.RLock()
+	Keys := make([]string, 0, len(t.Keydir))
+	for k := range t.Keydir {
+		Keys = append(Keys, k)
+	}
+	t.Lock.RUnlock()
+	return Keys
+}
+
+// Checks all the open tables every so often and compacts the ones which need it.
+func (s *SegmentEngine) CompactionLoop() {
+	for {
+		time.Sleep(SegmentCompactionInterval)
+		s.TablesLock.Lock()
+		Tables := make([]*SegmentTable, 0, len(s.Tables))
+		for _, t := range s.Tables {
+			Tables = append(Tables, t)
+		}
+		s.TablesLock.Unlock()
+		for _, t := range Tables {
+			t.Compact()
+		}
+	}
+}
+
+// Defines a value which was moved during compaction.
+type SegmentMove struct {
+	Key string
+	Old *KeydirEntry
+	New *KeydirEntry
+}
+
+// Compacts the table if over half of it is dead. All the segments are rewritten into new segments with just the live values in them.
+func (t *SegmentTable) Compact() {
+	// Checks if compaction is needed and reserves the IDs for it.
+	t.Lock.Lock()
+	if t.Closed || t.Compacting || t.DeadBytes < SegmentCompactionMinimum || t.DeadBytes*2 < t.TotalBytes {
+		t.Lock.Unlock()
+		return
+	}
+	t.Compacting = true
+	Inputs := make([]uint64, 0, len(t.Segments))
+	for ID := range t.Segments {
+		Inputs = append(Inputs, ID)
+	}
+	sort.Slice(Inputs, func(a, b int) bool { return Inputs[a] < Inputs[b] })
+
+	// The merged segments have to sort after all of the inputs but before the new active segment so they are loaded in the right order on boot.
+	NextOutput := t.NextID
+	LastOutput := t.NextID + uint64(len(Inputs)) - 1
+	t.NextID = LastOutput + 1
+	t.RolloverNonThreadSafe()
+	t.Lock.Unlock()
+
+	// Copies the live values into the new segments. The table isn't locked for this, so writes can carry on.
+	Moves := make([]*SegmentMove, 0)
+	Outputs := make(map[uint64]*os.File)
+	var Output *os.File
+	var OutputSize int64
+	var Failed error
+	for _, ID := range Inputs {
+		t.Lock.RLock()
+		f := t.Segments[ID]
+		t.Lock.RUnlock()
+		if f == nil {
+			continue
+		}
+		_, err := ScanSegment(f, func(Key string, Entry *KeydirEntry, Tombstone bool) {
+			if Failed != nil || Tombstone {
+				// Tombstones can be dropped since every older segment is being merged too.
+				return
+			}
+			Entry.Segment = ID
+
+			// Checks the value is still live and reads it.
+			t.Lock.RLock()
+			Current := t.Keydir[Key]
+			if Current == nil || *Current != *Entry {
+				t.Lock.RUnlock()
+				return
+			}
+			Value, err := t.ReadNonThreadSafe(Entry)
+			t.Lock.RUnlock()
+			if err != nil {
+				Failed = err
+				return
+			}
+
+			// Starts a new output segment if needed.
+			if Output == nil || (OutputSize >= SegmentMaxSize && NextOutput <= LastOutput) {
+				Output, err = os.OpenFile(SegmentPath(t.Dir, NextOutput, ".data"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+				if err != nil {
+					Failed = err
+					return
+				}
+				Outputs[NextOutput] = Output
+				NextOutput++
+				OutputSize = 0
+			}
+
+			// Writes the value.
+			b := EncodeSegmentEntry(Key, Value, false)
+			_, err = Output.WriteAt(b, OutputSize)
+			if err != nil {
+				Failed = err
+				return
+			}
+			Moves = append(Moves, &SegmentMove{
+				Key: Key,
+				Old: Entry,
+				New: &KeydirEntry{Segment: NextOutput - 1, Offset: OutputSize, KeySize: Entry.KeySize, ValueSize: Entry.ValueSize},
+			})
+			OutputSize += int64(len(b))
+		})
+		if err != nil && Failed == nil {
+			Failed = err
+		}
+	}
+
+	// Flushes the new segments and writes their hint files.
+	for ID, f := range Outputs {
+		if Failed != nil {
+			break
+		}
+		if DurabilityFlushes() {
+			Failed = f.Sync()
+		}
+		if Failed == nil {
+			Failed = WriteSegmentHint(t.Dir, ID, f)
+		}
+	}
+	if Failed != nil {
+		// Throws away the new segments. The old ones are all still there so nothing is lost.
+		println("[" + t.Dir + "] Compaction failed: " + Failed.Error())
+		for ID, f := range Outputs {
+			_ = f.Close()
+			_ = os.Remove(SegmentPath(t.Dir, ID, ".data"))
+			_ = os.Remove(SegmentPath(t.Dir, ID, ".hint"))
+		}
+		t.Lock.Lock()
+		t.Compacting = false
+		t.Lock.Unlock()
+		return
+	}
+
+	// Swaps the key directory over to the new segments and removes the old ones.
+	t.Lock.Lock()
+	if t.Closed {
+		// The table was deleted while we were compacting.
+		for _, f := range Outputs {
+			_ = f.Close()
+		}
+		t.Lock.Unlock()
+		return
+	}
+	for ID, f := range Outputs {
+		t.Segments[ID] = f
+	}
+	for _, v := range Moves {
+		Current := t.Keydir[v.Key]
+		if Current != nil && *Current == *v.Old {
+			t.Keydir[v.Key] = v.New
+		}
+	}
+	for _, ID := range Inputs {
+		f := t.Segments[ID]
+		if f != nil {
+			_ = f.Close()
+		}
+		delete(t.Segments, ID)
+		_ = os.Remove(SegmentPath(t.Dir, ID, ".data"))
+		_ = os.Remove(SegmentPath(t.Dir, ID, ".hint"))
+	}
+
+	// Works out how much of the table is dead now.
+	t.TotalBytes = t.ActiveSize
+	for ID, f := range t.Segments {
+		if ID == t.Active {
+			continue
+		}
+		Info, err := f.Stat()
+		if err == nil {
+			t.TotalBytes += Info.Size()
+		}
+	}
+	var LiveBytes int64
+	for _, v := range t.Keydir {
+		LiveBytes += v.Size()
+	}
+	t.DeadBytes = t.TotalBytes - LiveBytes
+	t.Compacting = false
+	t.Lock.Unlock()
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -172,6 +175,10 @@ func JoinCluster() {
 		panic(err)
 	}
 	for _, v := range Databases {
+		if v.Name == "__internal" {
+			// Each shard has its own internal database.
+			continue
+		}
 		err := Core.CreateDatabase(v.Name)
 		if err != nil {
 			panic(err)
@@ -182,7 +189,7 @@ func JoinCluster() {
 				panic(err)
 			}
 			for _, i := range t.Indexes {
-				err = Core.CreateIndex(v.Name, t.Name, i.Name, i.Keys)
+				err = Core.CreateIndex(v.Name, t.Name, i.Name, i.Keys, i.Options())
 				if err != nil {
 					panic(err)
 				}
@@ -243,11 +250,7 @@ func JoinCluster() {
 // Marks a shard as ready.
 func MarkShardAsReady(ShardID string) {
 	ShardInstance.ActiveShards = append(ShardInstance.ActiveShards, ShardID)
-	err := Core.DeleteRecord("__internal", "sharding", "config")
-	if err != nil {
-		panic(err)
-	}
-	err = Core.Insert("__internal", "sharding", "config", ToInterfacePtr(ShardInstance))
+	err := Core.Upsert("__internal", "sharding", "config", ToInterfacePtr(ShardInstance))
 	if err != nil {
 		panic(err)
 	}
@@ -255,20 +258,29 @@ func MarkShardAsReady(ShardID string) {
 
 // The remote insert structure.
 type RemoteInsertStructure struct {
+	WriteOptions
 	DB string `json:"db"`
 	Table string `json:"table"`
 	Key string `json:"key"`
 	Item interface{} `json:"item"`
 }
 
-// Inserts into a remote shard.
-func InsertRemoteShardReshard(DatabaseName string, TableName string, ShardID string, Item interface{}, Key string) {
+// The response from a remote shard after a write.
+type RemoteWriteResponse struct {
+	Err *string `json:"error"`
+	Meta *RecordMeta `json:"meta"`
+	Item *interface{} `json:"item,omitempty"`
+}
+
+// Inserts into a remote shard, keeping the metadata the record has on this shard.
+func InsertRemoteShardReshard(DatabaseName string, TableName string, ShardID string, Item interface{}, Key string, Meta *RecordMeta) {
 	u, err := url.Parse(ShardInstance.ShardURLS[ShardID])
 	if err != nil {
 		panic(err)
 	}
 	u.Path = "/_shard/insert"
 	I := RemoteInsertStructure{
+		WriteOptions: WriteOptions{Mode: WriteUpsert, Version: Meta.Version, Expires: Meta.Expires},
 		DB: DatabaseName,
 		Table: TableName,
 		Key: Key,
@@ -333,11 +345,11 @@ func Reshard() {
 				}
 				if !ContainsMe {
 					for _, v := range shards {
-						i, err := ShardInstance.Get(d, t.Name, k)
+						i, Meta, err := ShardInstance.GetWithMeta(d, t.Name, k)
 						if err != nil {
 							panic(err)
 						}
-						InsertRemoteShardReshard(d, t.Name, v, i, k)
+						InsertRemoteShardReshard(d, t.Name, v, i, k, Meta)
 					}
 				}
 			}
@@ -355,11 +367,7 @@ func InsertShard(ShardID string, ShardURL string) {
 	u.Path = "/"
 	ShardInstance.Shards = append(ShardInstance.Shards, ShardID)
 	ShardInstance.ShardURLS[ShardID] = ShardURL
-	err = Core.DeleteRecord("__internal", "sharding", "config")
-	if err != nil {
-		panic(err)
-	}
-	err = Core.Insert("__internal", "sharding", "config", ToInterfacePtr(ShardInstance))
+	err = Core.Upsert("__internal", "sharding", "config", ToInterfacePtr(ShardInstance))
 	if err != nil {
 		panic(err)
 	}
@@ -396,6 +404,27 @@ func ShardInit() {
 		}
 	}
 
+	if Core.Table("__internal", UniqueClaimsTable) == nil {
+		err := Core.CreateTable("__internal", UniqueClaimsTable)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if Core.Table("__internal", TransactionsTable) == nil {
+		err := Core.CreateTable("__internal", TransactionsTable)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if Core.Table("__internal", PreparedTransactionsTable) == nil {
+		err := Core.CreateTable("__internal", PreparedTransactionsTable)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	r, err := Core.Get("__internal", "sharding", "config")
 	if err != nil {
 		panic(err)
@@ -417,6 +446,9 @@ func ShardInit() {
 	for _, v := range ShardInstance.ShardURLS {
 		go ExecuteShardHeartbeat(v)
 	}
+
+	// Locks the tables of the transactions which were prepared before this shard restarted.
+	Core.RecoverPreparedTransactions()
 }
 
 // Executes a shard heartbeat.
@@ -432,72 +464,77 @@ func ExecuteShardHeartbeat(URL string) {
 	go ExecuteShardHeartbeat(URL)
 }
 
+// The remote get structure. Fields is the projection to apply before the item is sent back.
+type RemoteGetStructure struct {
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Key string `json:"key"`
+	Fields []string `json:"fields,omitempty"`
+}
+
 // Defines the response from a remote shard.
 type RemoteShardGetResponse struct {
 	Err  *string      `json:"error"`
 	Data *interface{} `json:"data"`
+	Meta *RecordMeta  `json:"meta"`
 }
 
 // Gets a item from a table.
 func (s *Shard) Get(DatabaseName string, TableName string, Item string) (*interface{}, error) {
+	item, _, err := s.GetWithMeta(DatabaseName, TableName, Item)
+	return item, err
+}
+
+// Gets a item from a table along with its metadata.
+func (s *Shard) GetWithMeta(DatabaseName string, TableName string, Item string) (*interface{}, *RecordMeta, error) {
+	return s.GetFields(DatabaseName, TableName, Item, nil)
+}
+
+// Gets some of the fields of a item from a table along with its metadata (see projection.go). The fields are picked by the shard holding the item.
+func (s *Shard) GetFields(DatabaseName string, TableName string, Item string, Fields []string) (*interface{}, *RecordMeta, error) {
+	Parsed, err := ParseProjection(Fields)
+	if err != nil {
+		return nil, nil, err
+	}
 	Replicas := GetReplicas(DatabaseName, TableName)
 	Shards := HandleShardCalculation(Item, s.Shards, Replicas)
 	for _, v := range Shards {
 		if s.ShardURLS[v] == "" {
 			// Me!
-			return Core.Get(DatabaseName, TableName, Item)
+			Data, Meta, err := Core.GetWithMeta(DatabaseName, TableName, Item)
+			return Parsed.Apply(Data), Meta, err
 		}
 	}
-	var RemoteShard string
+
+	// Picks the shard holding the item with the lowest latency. The heartbeats are kept by the URL of each shard.
+	var RemoteURL string
 	var Ping *int
+	UptimeMutex.RLock()
 	for _, v := range Shards {
-		UptimeMutex.RLock()
-		if Ping == nil || (UptimeMap[v] != nil && *Ping > *UptimeMap[v]) {
-			RemoteShard = v
+		URL := s.ShardURLS[v]
+		if UptimeMap[URL] != nil && (Ping == nil || *UptimeMap[URL] < *Ping) {
+			RemoteURL = URL
+			Ping = UptimeMap[URL]
 		}
-		UptimeMutex.RUnlock()
 	}
+	UptimeMutex.RUnlock()
 
 	if Ping == nil {
-		return nil, errors.New("All shards holding data are down!")
+		return nil, nil, errors.New("All shards holding data are down!")
 	}
 
 	// This is specifically for a remote shard. Let the remote shard respond.
-	u, err := url.Parse(RemoteShard)
-	if err != nil {
-		panic(err)
-	}
-	u.Path = "/_shard/get/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName) + "/d" + url.QueryEscape(Item)
-	client, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		panic(err)
-	}
-	client.Header.Set("Inner-Cluster-Token", InnerClusterToken)
-	req, err := HTTPClient.Do(client)
-	if err != nil {
-		panic(err)
-	}
-	if req.StatusCode != 200 {
-		panic("The other shard responded with a status " + string(req.StatusCode))
-	}
 	var Response RemoteShardGetResponse
-	var Data []byte
-	_, err = req.Body.Read(Data)
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(Data, &Response)
-	if err != nil {
-		panic(err)
-	}
+	PostToShard(RemoteURL, "/_shard/get", &RemoteGetStructure{
+		DB: DatabaseName,
+		Table: TableName,
+		Key: Item,
+		Fields: Fields,
+	}, &Response)
 	if Response.Err != nil {
-		return nil, errors.New(*Response.Err)
+		return nil, nil, errors.New(*Response.Err)
 	}
-	err = req.Body.Close()
-	if err != nil {
-		panic(err)
-	}
-	return Response.Data, nil
+	return Response.Data, Response.Meta, nil
 }
 
 // Gets the DB structure if it exists. We can get this from the local instance.
@@ -506,8 +543,30 @@ func (s *Shard) Database(DatabaseName string) *DBStructure {
 }
 
 // Gets the table structure if it exists. We can get this from the local instance.
-func (s *Shard) Table(DatabaseName string, TableName string) *Table {
-	return Core.Table(DatabaseName, TableName)
+func (s *Shard) Table(DatabaseName string, TableName string) (*Table, error) {
+	Table := Core.Table(DatabaseName, TableName)
+	if Table == nil {
+		return nil, nil
+	}
+
+	// Swaps the progress of each index build on this shard for the progress across every shard.
+	Builds, err := s.IndexBuilds(DatabaseName, TableName)
+	if err != nil {
+		return nil, err
+	}
+	Indexes := make([]*Index, len(Table.Indexes))
+	Core.ArrayLock.RLock()
+	for i, v := range Table.Indexes {
+		Clone := *v
+		Clone.Build = nil
+		if Progress := Builds[v.Name]; Progress != nil {
+			Clone.Build = &IndexBuild{Lock: &sync.Mutex{}, Done: Progress.Done, Total: Progress.Total, Failure: Progress.Error}
+		}
+		Indexes[i] = &Clone
+	}
+	Core.ArrayLock.RUnlock()
+	Table.Indexes = Indexes
+	return Table, nil
 }
 
 // Creates a database on all shards.
@@ -546,7 +605,7 @@ func (s *Shard) CreateDatabase(DatabaseName string) error {
 }
 
 // Creates a index on all shards.
-func (s *Shard) CreateIndex(DatabaseName string, TableName string, IndexName string, Keys []string) error  {
+func (s *Shard) CreateIndex(DatabaseName string, TableName string, IndexName string, Keys []string, Options *IndexOptions) error  {
 	UptimeMutex.RLock()
 	for _, v := range UptimeMap {
 		if v == nil {
@@ -554,10 +613,14 @@ func (s *Shard) CreateIndex(DatabaseName string, TableName string, IndexName str
 		}
 	}
 	UptimeMutex.RUnlock()
-	err := Core.CreateIndex(DatabaseName, TableName, IndexName, Keys)
+	err := Core.CreateIndex(DatabaseName, TableName, IndexName, Keys, Options)
 	if err != nil {
 		return err
 	}
+	OptionsJSON, err := json.Marshal(Options)
+	if err != nil {
+		panic(err)
+	}
 	for _, v := range s.ShardURLS {
 		u, err := url.Parse(v)
 		if err != nil {
@@ -567,7 +630,9 @@ func (s *Shard) CreateIndex(DatabaseName string, TableName string, IndexName str
 		if err != nil {
 			panic(err)
 		}
-		u.Path = "/_shard/new_index/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName) + "/" + url.QueryEscape(IndexName) + "/" + url.QueryEscape(string(b))
+		u.Path = "/_shard/new_index/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName) + "/" + url.QueryEscape(IndexName)
+		// The keys go in the query since paths in them can have slashes.
+		u.RawQuery = "keys=" + url.QueryEscape(string(b)) + "&options=" + url.QueryEscape(string(OptionsJSON))
 		client, err := http.NewRequest("GET", u.String(), nil)
 		if err != nil {
 			panic(err)
@@ -689,39 +754,60 @@ func (s *Shard) DeleteIndex(DatabaseName string, TableName string, IndexName str
 	return nil
 }
 
+// The remote delete structure.
+type RemoteDeleteStructure struct {
+	WriteOptions
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Key string `json:"key"`
+}
+
 // Deletes a record from all shards.
 func (s *Shard) DeleteRecord(DatabaseName string, TableName string, Item string) error {
+	return s.Delete(DatabaseName, TableName, Item, nil)
+}
+
+// Deletes a record from all shards holding it. The preconditions are checked on the first shard holding the record, the rest of the shards follow it. Options can be nil.
+func (s *Shard) Delete(DatabaseName string, TableName string, Item string, Options *WriteOptions) error {
 	UptimeMutex.RLock()
 	for _, v := range UptimeMap {
 		if v == nil {
+			UptimeMutex.RUnlock()
 			return errors.New("A shard is down. Please fix this before deleting a record.")
 		}
 	}
 	UptimeMutex.RUnlock()
-	_, err := s.Get(DatabaseName, TableName, Item)
-	if err != nil {
-		return err
-	}
-	for _, v := range s.ShardURLS {
-		u, err := url.Parse(v)
-		if err != nil {
-			panic(err)
+
+	Shards := HandleShardCalculation(Item, s.Shards, GetReplicas(DatabaseName, TableName))
+
+	for i, k := range Shards {
+		var ShardOptions *WriteOptions
+		if i == 0 {
+			ShardOptions = Options
 		}
-		u.Path = "/_shard/delete_record/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName) + "/" + url.QueryEscape(Item)
-		client, err := http.NewRequest("GET", u.String(), nil)
-		if err != nil {
-			panic(err)
+
+		if s.ShardURLS[k] == "" {
+			err := Core.Delete(DatabaseName, TableName, Item, ShardOptions)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		client.Header.Set("Inner-Cluster-Token", InnerClusterToken)
-		req, err := HTTPClient.Do(client)
-		if err != nil {
-			panic(err)
+
+		Body := &RemoteDeleteStructure{
+			DB: DatabaseName,
+			Table: TableName,
+			Key: Item,
 		}
-		if req.StatusCode != 204 {
-			panic("The other shard responded with a status " + string(req.StatusCode))
+		if ShardOptions != nil {
+			Body.WriteOptions = *ShardOptions
+		}
+		_, err := SendRemoteWrite(s.ShardURLS[k], "/_shard/delete", Body)
+		if err != nil {
+			return err
 		}
 	}
-	return Core.DeleteRecord(DatabaseName, TableName, Item)
+	return nil
 }
 
 // Deletes a table from all shards.
@@ -759,92 +845,295 @@ func (s *Shard) DeleteTable(DatabaseName string, TableName string) error {
 	return nil
 }
 
-// Gets all table keys.
-func (s *Shard) TableKeys(DatabaseName string, TableName string) (*[]string, error) {
+// Insert into all shards. *click, nice*
+func (s *Shard) Insert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := s.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteInsert})
+	return err
+}
+
+// Replaces a record on all shards.
+func (s *Shard) Replace(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := s.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteReplace})
+	return err
+}
+
+// Upserts a record on all shards.
+func (s *Shard) Upsert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	_, err := s.Write(DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteUpsert})
+	return err
+}
+
+// Writes to all shards holding the record with the options specified. The first shard holding the record checks the mode and preconditions and picks the version.
+// The rest of the shards are then written with that version and expiry so all the replicas agree. Returns the metadata the record was written with.
+func (s *Shard) Write(DatabaseName string, TableName string, Key string, Item *interface{}, Options *WriteOptions) (*RecordMeta, error) {
 	UptimeMutex.RLock()
 	for _, v := range UptimeMap {
 		if v == nil {
-			return nil, errors.New("A shard is down. Please fix this before getting table keys.")
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before writing.")
 		}
 	}
 	UptimeMutex.RUnlock()
-	keys, err := Core.TableKeys(DatabaseName, TableName)
+
+	// Works out when the record expires here so every replica gets the same time.
+	Resolved := *Options
+	if Table := Core.Table(DatabaseName, TableName); Table != nil {
+		Resolved.ResolveExpiry(Table.DefaultTTL)
+	}
+
+	// Claims the values of the unique indexes until the record is written.
+	Claims, err := s.ClaimUnique(DatabaseName, TableName, Key, Item)
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range s.ShardURLS {
-		u, err := url.Parse(v)
-		if err != nil {
-			panic(err)
+	defer s.ReleaseUnique(Claims)
+
+	Shards := HandleShardCalculation(Key, s.Shards, GetReplicas(DatabaseName, TableName))
+
+	var Meta *RecordMeta
+	for i, k := range Shards {
+		ShardOptions := &Resolved
+		if i != 0 {
+			ShardOptions = &WriteOptions{Mode: WriteUpsert, Version: Meta.Version, Expires: Meta.Expires}
 		}
-		u.Path = "/_shard/table_keys/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName)
-		client, err := http.NewRequest("GET", u.String(), nil)
+
+		m, err := s.WriteToShard(k, DatabaseName, TableName, Key, Item, ShardOptions)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		client.Header.Set("Inner-Cluster-Token", InnerClusterToken)
-		req, err := HTTPClient.Do(client)
+		if i == 0 {
+			Meta = m
+		}
+	}
+	return Meta, nil
+}
+
+// Writes a record to one shard. Returns the metadata the record was written with.
+func (s *Shard) WriteToShard(ShardID string, DatabaseName string, TableName string, Key string, Item *interface{}, Options *WriteOptions) (*RecordMeta, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.Write(DatabaseName, TableName, Key, Item, Options)
+	}
+
+	Response, err := SendRemoteWrite(s.ShardURLS[ShardID], "/_shard/insert", &RemoteInsertStructure{
+		WriteOptions: *Options,
+		DB: DatabaseName,
+		Table: TableName,
+		Key: Key,
+		Item: Item,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Response.Meta, nil
+}
+
+// Sends a JSON body to a remote shard and decodes the JSON response into Response.
+func PostToShard(ShardURL string, Path string, Body interface{}, Response interface{}) {
+	u, err := url.Parse(ShardURL)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = Path
+	b, err := json.Marshal(Body)
+	if err != nil {
+		panic(err)
+	}
+	client, err := http.NewRequest("POST", u.String(), bytes.NewReader(b))
+	if err != nil {
+		panic(err)
+	}
+	client.Header.Set("Inner-Cluster-Token", InnerClusterToken)
+	req, err := HTTPClient.Do(client)
+	if err != nil {
+		panic(err)
+	}
+	if req.StatusCode != 200 {
+		panic("The other shard responded with a status " + strconv.Itoa(req.StatusCode))
+	}
+	Data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(Data, Response)
+	if err != nil {
+		panic(err)
+	}
+	err = req.Body.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Turns a error from a remote shard back into a error. Errors which are checked for by value are given back as the same value.
+func RemoteError(Err *string) error {
+	if Err == nil {
+		return nil
+	}
+	if *Err == ErrPreconditionFailed.Error() {
+		return ErrPreconditionFailed
+	}
+	if Violation, ok := ParseUniqueViolation(*Err); ok {
+		return Violation
+	}
+	return errors.New(*Err)
+}
+
+// Sends a write to a remote shard. The remote shard responds with a RemoteWriteResponse.
+func SendRemoteWrite(ShardURL string, Path string, Body interface{}) (*RemoteWriteResponse, error) {
+	var Response RemoteWriteResponse
+	PostToShard(ShardURL, Path, Body, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return &Response, nil
+}
+
+// Builds the response to a write from a remote shard.
+func NewRemoteWriteResponse(Meta *RecordMeta, Item *interface{}, err error) *RemoteWriteResponse {
+	if err != nil {
+		e := err.Error()
+		return &RemoteWriteResponse{Err: &e}
+	}
+	return &RemoteWriteResponse{Meta: Meta, Item: Item}
+}
+
+// The remote patch structure.
+type RemotePatchStructure struct {
+	WriteOptions
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Key string `json:"key"`
+	Type string `json:"type"`
+	Patch interface{} `json:"patch"`
+}
+
+// Patches a record on all shards holding it. The first shard holding the record applies the patch under its table lock and the rest of the shards are given the result.
+// This means all the replicas end up with the same item, version and expiry. Options can be nil. Returns the new metadata.
+func (s *Shard) Patch(DatabaseName string, TableName string, Key string, PatchType string, Patch interface{}, Options *WriteOptions) (*RecordMeta, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before patching.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// A patch only changes when the record expires if a TTL is given, so the default TTL of the table isn't used.
+	Resolved := WriteOptions{Mode: WriteReplace}
+	if Options != nil {
+		Resolved = *Options
+	}
+	Resolved.ResolveExpiry(0)
+
+	// The new values of the unique indexes have to be claimed before the record is written.
+	if len(Core.UniqueIndexes(DatabaseName, TableName)) != 0 {
+		return s.PatchUnique(DatabaseName, TableName, Key, PatchType, Patch, &Resolved)
+	}
+	return s.PatchOnShards(DatabaseName, TableName, Key, PatchType, Patch, &Resolved)
+}
+
+// Patches a record in a table with unique indexes. The patch is applied here to work out the new values, which are claimed before the patch is sent to the shards.
+// The patch is sent with the version it was applied to, so it is only written if the record hasn't changed. If it has changed and the caller didn't give a precondition, the patch is tried again.
+func (s *Shard) PatchUnique(DatabaseName string, TableName string, Key string, PatchType string, Patch interface{}, Options *WriteOptions) (*RecordMeta, error) {
+	for Attempt := 1; ; Attempt++ {
+		// Gets the current version of the record.
+		Current, CurrentMeta, err := s.GetWithMeta(DatabaseName, TableName, Key)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		if req.StatusCode != 200 {
-			panic("The other shard responded with a status " + string(req.StatusCode))
+		if !Options.PreconditionsMet(CurrentMeta) {
+			return nil, ErrPreconditionFailed
 		}
-		var Data []byte
-		_, err = req.Body.Read(Data)
+
+		// Applies the patch and claims the new values.
+		New, err := ApplyPatch(*Current, PatchType, Patch)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		var StringArr []string
-		err = json.Unmarshal(Data, &StringArr)
+		Claims, err := s.ClaimUnique(DatabaseName, TableName, Key, &New)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		for _, v := range StringArr {
-			keys = append(keys, v)
+
+		// Patches the version the new values came from.
+		Pinned := *Options
+		Pinned.IfMatch = strconv.FormatUint(CurrentMeta.Version, 10)
+		Pinned.IfNoneMatch = ""
+		Meta, err := s.PatchOnShards(DatabaseName, TableName, Key, PatchType, Patch, &Pinned)
+		s.ReleaseUnique(Claims)
+		if err == ErrPreconditionFailed && Options.IfMatch == "" && Options.IfNoneMatch == "" && Attempt < UniquePatchAttempts {
+			continue
 		}
-		err = req.Body.Close()
+		return Meta, err
+	}
+}
+
+// Patches a record on the shards holding it. The first shard applies the patch and the rest are given the result.
+func (s *Shard) PatchOnShards(DatabaseName string, TableName string, Key string, PatchType string, Patch interface{}, Options *WriteOptions) (*RecordMeta, error) {
+	Resolved := *Options
+	Shards := HandleShardCalculation(Key, s.Shards, GetReplicas(DatabaseName, TableName))
+
+	// Patches the record on the first shard.
+	var Meta *RecordMeta
+	var Item *interface{}
+	if s.ShardURLS[Shards[0]] == "" {
+		m, i, err := Core.Patch(DatabaseName, TableName, Key, PatchType, Patch, &Resolved)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		Meta = m
+		Item = i
+	} else {
+		Response, err := SendRemoteWrite(s.ShardURLS[Shards[0]], "/_shard/patch", &RemotePatchStructure{
+			WriteOptions: Resolved,
+			DB: DatabaseName,
+			Table: TableName,
+			Key: Key,
+			Type: PatchType,
+			Patch: Patch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		Meta = Response.Meta
+		Item = Response.Item
+	}
+
+	// Writes the result to the rest of the shards.
+	for _, k := range Shards[1:] {
+		_, err := s.WriteToShard(k, DatabaseName, TableName, Key, Item, &WriteOptions{Mode: WriteUpsert, Version: Meta.Version, Expires: Meta.Expires})
+		if err != nil {
+			return nil, err
 		}
 	}
-	return &keys, nil
+	return Meta, nil
 }
 
-// Insert into all shards. *click, nice*
-func (s *Shard) Insert(DatabaseName string, TableName string, Key string, Item *interface{}) error {
+// Sets the default TTL of a table on all shards.
+func (s *Shard) SetTableTTL(DatabaseName string, TableName string, TTL int64) error {
 	UptimeMutex.RLock()
 	for _, v := range UptimeMap {
 		if v == nil {
-			return errors.New("A shard is down. Please fix this before inserting.")
+			UptimeMutex.RUnlock()
+			return errors.New("A shard is down. Please fix this before changing the TTL of a table.")
 		}
 	}
 	UptimeMutex.RUnlock()
-
-	Shards := HandleShardCalculation(Key, s.Shards, GetReplicas(DatabaseName, TableName))
-
-	for _, k := range Shards {
-		if s.ShardURLS[k] == "" {
-			err := Core.Insert(DatabaseName, TableName, Key, Item)
-			if err != nil {
-				return err
-			}
+	err := Core.SetTableTTL(DatabaseName, TableName, TTL)
+	if err != nil {
+		return err
+	}
+	for _, v := range s.ShardURLS {
+		if v == "" {
 			continue
 		}
-
-		u, err := url.Parse(s.ShardURLS[k])
+		u, err := url.Parse(v)
 		if err != nil {
 			panic(err)
 		}
-		u.Path = "/_shard/insert"
-		POSTBody := RemoteInsertStructure{
-			DB: DatabaseName,
-			Table: TableName,
-			Key: Key,
-			Item: Item,
-		}
-		b, err := json.Marshal(&POSTBody)
-		client, err := http.NewRequest("POST", u.String(), bytes.NewReader(b))
+		u.Path = "/_shard/table_ttl/" + url.QueryEscape(DatabaseName) + "/" + url.QueryEscape(TableName) + "/" + strconv.FormatInt(TTL, 10)
+		client, err := http.NewRequest("GET", u.String(), nil)
 		if err != nil {
 			panic(err)
 		}
@@ -853,26 +1142,551 @@ func (s *Shard) Insert(DatabaseName string, TableName string, Key string, Item *
 		if err != nil {
 			panic(err)
 		}
-		if req.StatusCode != 200 {
-			panic("The other shard responded with a status " + string(req.StatusCode))
+		if req.StatusCode != 204 {
+			panic("The other shard responded with a status " + strconv.Itoa(req.StatusCode))
 		}
-		var Data []byte
-		_, err = req.Body.Read(Data)
+	}
+	return nil
+}
+
+// The remote transaction structure. Only the ID (and the versions when committing) is used when committing or aborting.
+type RemoteTransactionStructure struct {
+	ID string `json:"id"`
+	DB string `json:"db"`
+	Operations []*TransactionOperation `json:"operations,omitempty"`
+	Versions []*TransactionVersion `json:"versions,omitempty"`
+}
+
+// The response from a remote shard after a transaction is prepared, committed or aborted.
+type RemoteTransactionResponse struct {
+	Err *string `json:"error"`
+	Results []*TransactionResult `json:"results,omitempty"`
+}
+
+// The table in the internal database which holds the decision made for each transaction.
+const TransactionsTable = "transactions"
+
+// How long the decision for a transaction is kept. A shard which is down for longer than this while holding a prepared transaction can't find out if it was committed.
+var TransactionDecisionTimeout = 7 * 24 * time.Hour
+
+// Defines the decisions which can be made for a transaction.
+const (
+	TransactionCommitted = "committed"
+	TransactionAborted   = "aborted"
+)
+
+// Defines the decision made for a transaction. Versions are the versions to commit the records with.
+type TransactionDecision struct {
+	State    string                `json:"state"`
+	Versions []*TransactionVersion `json:"versions,omitempty"`
+}
+
+// Records the decision for a transaction unless one has already been made. Returns the decision which stands.
+// The shard running the transaction decides to commit it once every shard has prepared, and a shard whose prepare times out decides to abort it, so only the first of them counts.
+func (s *Shard) DecideTransaction(ID string, Decision *TransactionDecision) (*TransactionDecision, error) {
+	_, err := s.Write("__internal", TransactionsTable, ID, ToInterfacePtr(Decision), &WriteOptions{
+		Mode:        WriteUpsert,
+		IfNoneMatch: "*",
+		Expires:     NowMillis() + int64(TransactionDecisionTimeout/time.Millisecond),
+	})
+	if err == nil {
+		return Decision, nil
+	}
+	if err != ErrPreconditionFailed {
+		return nil, err
+	}
+
+	// Gets the decision which was already made. Converting to JSON and back gets it out of the item.
+	Data, err := s.Get("__internal", TransactionsTable, ID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(Data)
+	if err != nil {
+		panic(err)
+	}
+	var Made TransactionDecision
+	err = json.Unmarshal(b, &Made)
+	if err != nil {
+		panic(err)
+	}
+	return &Made, nil
+}
+
+// Settles a transaction which was prepared on this shard but wasn't committed or aborted in time. It is committed if the shard running it decided to commit, and aborted otherwise.
+// If the decision can't be checked, the tables stay locked and it is checked again after another TransactionPrepareTimeout.
+func (s *Shard) SettleTransaction(ID string) {
+	Decision, err := s.DecideTransaction(ID, &TransactionDecision{State: TransactionAborted})
+	if err != nil {
+		println("[" + ID + "] The prepared transaction could not be settled: " + err.Error())
+		PreparedTransactionsLock.Lock()
+		if Prepared := PreparedTransactions[ID]; Prepared != nil {
+			Prepared.Timer = time.AfterFunc(TransactionPrepareTimeout, func() {
+				s.SettleTransaction(ID)
+			})
+		}
+		PreparedTransactionsLock.Unlock()
+		return
+	}
+	if Decision.State == TransactionCommitted {
+		_ = Core.CommitTransaction(ID, Decision.Versions)
+	} else {
+		Core.AbortTransaction(ID)
+	}
+}
+
+// Runs a transaction across all of the shards holding the records in it with a two-phase commit.
+// Each shard is given the operations for the records it holds and prepares them (in shard ID order so two transactions can't deadlock). If every shard prepares, the decision to commit is recorded and every shard is told to commit. If not, the shards which prepared are told to abort.
+// The results come from the first shard holding each record, and the versions it picked are sent with the commit so every replica agrees.
+func (s *Shard) Transaction(DatabaseName string, Operations []*TransactionOperation) ([]*TransactionResult, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before running a transaction.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Works out when the records expire here so every replica gets the same time.
+	Resolved := make([]*TransactionOperation, len(Operations))
+	for i, v := range Operations {
+		o := *v
+		if o.Op == TransactionPatch {
+			o.ResolveExpiry(0)
+		} else if o.Writes() {
+			if Table := Core.Table(DatabaseName, o.Table); Table != nil {
+				o.ResolveExpiry(Table.DefaultTTL)
+			}
+		}
+		Resolved[i] = &o
+	}
+
+	// Claims the values of the unique indexes for the items being written until the transaction is done. A patch can't be claimed before it is applied, so patches aren't allowed on tables with unique indexes.
+	Claims := make([]*UniqueClaim, 0)
+	defer func() {
+		s.ReleaseUnique(Claims)
+	}()
+	for _, v := range Resolved {
+		if !v.Writes() {
+			continue
+		}
+		if v.Op == TransactionPatch {
+			if len(Core.UniqueIndexes(DatabaseName, v.Table)) != 0 {
+				return nil, errors.New(`The table "` + v.Table + `" has unique indexes, so its records can't be patched in a transaction.`)
+			}
+			continue
+		}
+		if v.Item == nil {
+			continue
+		}
+		c, err := s.ClaimUnique(DatabaseName, v.Table, v.Key, v.Item)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		var InsertResponse *string
-		err = json.Unmarshal(Data, &InsertResponse)
+		Claims = append(Claims, c...)
+	}
+
+	// Works out which operations go to which shard.
+	Participants := map[string][]int{}
+	Primary := make([]string, len(Resolved))
+	for i, v := range Resolved {
+		Shards := HandleShardCalculation(v.Key, s.Shards, GetReplicas(DatabaseName, v.Table))
+		Primary[i] = Shards[0]
+		for _, k := range Shards {
+			Participants[k] = append(Participants[k], i)
+		}
+	}
+	ShardIDs := make([]string, 0, len(Participants))
+	for k := range Participants {
+		ShardIDs = append(ShardIDs, k)
+	}
+	sort.Strings(ShardIDs)
+
+	// Prepares the transaction on each shard.
+	ID := uuid.Must(uuid.NewV4()).String()
+	Results := make([]*TransactionResult, len(Resolved))
+	Prepared := []string{}
+	for _, k := range ShardIDs {
+		ShardOperations := make([]*TransactionOperation, len(Participants[k]))
+		for j, i := range Participants[k] {
+			ShardOperations[j] = Resolved[i]
+		}
+		ShardResults, err := s.PrepareTransactionOnShard(k, ID, DatabaseName, ShardOperations)
 		if err != nil {
-			panic(err)
+			for _, p := range Prepared {
+				_ = s.FinishTransactionOnShard(p, ID, false, nil)
+			}
+			return nil, err
+		}
+		Prepared = append(Prepared, k)
+		for j, i := range Participants[k] {
+			if Primary[i] == k {
+				Results[i] = ShardResults[j]
+			}
+		}
+	}
+
+	// Records the decision to commit along with the versions from the first shard holding each record. A shard whose prepare timed out could have decided to abort first.
+	Decision, err := s.DecideTransaction(ID, &TransactionDecision{
+		State:    TransactionCommitted,
+		Versions: TransactionVersions(Resolved, Results),
+	})
+	if err != nil || Decision.State != TransactionCommitted {
+		for _, p := range Prepared {
+			_ = s.FinishTransactionOnShard(p, ID, false, nil)
+		}
+		if err == nil {
+			err = errors.New("The transaction timed out before it could be committed.")
+		}
+		return nil, err
+	}
+
+	// Commits the transaction on each shard. The decision has been recorded, so a shard which has already settled the transaction has committed it too.
+	for _, k := range Prepared {
+		_ = s.FinishTransactionOnShard(k, ID, true, Decision.Versions)
+	}
+	return Results, nil
+}
+
+// Prepares a transaction on one shard.
+func (s *Shard) PrepareTransactionOnShard(ShardID string, ID string, DatabaseName string, Operations []*TransactionOperation) ([]*TransactionResult, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.PrepareTransaction(ID, DatabaseName, Operations)
+	}
+	var Response RemoteTransactionResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/transaction/prepare", &RemoteTransactionStructure{
+		ID: ID,
+		DB: DatabaseName,
+		Operations: Operations,
+	}, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Results, nil
+}
+
+// Commits or aborts a prepared transaction on one shard. The versions are only used when committing.
+func (s *Shard) FinishTransactionOnShard(ShardID string, ID string, Commit bool, Versions []*TransactionVersion) error {
+	if s.ShardURLS[ShardID] == "" {
+		if Commit {
+			return Core.CommitTransaction(ID, Versions)
 		}
-		err = req.Body.Close()
+		Core.AbortTransaction(ID)
+		return nil
+	}
+	Path := "/_shard/transaction/abort"
+	if Commit {
+		Path = "/_shard/transaction/commit"
+	}
+	var Response RemoteTransactionResponse
+	PostToShard(s.ShardURLS[ShardID], Path, &RemoteTransactionStructure{ID: ID, Versions: Versions}, &Response)
+	return RemoteError(Response.Err)
+}
+
+// Defines the kinds of batches which can be sent to a shard.
+const (
+	BatchOpGet    = "get"
+	BatchOpWrite  = "write"
+	BatchOpDelete = "delete"
+)
+
+// The remote batch structure.
+type RemoteBatchStructure struct {
+	Op string `json:"op"`
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Items []*BatchItem `json:"items"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// The response from a remote shard after a batch.
+type RemoteBatchResponse struct {
+	Results []*BatchResult `json:"results"`
+}
+
+// Runs a batch on one shard. The results are in the same order as the items. The fields are only used by gets.
+func (s *Shard) RunBatchOnShard(ShardID string, Op string, DatabaseName string, TableName string, Items []*BatchItem, Fields []string) []*BatchResult {
+	if s.ShardURLS[ShardID] == "" {
+		return RunLocalBatch(Op, DatabaseName, TableName, Items, Fields)
+	}
+	var Response RemoteBatchResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/batch", &RemoteBatchStructure{
+		Op: Op,
+		DB: DatabaseName,
+		Table: TableName,
+		Items: Items,
+		Fields: Fields,
+	}, &Response)
+	return Response.Results
+}
+
+// Runs a batch on the local DB.
+func RunLocalBatch(Op string, DatabaseName string, TableName string, Items []*BatchItem, Fields []string) []*BatchResult {
+	switch Op {
+	case BatchOpGet:
+		Keys := make([]string, len(Items))
+		for i, v := range Items {
+			Keys[i] = v.Key
+		}
+		Parsed, err := ParseProjection(Fields)
 		if err != nil {
-			panic(err)
+			return FailedBatchResults(len(Items), err)
 		}
-		if InsertResponse != nil {
-			return errors.New(*InsertResponse)
+		return Core.BatchGet(DatabaseName, TableName, Keys, Parsed)
+	case BatchOpWrite:
+		return Core.BatchWrite(DatabaseName, TableName, Items)
+	case BatchOpDelete:
+		return Core.BatchDelete(DatabaseName, TableName, Items)
+	default:
+		return FailedBatchResults(len(Items), errors.New(`The batch operation "` + Op + `" is not valid.`))
+	}
+}
+
+// Gets a batch of items from a table. The keys are grouped by the shard they are read from and each shard is asked in parallel.
+// If fields are given, only those fields of each item are returned (see projection.go).
+func (s *Shard) BatchGet(DatabaseName string, TableName string, Keys []string, Fields []string) map[string]*BatchResult {
+	// Groups the keys by shard. This shard is used if it holds the key.
+	Groups := map[string][]*BatchItem{}
+	Replicas := GetReplicas(DatabaseName, TableName)
+	for _, k := range Keys {
+		Shards := HandleShardCalculation(k, s.Shards, Replicas)
+		ShardID := Shards[0]
+		for _, v := range Shards {
+			if s.ShardURLS[v] == "" {
+				ShardID = v
+				break
+			}
 		}
+		Groups[ShardID] = append(Groups[ShardID], &BatchItem{Key: k})
 	}
-	return nil
+
+	// Asks each shard in parallel.
+	Results := map[string]*BatchResult{}
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for ShardID, Items := range Groups {
+		wg.Add(1)
+		go func(ShardID string, Items []*BatchItem) {
+			defer wg.Done()
+			ShardResults := s.RunBatchOnShard(ShardID, BatchOpGet, DatabaseName, TableName, Items, Fields)
+			ResultsLock.Lock()
+			for i, v := range Items {
+				Results[v.Key] = ShardResults[i]
+			}
+			ResultsLock.Unlock()
+		}(ShardID, Items)
+	}
+	wg.Wait()
+	return Results
+}
+
+// Writes or deletes a batch of items in a table. The items are grouped by the first shard holding them and each group is run in parallel.
+// Like a single write, the first shard picks the version and the other shards holding the item follow it. Each key succeeds or fails on its own.
+func (s *Shard) BatchWrite(DatabaseName string, TableName string, Op string, Items []*BatchItem) (map[string]*BatchResult, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before writing.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Works out when the records expire here so every replica gets the same time.
+	if Op == BatchOpWrite {
+		if Table := Core.Table(DatabaseName, TableName); Table != nil {
+			for _, v := range Items {
+				v.ResolveExpiry(Table.DefaultTTL)
+			}
+		}
+	}
+
+	// Claims the values of the unique indexes for each item until the batch is written. Items which can't be claimed fail straight away.
+	Results := map[string]*BatchResult{}
+	if Op == BatchOpWrite && len(Core.UniqueIndexes(DatabaseName, TableName)) != 0 {
+		Claims := make([]*UniqueClaim, 0)
+		defer func() {
+			s.ReleaseUnique(Claims)
+		}()
+		Claimed := make([]*BatchItem, 0, len(Items))
+		for _, v := range Items {
+			c, err := s.ClaimUnique(DatabaseName, TableName, v.Key, v.Item)
+			if err != nil {
+				Results[v.Key] = NewBatchResult(nil, nil, err)
+				continue
+			}
+			Claims = append(Claims, c...)
+			Claimed = append(Claimed, v)
+		}
+		Items = Claimed
+	}
+
+	// Groups the items by the first shard holding them.
+	Groups := map[string][]*BatchItem{}
+	Followers := map[string][]string{}
+	Replicas := GetReplicas(DatabaseName, TableName)
+	for _, v := range Items {
+		Shards := HandleShardCalculation(v.Key, s.Shards, Replicas)
+		Groups[Shards[0]] = append(Groups[Shards[0]], v)
+		Followers[v.Key] = Shards[1:]
+	}
+
+	// Runs each group in parallel.
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for ShardID, GroupItems := range Groups {
+		wg.Add(1)
+		go func(ShardID string, GroupItems []*BatchItem) {
+			defer wg.Done()
+
+			// Runs the batch on the first shard.
+			GroupResults := s.RunBatchOnShard(ShardID, Op, DatabaseName, TableName, GroupItems, nil)
+
+			// Sends the items which worked to the other shards holding them.
+			FollowerItems := map[string][]*BatchItem{}
+			FollowerIndexes := map[string][]int{}
+			for i, v := range GroupItems {
+				if GroupResults[i].Err != nil {
+					continue
+				}
+				Follow := &BatchItem{Key: v.Key, Item: v.Item}
+				if Op == BatchOpWrite {
+					Follow.WriteOptions = WriteOptions{Mode: WriteUpsert, Version: GroupResults[i].Version, Expires: GroupResults[i].Expires}
+				}
+				for _, f := range Followers[v.Key] {
+					FollowerItems[f] = append(FollowerItems[f], Follow)
+					FollowerIndexes[f] = append(FollowerIndexes[f], i)
+				}
+			}
+			for f, FItems := range FollowerItems {
+				FResults := s.RunBatchOnShard(f, Op, DatabaseName, TableName, FItems, nil)
+				for j, r := range FResults {
+					if r.Err != nil {
+						GroupResults[FollowerIndexes[f][j]] = r
+					}
+				}
+			}
+
+			// Stores the results.
+			ResultsLock.Lock()
+			for i, v := range GroupItems {
+				Results[v.Key] = GroupResults[i]
+			}
+			ResultsLock.Unlock()
+		}(ShardID, GroupItems)
+	}
+	wg.Wait()
+	return Results, nil
+}
+
+// The remote index query structure.
+type RemoteIndexQueryStructure struct {
+	IndexQuery
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Index string `json:"index"`
+}
+
+// The response from a remote shard after a index query.
+type RemoteIndexQueryResponse struct {
+	Err *string `json:"error"`
+	Records []*IndexRecord `json:"records"`
+}
+
+// Defines a page of records found using a index. Next is the cursor to pass as after to get the next page, or nil if this is the last page.
+type IndexPage struct {
+	Records []*IndexRecord `json:"records"`
+	Next *string `json:"next"`
+}
+
+// Queries a index on one shard.
+func (s *Shard) GetAllByIndexOnShard(ShardID string, Query *RemoteIndexQueryStructure) ([]*IndexRecord, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.GetAllByIndex(Query.DB, Query.Table, Query.Index, &Query.IndexQuery)
+	}
+	var Response RemoteIndexQueryResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/index_query", Query, &Response)
+	if Response.Err != nil {
+		return nil, RemoteError(Response.Err)
+	}
+	return Response.Records, nil
+}
+
+// Gets a page of the records which match a query on a index. Any shard could hold some of the records, so every shard is asked in parallel and the results are merged.
+// Replicas of the same record are only returned once (the newest version wins).
+func (s *Shard) GetAllByIndex(DatabaseName string, TableName string, IndexName string, Query *IndexQuery) (*IndexPage, error) {
+	UptimeMutex.RLock()
+	for _, v := range UptimeMap {
+		if v == nil {
+			UptimeMutex.RUnlock()
+			return nil, errors.New("A shard is down. Please fix this before querying indexes.")
+		}
+	}
+	UptimeMutex.RUnlock()
+
+	// Asks each shard for one more record than the limit. If there is more than the limit after merging, there is another page.
+	ShardQuery := &RemoteIndexQueryStructure{
+		IndexQuery: *Query,
+		DB: DatabaseName,
+		Table: TableName,
+		Index: IndexName,
+	}
+	ShardQuery.Limit = Query.Limit + 1
+	Merged := map[string]*IndexRecord{}
+	var Failed error
+	ResultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, ShardID := range s.Shards {
+		wg.Add(1)
+		go func(ShardID string) {
+			defer wg.Done()
+			Records, err := s.GetAllByIndexOnShard(ShardID, ShardQuery)
+			ResultsLock.Lock()
+			if err != nil {
+				Failed = err
+			}
+			for _, v := range Records {
+				if Merged[v.Key] == nil || Merged[v.Key].Version < v.Version {
+					Merged[v.Key] = v
+				}
+			}
+			ResultsLock.Unlock()
+		}(ShardID)
+	}
+	wg.Wait()
+	if Failed != nil {
+		return nil, Failed
+	}
+
+	// Sorts the records and cuts them down to the limit.
+	Page := &IndexPage{Records: make([]*IndexRecord, 0, len(Merged))}
+	for _, v := range Merged {
+		Page.Records = append(Page.Records, v)
+	}
+	sort.Slice(Page.Records, func(a, b int) bool {
+		x, y := Page.Records[a], Page.Records[b]
+		if Query.Reverse {
+			x, y = y, x
+		}
+		if string(x.Sort) != string(y.Sort) {
+			return string(x.Sort) < string(y.Sort)
+		}
+		return x.Key < y.Key
+	})
+	if len(Page.Records) > Query.Limit {
+		Page.Records = Page.Records[:Query.Limit]
+		Last := Page.Records[Query.Limit-1]
+		Next := Last.Key
+		if Last.Sort != nil {
+			Next = EncodeOrderedCursor(string(Last.Sort), Last.Key)
+		}
+		Page.Next = &Next
+	}
+
+	// The sort keys are only used inside the cluster.
+	for _, v := range Page.Records {
+		v.Sort = nil
+	}
+	return Page, nil
 }
@@ -0,0 +1,242 @@
+// This is the Porter stemming algorithm (https://tartarus.org/martin/PorterStemmer/), which full-text indexes use to turn words like "connected", "connecting" and "connection" into the same term.
+// It follows the reference implementation by Martin Porter, so the terms match what other Porter stemmers give.
+
+package main
+
+// Defines the state of a word while it is being stemmed. The word is in B[0:K+1] and J marks the end of the stem being looked at.
+type PorterStemmer struct {
+	B []byte
+	K int
+	J int
+}
+
+// Stems a lowercase word. Words with anything other than the letters a to z in them are returned as they are.
+func PorterStem(Word string) string {
+	if len(Word) <= 2 {
+		return Word
+	}
+	for i := 0; i < len(Word); i++ {
+		if Word[i] < 'a' || Word[i] > 'z' {
+			return Word
+		}
+	}
+	p := &PorterStemmer{B: []byte(Word), K: len(Word) - 1}
+	p.Step1ab()
+	if p.K > 0 {
+		p.Step1c()
+		p.Step2()
+		p.Step3()
+		p.Step4()
+		p.Step5()
+	}
+	return string(p.B[:p.K+1])
+}
+
+// Checks if the letter at i is a consonant. A "y" is a consonant unless it comes after one.
+func (p *PorterStemmer) Cons(i int) bool {
+	switch p.B[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		if i == 0 {
+			return true
+		}
+		return !p.Cons(i - 1)
+	}
+	return true
+}
+
+// Counts the vowel-consonant sequences in the stem. The stem is made of [C](VC){m}[V], and this is m.
+func (p *PorterStemmer) M() int {
+	n := 0
+	i := 0
+	for {
+		if i > p.J {
+			return n
+		}
+		if !p.Cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > p.J {
+				return n
+			}
+			if p.Cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > p.J {
+				return n
+			}
+			if !p.Cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// Checks if the stem has a vowel in it.
+func (p *PorterStemmer) VowelInStem() bool {
+	for i := 0; i <= p.J; i++ {
+		if !p.Cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the letters at i and before it are the same consonant.
+func (p *PorterStemmer) DoubleC(i int) bool {
+	return i >= 1 && p.B[i] == p.B[i-1] && p.Cons(i)
+}
+
+// Checks if the letters ending at i are consonant, vowel, consonant and the last one isn't w, x or y. This is used to put an "e" back on short words like "hop(e)".
+func (p *PorterStemmer) CVC(i int) bool {
+	if i < 2 || !p.Cons(i) || p.Cons(i-1) || !p.Cons(i-2) {
+		return false
+	}
+	switch p.B[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// Checks if the word ends with the suffix given. If it does, the stem is set to the rest of the word.
+func (p *PorterStemmer) Ends(Suffix string) bool {
+	l := len(Suffix)
+	if l > p.K+1 || string(p.B[p.K-l+1:p.K+1]) != Suffix {
+		return false
+	}
+	p.J = p.K - l
+	return true
+}
+
+// Replaces the end of the word after the stem.
+func (p *PorterStemmer) SetTo(s string) {
+	p.B = append(p.B[:p.J+1], s...)
+	p.K = p.J + len(s)
+}
+
+// Replaces the end of the word after the stem if the stem has at least one vowel-consonant sequence.
+func (p *PorterStemmer) R(s string) {
+	if p.M() > 0 {
+		p.SetTo(s)
+	}
+}
+
+// Replaces the first suffix in the list which the word ends with. The list is pairs of suffixes and what they are replaced with.
+func (p *PorterStemmer) ReplaceSuffix(Pairs []string) {
+	for i := 0; i < len(Pairs); i += 2 {
+		if p.Ends(Pairs[i]) {
+			p.R(Pairs[i+1])
+			return
+		}
+	}
+}
+
+// Removes plurals and -ed or -ing. For example, "caresses" becomes "caress", "ponies" becomes "poni" and "hopping" becomes "hop".
+func (p *PorterStemmer) Step1ab() {
+	if p.B[p.K] == 's' {
+		if p.Ends("sses") {
+			p.K -= 2
+		} else if p.Ends("ies") {
+			p.SetTo("i")
+		} else if p.B[p.K-1] != 's' {
+			p.K--
+		}
+	}
+	if p.Ends("eed") {
+		if p.M() > 0 {
+			p.K--
+		}
+	} else if (p.Ends("ed") || p.Ends("ing")) && p.VowelInStem() {
+		p.K = p.J
+		if p.Ends("at") {
+			p.SetTo("ate")
+		} else if p.Ends("bl") {
+			p.SetTo("ble")
+		} else if p.Ends("iz") {
+			p.SetTo("ize")
+		} else if p.DoubleC(p.K) {
+			p.K--
+			switch p.B[p.K] {
+			case 'l', 's', 'z':
+				p.K++
+			}
+		} else if p.M() == 1 && p.CVC(p.K) {
+			p.SetTo("e")
+		}
+	}
+}
+
+// Turns a "y" at the end into a "i" when there is another vowel in the word.
+func (p *PorterStemmer) Step1c() {
+	if p.Ends("y") && p.VowelInStem() {
+		p.B[p.K] = 'i'
+	}
+}
+
+// Turns double suffixes into single ones. For example, "-ization" becomes "-ize".
+func (p *PorterStemmer) Step2() {
+	p.ReplaceSuffix([]string{
+		"ational", "ate", "tional", "tion",
+		"enci", "ence", "anci", "ance",
+		"izer", "ize",
+		"bli", "ble", "alli", "al", "entli", "ent", "eli", "e", "ousli", "ous",
+		"ization", "ize", "ation", "ate", "ator", "ate",
+		"alism", "al", "iveness", "ive", "fulness", "ful", "ousness", "ous",
+		"aliti", "al", "iviti", "ive", "biliti", "ble",
+		"logi", "log",
+	})
+}
+
+// Handles -ic-, -full, -ness and similar suffixes.
+func (p *PorterStemmer) Step3() {
+	p.ReplaceSuffix([]string{
+		"icate", "ic", "ative", "", "alize", "al", "iciti", "ic", "ical", "ic", "ful", "", "ness", "",
+	})
+}
+
+// Removes -ant, -ence and similar suffixes when the stem is long enough.
+func (p *PorterStemmer) Step4() {
+	for _, Suffix := range []string{
+		"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent",
+		"ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+	} {
+		if !p.Ends(Suffix) {
+			continue
+		}
+		if Suffix == "ion" && (p.J < 0 || (p.B[p.J] != 's' && p.B[p.J] != 't')) {
+			return
+		}
+		if p.M() > 1 {
+			p.K = p.J
+		}
+		return
+	}
+}
+
+// Removes a final "e" and turns a final "ll" into "l" when the stem is long enough.
+func (p *PorterStemmer) Step5() {
+	p.J = p.K
+	if p.B[p.K] == 'e' {
+		a := p.M()
+		if a > 1 || (a == 1 && !p.CVC(p.K-1)) {
+			p.K--
+		}
+	}
+	if p.B[p.K] == 'l' && p.DoubleC(p.K) && p.M() > 1 {
+		p.K--
+	}
+}
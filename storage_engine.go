@@ -0,0 +1,87 @@
+// This defines the interface storage engines implement. The DB core handles all of the logic (locking, indexes, caching) and the storage engine just handles getting the bytes on and off of whatever it stores things on.
+
+package main
+
+import "os"
+
+// Defines the storage engine which should be used.
+var StorageEngineName = os.Getenv("STORAGE_ENGINE")
+
+// Defines a change to a record in a batch. A nil Data deletes the record.
+type RecordChange struct {
+	DB    string `json:"db"`
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Data  []byte `json:"data"`
+}
+
+// Defines a storage engine.
+type StorageEngine interface {
+	// Loads the DB structure. Returns nil if it has never been saved.
+	LoadStructure() []byte
+
+	// Saves the DB structure.
+	SaveStructure(Data []byte)
+
+	// Creates the storage for a database.
+	CreateDatabase(DatabaseName string)
+
+	// Deletes a database and everything inside of it.
+	DeleteDatabase(DatabaseName string)
+
+	// Creates the storage for a table.
+	CreateTable(DatabaseName string, TableName string)
+
+	// Deletes a table and everything inside of it.
+	DeleteTable(DatabaseName string, TableName string)
+
+	// Reads a record. Returns nil if the record does not exist.
+	ReadRecord(DatabaseName string, TableName string, Key string) []byte
+
+	// Writes a record, replacing it if it already exists.
+	WriteRecord(DatabaseName string, TableName string, Key string, Data []byte)
+
+	// Deletes a record if it exists.
+	DeleteRecord(DatabaseName string, TableName string, Key string)
+
+	// Applies a batch of record changes atomically. If the process dies, either all of the changes are there when it starts back up or none of them are.
+	ApplyBatch(Changes []*RecordChange)
+
+	// Gets all of the record keys in a table.
+	RecordKeys(DatabaseName string, TableName string) []string
+
+	// Creates the storage for a index.
+	CreateIndex(DatabaseName string, TableName string, IndexName string)
+
+	// Deletes a index and all of its files.
+	DeleteIndex(DatabaseName string, TableName string, IndexName string)
+
+	// Gets the names of all the files in a index.
+	IndexFiles(DatabaseName string, TableName string, IndexName string) []string
+
+	// Reads a index file. Returns nil if the file does not exist.
+	ReadIndexFile(DatabaseName string, TableName string, IndexName string, File string) []byte
+
+	// Writes a index file, replacing it if it already exists.
+	WriteIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte)
+
+	// Appends to the end of a index file, creating it if it doesn't exist.
+	AppendIndexFile(DatabaseName string, TableName string, IndexName string, File string, Data []byte)
+
+	// Deletes a index file if it exists.
+	DeleteIndexFile(DatabaseName string, TableName string, IndexName string, File string)
+}
+
+// Creates the storage engine which was configured.
+func NewStorageEngine(Base string) StorageEngine {
+	switch StorageEngineName {
+	case "", "filesystem":
+		return NewFilesystemEngine(Base)
+	case "memory":
+		return NewMemoryEngine()
+	case "segment":
+		return NewSegmentEngine(Base)
+	default:
+		panic(`The storage engine "` + StorageEngineName + `" does not exist.`)
+	}
+}
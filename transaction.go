@@ -0,0 +1,462 @@
+// This handles transactions. A transaction is a list of reads, checks and writes across the tables in a database which either all happen or none of them do.
+// A transaction is done in two steps so it can be spread across shards:
+//   - Prepare: All of the tables in the transaction are locked (in name order so two transactions can't deadlock), then the operations are run against a staged copy of the records. If anything fails, the locks are released and nothing is written.
+//   - Commit: The staged records are written to the storage engine in one batch, the indexes/cache are updated and the locks are released.
+// Across shards, the versions are picked by the first shard holding each record and sent with the commit, so every replica of a record ends up with the same version.
+// The staged records are saved in the internal database when a transaction is prepared, so a prepared transaction survives a restart (the tables are locked again on boot).
+// If a prepared transaction isn't committed or aborted within TransactionPrepareTimeout, the decision recorded for it is checked (see Shard.SettleTransaction). It is committed if the shard running it decided to commit, and aborted otherwise.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defines the operations which can be in a transaction.
+const (
+	// Gets a record. This doesn't fail if the record doesn't exist.
+	TransactionGet = "get"
+
+	// Checks a record against the conditions given. The transaction fails if the conditions aren't met.
+	TransactionCheck = "check"
+
+	// Inserts a record.
+	TransactionInsert = "insert"
+
+	// Replaces a record.
+	TransactionReplace = "replace"
+
+	// Inserts a record, replacing it if it already exists.
+	TransactionUpsert = "upsert"
+
+	// Patches a record.
+	TransactionPatch = "patch"
+
+	// Deletes a record.
+	TransactionDelete = "delete"
+)
+
+// How long a transaction can stay prepared before the decision for it is checked.
+var TransactionPrepareTimeout = 30 * time.Second
+
+// The table in the internal database which holds the staged records of the transactions prepared on this shard.
+const PreparedTransactionsTable = "prepared_transactions"
+
+// Defines a operation in a transaction. The if_match, if_none_match, ttl and expires options work the same as they do on a write.
+type TransactionOperation struct {
+	WriteOptions
+	Op        string       `json:"op"`
+	Table     string       `json:"table"`
+	Key       string       `json:"key"`
+	Item      *interface{} `json:"item,omitempty"`
+	PatchType string       `json:"patch_type,omitempty"`
+	Patch     interface{}  `json:"patch,omitempty"`
+
+	// Used by checks. If set, the record has to exist (or not exist).
+	Exists *bool `json:"exists,omitempty"`
+}
+
+// Checks if the operation writes to the record.
+func (o *TransactionOperation) Writes() bool {
+	return o.Op != TransactionGet && o.Op != TransactionCheck
+}
+
+// Defines the result of a operation in a transaction.
+type TransactionResult struct {
+	Exists  bool         `json:"exists"`
+	Item    *interface{} `json:"item,omitempty"`
+	Version uint64       `json:"version,omitempty"`
+}
+
+// Defines the version a record in a transaction is committed with.
+type TransactionVersion struct {
+	Table   string `json:"table"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+// Gets the version each record in a transaction ends up with from the results of the operations. Records which end up deleted are left out.
+func TransactionVersions(Operations []*TransactionOperation, Results []*TransactionResult) []*TransactionVersion {
+	ByKey := map[string]*TransactionVersion{}
+	Versions := make([]*TransactionVersion, 0)
+	for i, v := range Operations {
+		if !v.Writes() || Results[i] == nil || !Results[i].Exists {
+			continue
+		}
+		Version := ByKey[v.Table+"\x00"+v.Key]
+		if Version == nil {
+			Version = &TransactionVersion{Table: v.Table, Key: v.Key}
+			ByKey[v.Table+"\x00"+v.Key] = Version
+			Versions = append(Versions, Version)
+		}
+		Version.Version = Results[i].Version
+	}
+	return Versions
+}
+
+// Defines a record which has been staged in a transaction.
+type StagedRecord struct {
+	Table       *Table       `json:"-"`
+	TableName   string       `json:"table"`
+	Key         string       `json:"key"`
+	Old         *interface{} `json:"old"`
+	Meta        *RecordMeta  `json:"meta"`
+	Item        *interface{} `json:"item"`
+	LastVersion uint64       `json:"-"`
+	Changed     bool         `json:"changed"`
+}
+
+// Stages a new version of the record.
+func (s *StagedRecord) Write(Item *interface{}, Expires int64, Version uint64) {
+	s.LastVersion = Version
+	s.Meta = &RecordMeta{Version: Version, Expires: Expires}
+	s.Item = Item
+	s.Changed = true
+}
+
+// Gets the result for the record as it is staged.
+func (s *StagedRecord) Result(IncludeItem bool) *TransactionResult {
+	if s.Meta == nil {
+		return &TransactionResult{Exists: false}
+	}
+	r := &TransactionResult{Exists: true, Version: s.Meta.Version}
+	if IncludeItem {
+		r.Item = s.Item
+	}
+	return r
+}
+
+// Defines a transaction which has been prepared.
+type PreparedTransaction struct {
+	DB     string          `json:"db"`
+	Locks  []*sync.RWMutex `json:"-"`
+	Staged []*StagedRecord `json:"staged"`
+	Timer  *time.Timer     `json:"-"`
+}
+
+// Defines all of the transactions which have been prepared on this shard.
+var (
+	PreparedTransactions     = map[string]*PreparedTransaction{}
+	PreparedTransactionsLock = sync.Mutex{}
+)
+
+// Unlocks all of the tables in the transaction.
+func (p *PreparedTransaction) Unlock() {
+	for i := len(p.Locks) - 1; i >= 0; i-- {
+		p.Locks[i].Unlock()
+	}
+}
+
+// Locks the tables in a transaction and runs the operations against a staged copy of the records. The tables stay locked until the transaction is committed or aborted. Returns the result of each operation.
+func (d *DBCore) StageTransaction(DatabaseName string, Operations []*TransactionOperation) (*PreparedTransaction, []*TransactionResult, error) {
+	// Checks all of the tables exist.
+	if len(Operations) == 0 {
+		return nil, nil, errors.New("The transaction has no operations.")
+	}
+	Tables := map[string]*Table{}
+	for _, v := range Operations {
+		if Tables[v.Table] != nil {
+			continue
+		}
+		Table := d.Table(DatabaseName, v.Table)
+		if Table == nil {
+			err := errors.New(`The table "` + v.Table + `" does not exist.`)
+			return nil, nil, err
+		}
+		Tables[v.Table] = Table
+	}
+
+	// Locks the tables in name order.
+	Prepared := &PreparedTransaction{
+		DB:     DatabaseName,
+		Staged: []*StagedRecord{},
+	}
+	d.LockTransactionTables(Prepared, Tables)
+
+	// Runs the operations.
+	Results, err := d.RunTransactionNonThreadSafe(Prepared, Tables, Operations)
+	if err != nil {
+		Prepared.Unlock()
+		return nil, nil, err
+	}
+	return Prepared, Results, nil
+}
+
+// Locks the tables given in name order so two transactions can't deadlock.
+func (d *DBCore) LockTransactionTables(Prepared *PreparedTransaction, Tables map[string]*Table) {
+	TableNames := make([]string, 0, len(Tables))
+	for k := range Tables {
+		TableNames = append(TableNames, k)
+	}
+	sort.Strings(TableNames)
+	Prepared.Locks = make([]*sync.RWMutex, len(TableNames))
+	for i, v := range TableNames {
+		lock := d.GetTableLock(Prepared.DB, v)
+		lock.Lock()
+		Prepared.Locks[i] = lock
+	}
+}
+
+// Prepares a transaction. The staged records are saved so the transaction can still be committed if this shard restarts. Returns the result of each operation.
+func (d *DBCore) PrepareTransaction(ID string, DatabaseName string, Operations []*TransactionOperation) ([]*TransactionResult, error) {
+	Prepared, Results, err := d.StageTransaction(DatabaseName, Operations)
+	if err != nil {
+		return nil, err
+	}
+
+	// Saves the staged records.
+	err = d.Upsert("__internal", PreparedTransactionsTable, ID, ToInterfacePtr(Prepared))
+	if err != nil {
+		Prepared.Unlock()
+		return nil, err
+	}
+
+	// Stores the prepared transaction.
+	d.StorePreparedTransaction(ID, Prepared)
+
+	// Returns the results.
+	return Results, nil
+}
+
+// Stores a prepared transaction and starts the timer which settles it if it isn't committed or aborted in time.
+func (d *DBCore) StorePreparedTransaction(ID string, Prepared *PreparedTransaction) {
+	PreparedTransactionsLock.Lock()
+	PreparedTransactions[ID] = Prepared
+	Prepared.Timer = time.AfterFunc(TransactionPrepareTimeout, func() {
+		ShardInstance.SettleTransaction(ID)
+	})
+	PreparedTransactionsLock.Unlock()
+}
+
+// Loads the transactions which were prepared on this shard before it restarted and locks their tables again. They are settled once they time out, unless they are committed or aborted first.
+func (d *DBCore) RecoverPreparedTransactions() {
+	Keys, err := d.TableKeys("__internal", PreparedTransactionsTable)
+	if err != nil {
+		panic(err)
+	}
+	for _, ID := range Keys {
+		Data, err := d.Get("__internal", PreparedTransactionsTable, ID)
+		if err != nil {
+			continue
+		}
+
+		// Converting to JSON and back gets the staged records out of the item.
+		b, err := json.Marshal(Data)
+		if err != nil {
+			panic(err)
+		}
+		var Prepared PreparedTransaction
+		err = json.Unmarshal(b, &Prepared)
+		if err != nil {
+			panic(err)
+		}
+
+		// Drops the transaction if one of its tables has been deleted.
+		Tables := map[string]*Table{}
+		for _, s := range Prepared.Staged {
+			s.Table = d.Table(Prepared.DB, s.TableName)
+			if s.Table == nil {
+				Tables = nil
+				break
+			}
+			Tables[s.TableName] = s.Table
+		}
+		if Tables == nil {
+			_ = d.DeleteRecord("__internal", PreparedTransactionsTable, ID)
+			continue
+		}
+		d.LockTransactionTables(&Prepared, Tables)
+		d.StorePreparedTransaction(ID, &Prepared)
+		println("[" + Prepared.DB + "] Recovered the prepared transaction " + ID + ".")
+	}
+}
+
+// Runs the operations in a transaction against the staged records. The tables must be locked when this is called.
+func (d *DBCore) RunTransactionNonThreadSafe(Prepared *PreparedTransaction, Tables map[string]*Table, Operations []*TransactionOperation) ([]*TransactionResult, error) {
+	Staged := map[string]*StagedRecord{}
+	Results := make([]*TransactionResult, len(Operations))
+	for i, v := range Operations {
+		// Gets the record as it is staged, reading it from the storage engine if this is the first time it is used.
+		s := Staged[v.Table+"\x00"+v.Key]
+		if s == nil {
+			Meta, Old := d.ReadRecordNonThreadSafe(Prepared.DB, v.Table, v.Key)
+			s = &StagedRecord{
+				Table:     Tables[v.Table],
+				TableName: v.Table,
+				Key:       v.Key,
+				Old:       Old,
+				Meta:      LiveMeta(Meta),
+				Item:      Old,
+			}
+			if Meta != nil {
+				s.LastVersion = Meta.Version
+			}
+			if s.Meta == nil {
+				s.Item = nil
+			}
+			Staged[v.Table+"\x00"+v.Key] = s
+			Prepared.Staged = append(Prepared.Staged, s)
+		}
+
+		// Checks the record exists (or doesn't) if the operation needs it to.
+		switch v.Op {
+		case TransactionInsert:
+			if s.Meta != nil {
+				err := errors.New(`The record "` + v.Key + `" already exists.`)
+				return nil, err
+			}
+		case TransactionReplace, TransactionPatch, TransactionDelete:
+			if s.Meta == nil {
+				err := errors.New(`The record "` + v.Key + `" does not exist.`)
+				return nil, err
+			}
+		case TransactionCheck:
+			if v.Exists != nil && *v.Exists != (s.Meta != nil) {
+				return nil, ErrPreconditionFailed
+			}
+		case TransactionGet, TransactionUpsert:
+		default:
+			err := errors.New(`The operation "` + v.Op + `" is not valid.`)
+			return nil, err
+		}
+
+		// Checks the preconditions.
+		if !v.PreconditionsMet(s.Meta) {
+			return nil, ErrPreconditionFailed
+		}
+
+		// Runs the operation.
+		switch v.Op {
+		case TransactionInsert, TransactionReplace, TransactionUpsert:
+			if v.Item == nil {
+				return nil, errors.New("The item is missing.")
+			}
+			s.Write(v.Item, v.Expires, d.NextVersionNonThreadSafe(Prepared.DB, v.Table, &RecordMeta{Version: s.LastVersion}, &WriteOptions{}))
+		case TransactionPatch:
+			PatchType := v.PatchType
+			if PatchType == "" {
+				PatchType = PatchMerge
+			}
+			New, err := ApplyPatch(*s.Item, PatchType, v.Patch)
+			if err != nil {
+				return nil, err
+			}
+			Expires := s.Meta.Expires
+			if v.Expires != 0 {
+				Expires = v.Expires
+			}
+			s.Write(&New, Expires, d.NextVersionNonThreadSafe(Prepared.DB, v.Table, &RecordMeta{Version: s.LastVersion}, &WriteOptions{}))
+		case TransactionDelete:
+			s.Meta = nil
+			s.Item = nil
+			s.Changed = true
+		}
+		Results[i] = s.Result(v.Op == TransactionGet)
+	}
+
+	// Checks the unique indexes against the records as they are staged.
+	err := d.CheckStagedUniqueNonThreadSafe(Prepared.DB, Prepared.Staged)
+	if err != nil {
+		return nil, err
+	}
+	return Results, nil
+}
+
+// Takes a prepared transaction out of the map. Returns nil if it doesn't exist.
+func TakePreparedTransaction(ID string) *PreparedTransaction {
+	PreparedTransactionsLock.Lock()
+	Prepared := PreparedTransactions[ID]
+	delete(PreparedTransactions, ID)
+	PreparedTransactionsLock.Unlock()
+	if Prepared != nil && Prepared.Timer != nil {
+		Prepared.Timer.Stop()
+	}
+	return Prepared
+}
+
+// Commits a prepared transaction. Versions are the versions picked by the first shard holding each record. If they are nil, the staged versions are used.
+func (d *DBCore) CommitTransaction(ID string, Versions []*TransactionVersion) error {
+	// Gets the transaction.
+	Prepared := TakePreparedTransaction(ID)
+	if Prepared == nil {
+		return errors.New("The transaction does not exist or has timed out.")
+	}
+	d.ApplyTransactionNonThreadSafe(Prepared, Versions)
+
+	// Removes the saved records and unlocks the tables.
+	_ = d.DeleteRecord("__internal", PreparedTransactionsTable, ID)
+	Prepared.Unlock()
+
+	// Yay! Return a null pointer for errors.
+	return nil
+}
+
+// Writes the staged records of a transaction. The tables in the transaction must be locked when this is called.
+func (d *DBCore) ApplyTransactionNonThreadSafe(Prepared *PreparedTransaction, Versions []*TransactionVersion) {
+	// Moves the staged records onto the versions given, so every replica has the same version.
+	for _, v := range Versions {
+		for _, s := range Prepared.Staged {
+			if s.Changed && s.Meta != nil && s.TableName == v.Table && s.Key == v.Key {
+				s.Meta.Version = d.NextVersionNonThreadSafe(Prepared.DB, s.TableName, s.Meta, &WriteOptions{Version: v.Version})
+			}
+		}
+	}
+
+	// Builds the batch.
+	Changes := []*RecordChange{}
+	Encoded := make([][]byte, len(Prepared.Staged))
+	for i, s := range Prepared.Staged {
+		if !s.Changed || (s.Meta == nil && s.Old == nil) {
+			continue
+		}
+		Change := &RecordChange{DB: Prepared.DB, Table: s.TableName, Key: s.Key}
+		if s.Meta != nil {
+			b, err := json.Marshal(s.Item)
+			if err != nil {
+				panic(err)
+			}
+			Change.Data = EncodeRecord(s.Meta, b)
+			Encoded[i] = Change.Data
+			if s.Meta.Expires != 0 && !s.Table.Expiring {
+				d.MarkTableExpiringNonThreadSafe(Prepared.DB, s.TableName)
+			}
+		}
+		Changes = append(Changes, Change)
+	}
+
+	// Writes the batch and updates everything else.
+	if len(Changes) != 0 {
+		d.Engine.ApplyBatch(Changes)
+	}
+	for i, s := range Prepared.Staged {
+		if Encoded[i] != nil {
+			d.AfterWriteNonThreadSafe(s.Table, Prepared.DB, s.TableName, s.Key, s.Old, s.Item, s.Meta, Encoded[i])
+		} else if s.Changed && s.Old != nil {
+			d.AfterDeleteNonThreadSafe(s.Table, Prepared.DB, s.TableName, s.Key, s.Old)
+		}
+	}
+}
+
+// Aborts a prepared transaction. Nothing happens if the transaction doesn't exist.
+func (d *DBCore) AbortTransaction(ID string) {
+	Prepared := TakePreparedTransaction(ID)
+	if Prepared != nil {
+		_ = d.DeleteRecord("__internal", PreparedTransactionsTable, ID)
+		Prepared.Unlock()
+	}
+}
+
+// Runs a transaction on this shard. The transaction is committed as soon as it is staged, so nothing needs to be saved.
+func (d *DBCore) Transaction(DatabaseName string, Operations []*TransactionOperation) ([]*TransactionResult, error) {
+	Prepared, Results, err := d.StageTransaction(DatabaseName, Operations)
+	if err != nil {
+		return nil, err
+	}
+	d.ApplyTransactionNonThreadSafe(Prepared, nil)
+	Prepared.Unlock()
+	return Results, nil
+}
@@ -0,0 +1,359 @@
+// This handles unique indexes. A unique index rejects a write which would give a record the same value as another record in the index.
+// Inside one DBCore, the check happens while the table is locked, so two writes can't both pass it. Across the cluster, two records with the same value could be on different shards, so the shard layer also:
+//   - Claims the value first. A claim is a short-lived record in the internal database on the shard which owns the value, so two writers of the same value can't both hold it.
+//   - Asks every shard if another record already has the value while holding the claim.
+//   - Releases the claim once the record has been written. If the process dies first, the claim expires after UniqueClaimTimeout.
+// Each claim holds a random owner token. A writer which is slower than UniqueClaimTimeout could find its claim has expired and been taken by another writer, so a claim is only released if it still holds the writer's token. Each shard holding the claim checks the token itself before deleting it.
+// Records which were already in the table when a unique index was created are checked on each shard as the index is built. If two have the same value, the build fails.
+// While a unique index is being built (or rebuilt), it only holds some of the records, so writes which give a record a value in it are turned away until it has been built.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// The table in the internal database which holds the unique claims.
+const UniqueClaimsTable = "unique_claims"
+
+// How long a unique claim lasts if it isn't released.
+var UniqueClaimTimeout = 30 * time.Second
+
+// How many times a patch to a table with unique indexes is tried again if the record changes while the new value is being claimed.
+const UniquePatchAttempts = 5
+
+// The error which is returned when a write would give a unique index a value which another record already has.
+type UniqueViolationError struct {
+	Index string
+}
+
+// Gets the message of the error.
+func (e *UniqueViolationError) Error() string {
+	return `The index "` + e.Index + `" is unique and another record already has the same value.`
+}
+
+// Gets the unique violation back from its message. The boolean is false if the message is for a different error.
+func ParseUniqueViolation(Message string) (*UniqueViolationError, bool) {
+	Prefix := `The index "`
+	Suffix := `" is unique and another record already has the same value.`
+	if !strings.HasPrefix(Message, Prefix) || !strings.HasSuffix(Message, Suffix) || len(Message) < len(Prefix)+len(Suffix) {
+		return nil, false
+	}
+	return &UniqueViolationError{Index: Message[len(Prefix) : len(Message)-len(Suffix)]}, true
+}
+
+// Checks if a error is a unique violation.
+func IsUniqueViolation(err error) bool {
+	_, ok := err.(*UniqueViolationError)
+	return ok
+}
+
+// Gets the unique indexes on a table.
+func (d *DBCore) UniqueIndexes(DatabaseName string, TableName string) []*Index {
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		return nil
+	}
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.RLock()
+	Indexes := make([]*Index, 0)
+	for _, v := range Table.Indexes {
+		if v.Unique {
+			Indexes = append(Indexes, v)
+		}
+	}
+	lock.RUnlock()
+	return Indexes
+}
+
+// Gets the records other than the one given which have the key in a unique index. Entries for records which no longer exist or no longer have the key are ignored. The table lock should be held when this is called.
+func (d *DBCore) UniqueHoldersNonThreadSafe(TableIndex *Index, DatabaseName string, TableName string, IndexKey string, Key string) []string {
+	Holders := make([]string, 0)
+	Records := TableIndex.Get(d.Engine, DatabaseName, TableName, IndexKey)
+	if Records == nil {
+		return Holders
+	}
+	for _, v := range *Records {
+		if v == Key {
+			continue
+		}
+		Meta, Item := d.ReadRecordNonThreadSafe(DatabaseName, TableName, v)
+		if LiveMeta(Meta) == nil {
+			continue
+		}
+		if TableIndex.HasKey(Item, IndexKey) {
+			Holders = append(Holders, v)
+		}
+	}
+	return Holders
+}
+
+// Checks a unique index holds every record, so values can be checked against it. The table lock should be held when this is called.
+func (d *DBCore) UniqueIndexReadyNonThreadSafe(TableIndex *Index) error {
+	if TableIndex.Build != nil && d.IndexBuildFailureNonThreadSafe(TableIndex) == "" {
+		err := errors.New(`The unique index "` + TableIndex.Name + `" is being built. Please try again once it has been built.`)
+		return err
+	}
+	return nil
+}
+
+// Checks a item can be written to a record without breaking any of the unique indexes on the table. The table lock should be held when this is called.
+func (d *DBCore) CheckUniqueNonThreadSafe(Table *Table, DatabaseName string, TableName string, Key string, Item *interface{}) error {
+	for _, v := range Table.Indexes {
+		if !v.Unique {
+			continue
+		}
+		IndexKeys := v.KeysFor(Item)
+		if len(IndexKeys) != 0 {
+			if err := d.UniqueIndexReadyNonThreadSafe(v); err != nil {
+				return err
+			}
+		}
+		for _, IndexKey := range IndexKeys {
+			if len(d.UniqueHoldersNonThreadSafe(v, DatabaseName, TableName, IndexKey, Key)) != 0 {
+				return &UniqueViolationError{Index: v.Name}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the records staged in a transaction don't break any of the unique indexes. Records which are staged are checked by their staged item rather than what is in the storage engine. The tables should be locked when this is called.
+func (d *DBCore) CheckStagedUniqueNonThreadSafe(DatabaseName string, Staged []*StagedRecord) error {
+	// Gets the staged records by table and key.
+	ByKey := map[string]*StagedRecord{}
+	for _, s := range Staged {
+		ByKey[s.TableName+"\x00"+s.Key] = s
+	}
+
+	for _, s := range Staged {
+		if !s.Changed || s.Meta == nil {
+			continue
+		}
+		for _, v := range s.Table.Indexes {
+			if !v.Unique {
+				continue
+			}
+			IndexKeys := v.KeysFor(s.Item)
+			if len(IndexKeys) != 0 {
+				if err := d.UniqueIndexReadyNonThreadSafe(v); err != nil {
+					return err
+				}
+			}
+			for _, IndexKey := range IndexKeys {
+				// Checks the records which aren't staged.
+				for _, h := range d.UniqueHoldersNonThreadSafe(v, DatabaseName, s.TableName, IndexKey, s.Key) {
+					if ByKey[s.TableName+"\x00"+h] == nil {
+						return &UniqueViolationError{Index: v.Name}
+					}
+				}
+
+				// Checks the other staged records in the table.
+				for _, o := range Staged {
+					if o == s || o.TableName != s.TableName || o.Meta == nil {
+						continue
+					}
+					if v.HasKey(o.Item, IndexKey) {
+						return &UniqueViolationError{Index: v.Name}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks if a record other than the one given has the key in a unique index on this shard.
+func (d *DBCore) UniqueConflict(DatabaseName string, TableName string, IndexName string, IndexKey string, Key string) (bool, error) {
+	// Checks the table exists.
+	Table := d.Table(DatabaseName, TableName)
+	if Table == nil {
+		err := errors.New(`The table "` + TableName + `" does not exist.`)
+		return false, err
+	}
+
+	// Locks the table.
+	lock := d.GetTableLock(DatabaseName, TableName)
+	lock.RLock()
+
+	// Checks the records holding the key.
+	for _, v := range Table.Indexes {
+		if v.Name == IndexName {
+			if err := d.UniqueIndexReadyNonThreadSafe(v); err != nil {
+				lock.RUnlock()
+				return false, err
+			}
+			Conflict := len(d.UniqueHoldersNonThreadSafe(v, DatabaseName, TableName, IndexKey, Key)) != 0
+			lock.RUnlock()
+			return Conflict, nil
+		}
+	}
+
+	// The index doesn't exist.
+	lock.RUnlock()
+	err := errors.New(`The index "` + IndexName + `" does not exist.`)
+	return false, err
+}
+
+// Defines a value which has been claimed in a unique index. Owner is the token written into the claim.
+type UniqueClaim struct {
+	Key     string
+	Version uint64
+	Owner   string
+}
+
+// Gets the key of the claim for a value in a unique index. The values can hold any bytes, so they are hashed to keep the key safe for every storage engine.
+func UniqueClaimKey(DatabaseName string, TableName string, IndexName string, IndexKey string) string {
+	Hash := sha256.Sum256([]byte(DatabaseName + "\x00" + TableName + "\x00" + IndexName + "\x00" + IndexKey))
+	return hex.EncodeToString(Hash[:])
+}
+
+// The remote unique check structure.
+type RemoteUniqueCheckStructure struct {
+	DB string `json:"db"`
+	Table string `json:"table"`
+	Index string `json:"index"`
+	IndexKey string `json:"index_key"`
+	Key string `json:"key"`
+}
+
+// The response from a remote shard after a unique check.
+type RemoteUniqueCheckResponse struct {
+	Err *string `json:"error"`
+	Conflict bool `json:"conflict"`
+}
+
+// Checks if a record other than the one given has the key in a unique index on one shard.
+func (s *Shard) UniqueConflictOnShard(ShardID string, Check *RemoteUniqueCheckStructure) (bool, error) {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.UniqueConflict(Check.DB, Check.Table, Check.Index, Check.IndexKey, Check.Key)
+	}
+	var Response RemoteUniqueCheckResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/unique_check", Check, &Response)
+	if Response.Err != nil {
+		return false, RemoteError(Response.Err)
+	}
+	return Response.Conflict, nil
+}
+
+// Claims the values a item has in the unique indexes of a table and checks no other record in the cluster has them.
+// Returns the claims, which have to be released with ReleaseUnique once the record has been written. Nothing is claimed if the table has no unique indexes.
+func (s *Shard) ClaimUnique(DatabaseName string, TableName string, Key string, Item *interface{}) ([]*UniqueClaim, error) {
+	Claims := make([]*UniqueClaim, 0)
+	for _, v := range Core.UniqueIndexes(DatabaseName, TableName) {
+		for _, IndexKey := range v.KeysFor(Item) {
+			// Claims the value. If another writer holds it, they are writing the same value to another record.
+			ClaimKey := UniqueClaimKey(DatabaseName, TableName, v.Name, IndexKey)
+			Owner := uuid.Must(uuid.NewV4()).String()
+			Meta, err := s.Write("__internal", UniqueClaimsTable, ClaimKey, ToInterfacePtr(map[string]interface{}{
+				"db":    DatabaseName,
+				"table": TableName,
+				"index": v.Name,
+				"key":   Key,
+				"owner": Owner,
+			}), &WriteOptions{
+				Mode:        WriteUpsert,
+				IfNoneMatch: "*",
+				Expires:     NowMillis() + int64(UniqueClaimTimeout/time.Millisecond),
+			})
+			if err == ErrPreconditionFailed {
+				s.ReleaseUnique(Claims)
+				return nil, &UniqueViolationError{Index: v.Name}
+			}
+			if err != nil {
+				s.ReleaseUnique(Claims)
+				return nil, err
+			}
+			Claims = append(Claims, &UniqueClaim{Key: ClaimKey, Version: Meta.Version, Owner: Owner})
+
+			// Asks every shard in parallel if another record has the value.
+			Check := &RemoteUniqueCheckStructure{DB: DatabaseName, Table: TableName, Index: v.Name, IndexKey: IndexKey, Key: Key}
+			var CheckErr error
+			Conflict := false
+			CheckLock := sync.Mutex{}
+			wg := sync.WaitGroup{}
+			for _, ShardID := range s.Shards {
+				wg.Add(1)
+				go func(ShardID string) {
+					defer wg.Done()
+					c, err := s.UniqueConflictOnShard(ShardID, Check)
+					CheckLock.Lock()
+					if err != nil {
+						CheckErr = err
+					}
+					Conflict = Conflict || c
+					CheckLock.Unlock()
+				}(ShardID)
+			}
+			wg.Wait()
+			if CheckErr != nil {
+				s.ReleaseUnique(Claims)
+				return nil, CheckErr
+			}
+			if Conflict {
+				s.ReleaseUnique(Claims)
+				return nil, &UniqueViolationError{Index: v.Name}
+			}
+		}
+	}
+	return Claims, nil
+}
+
+// Deletes a unique claim on this shard if it still holds the owner token given. Nothing happens if the claim has gone or has been taken over after expiring.
+func (d *DBCore) ReleaseUniqueClaim(ClaimKey string, Owner string) error {
+	Item, Meta, err := d.GetWithMeta("__internal", UniqueClaimsTable, ClaimKey)
+	if err != nil {
+		return nil
+	}
+	Claim, ok := (*Item).(map[string]interface{})
+	if !ok || Claim["owner"] != Owner {
+		return nil
+	}
+
+	// Only deletes the claim if it hasn't changed since it was read.
+	err = d.Delete("__internal", UniqueClaimsTable, ClaimKey, &WriteOptions{IfMatch: strconv.FormatUint(Meta.Version, 10)})
+	if err == ErrPreconditionFailed {
+		return nil
+	}
+	return err
+}
+
+// The remote unique release structure.
+type RemoteUniqueReleaseStructure struct {
+	Key string `json:"key"`
+	Owner string `json:"owner"`
+}
+
+// The response from a remote shard after releasing a unique claim.
+type RemoteUniqueReleaseResponse struct {
+	Err *string `json:"error"`
+}
+
+// Releases a unique claim on one shard.
+func (s *Shard) ReleaseUniqueOnShard(ShardID string, Release *RemoteUniqueReleaseStructure) error {
+	if s.ShardURLS[ShardID] == "" {
+		return Core.ReleaseUniqueClaim(Release.Key, Release.Owner)
+	}
+	var Response RemoteUniqueReleaseResponse
+	PostToShard(s.ShardURLS[ShardID], "/_shard/unique_release", Release, &Response)
+	return RemoteError(Response.Err)
+}
+
+// Releases unique claims on every shard holding them. Each shard only deletes a claim which still holds our token, so claims which have been taken over after expiring are left alone.
+// A claim which can't be released expires after UniqueClaimTimeout.
+func (s *Shard) ReleaseUnique(Claims []*UniqueClaim) {
+	for _, v := range Claims {
+		Release := &RemoteUniqueReleaseStructure{Key: v.Key, Owner: v.Owner}
+		for _, ShardID := range HandleShardCalculation(v.Key, s.Shards, GetReplicas("__internal", UniqueClaimsTable)) {
+			_ = s.ReleaseUniqueOnShard(ShardID, Release)
+		}
+	}
+}
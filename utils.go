@@ -2,3 +2,16 @@ package main
 
 // Create a interface pointer.
 func ToInterfacePtr(I interface{}) *interface{} { return &I }
+
+// Checks if two lists of strings are the same.
+func SameStrings(A []string, B []string) bool {
+	if len(A) != len(B) {
+		return false
+	}
+	for i := range A {
+		if A[i] != B[i] {
+			return false
+		}
+	}
+	return true
+}
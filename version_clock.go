@@ -0,0 +1,90 @@
+// This hands out record versions. Every version written to a table is higher than any version the table has had before, even for a record which was deleted and written again, so a old ETag can never match a new record.
+// The last version of each table is kept in memory. So it doesn't have to be saved on every write, a ceiling is saved in the table structure a block of versions ahead, and the table carries on from the ceiling after a restart.
+
+package main
+
+import "sync"
+
+// How many versions are reserved each time the ceiling of a table is saved.
+const VersionReserve = 1 << 20
+
+// Keeps track of the last version written to each table.
+type VersionClock struct {
+	Lock      *sync.Mutex
+	Databases map[string]map[string]uint64
+}
+
+// Creates the version clock.
+func NewVersionClock() *VersionClock {
+	return &VersionClock{
+		Lock:      &sync.Mutex{},
+		Databases: map[string]map[string]uint64{},
+	}
+}
+
+// Gets the version a record should be written with. The table lock must be held when this is called.
+// A version given in the options (from the first shard holding the record) is used as it is, and moves the clock forward.
+func (d *DBCore) NextVersionNonThreadSafe(DatabaseName string, TableName string, Meta *RecordMeta, Options *WriteOptions) uint64 {
+	// Gets the ceiling saved for the table.
+	var Ceiling uint64
+	d.ArrayLock.RLock()
+	for _, db := range *d.Structure {
+		if db.Name == DatabaseName {
+			for _, table := range db.Tables {
+				if table.Name == TableName {
+					Ceiling = table.VersionCeiling
+				}
+			}
+		}
+	}
+	d.ArrayLock.RUnlock()
+
+	// Picks the version.
+	d.Versions.Lock.Lock()
+	db := d.Versions.Databases[DatabaseName]
+	if db == nil {
+		db = map[string]uint64{}
+		d.Versions.Databases[DatabaseName] = db
+	}
+	Last, ok := db[TableName]
+	if !ok {
+		// Nothing has been written since the DB core started, so everything up to the ceiling could have been used.
+		Last = Ceiling
+	}
+	Version := Options.NextVersion(Meta)
+	if Options.Version == 0 && Version <= Last {
+		Version = Last + 1
+	}
+	if Version > Last {
+		db[TableName] = Version
+	} else {
+		db[TableName] = Last
+	}
+	d.Versions.Lock.Unlock()
+
+	// Saves a new ceiling if the version has reached it.
+	if Version >= Ceiling {
+		d.SetVersionCeilingNonThreadSafe(DatabaseName, TableName, Version+VersionReserve)
+	}
+	return Version
+}
+
+// Saves the version ceiling of a table. The table lock must be held when this is called.
+func (d *DBCore) SetVersionCeilingNonThreadSafe(DatabaseName string, TableName string, Ceiling uint64) {
+	Changed := false
+	d.ArrayLock.Lock()
+	for _, db := range *d.Structure {
+		if db.Name == DatabaseName {
+			for _, table := range db.Tables {
+				if table.Name == TableName && table.VersionCeiling < Ceiling {
+					table.VersionCeiling = Ceiling
+					Changed = true
+				}
+			}
+		}
+	}
+	d.ArrayLock.Unlock()
+	if Changed {
+		d.SaveStructure()
+	}
+}
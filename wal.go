@@ -0,0 +1,292 @@
+// This is the write-ahead log for this node.
+// Every change to the data folder is written to the log and flushed to disk before the file itself is touched. If the process dies half way through writing a file, the change is still in the log and is replayed when the database boots back up.
+// Every change in the log is the full new state of a file, bytes written at a offset in a file (which cuts the file off after them) or a removal, so replaying a change more than once is harmless.
+// Files are replaced atomically when a change is applied. When the log is flushed depends on the durability mode (see durability.go).
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// The maximum size the log can grow to before it is checkpointed.
+const WALCheckpointSize = 64000000
+
+// Defines the operations which can be in the log.
+const (
+	WALWrite     = "w"
+	WALWriteAt   = "wa"
+	WALRemove    = "r"
+	WALRemoveAll = "ra"
+	WALMkdir     = "m"
+)
+
+// Defines a entry in the log.
+type WALEntry struct {
+	Op   string `json:"o"`
+	Path string `json:"p"`
+	Data []byte `json:"d,omitempty"`
+
+	// Where the data is written in the file. Only used by WALWriteAt.
+	Offset int64 `json:"off,omitempty"`
+}
+
+// Defines the write-ahead log structure.
+type WriteAheadLog struct {
+	Base           string
+	File           *os.File
+	Size           int64
+	AppendLock     *sync.Mutex
+	CheckpointLock *sync.RWMutex
+	Dirty          map[string]bool
+}
+
+// Opens the write-ahead log inside the base folder and replays anything which was left in it.
+func NewWriteAheadLog(Base string) *WriteAheadLog {
+	LogPath := path.Join(Base, "wal")
+	f, err := os.OpenFile(LogPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		panic(err)
+	}
+	w := &WriteAheadLog{
+		Base:           Base,
+		File:           f,
+		Size:           0,
+		AppendLock:     &sync.Mutex{},
+		CheckpointLock: &sync.RWMutex{},
+		Dirty:          map[string]bool{},
+	}
+	w.Replay()
+	return w
+}
+
+// Replays all the batches in the log and then checkpoints it.
+func (w *WriteAheadLog) Replay() {
+	_, err := w.File.Seek(0, io.SeekStart)
+	if err != nil {
+		panic(err)
+	}
+	Replayed := 0
+	for {
+		// Read the frame header. A short read means we hit the end of the log (or a torn write at the end of it).
+		Header := make([]byte, 8)
+		_, err := io.ReadFull(w.File, Header)
+		if err != nil {
+			break
+		}
+		Length := binary.LittleEndian.Uint32(Header[:4])
+		Checksum := binary.LittleEndian.Uint32(Header[4:])
+		Payload := make([]byte, Length)
+		_, err = io.ReadFull(w.File, Payload)
+		if err != nil {
+			break
+		}
+
+		// If the checksum doesn't match, the batch was never fully written and so was never applied. Stop here.
+		if crc32.ChecksumIEEE(Payload) != Checksum {
+			break
+		}
+		var Batch []*WALEntry
+		err = json.Unmarshal(Payload, &Batch)
+		if err != nil {
+			break
+		}
+		for _, e := range Batch {
+			w.Apply(e)
+		}
+		Replayed++
+	}
+	if Replayed != 0 {
+		println("Replayed", Replayed, "batches from the write-ahead log.")
+	}
+	w.Checkpoint()
+}
+
+// Applies a entry to the filesystem.
+func (w *WriteAheadLog) Apply(Entry *WALEntry) {
+	FullPath := path.Join(w.Base, Entry.Path)
+	switch Entry.Op {
+	case WALWrite:
+		err := os.MkdirAll(path.Dir(FullPath), 0777)
+		if err != nil {
+			panic(err)
+		}
+		// The file is flushed when the log is checkpointed, so it doesn't need flushing here.
+		err = AtomicWriteFile(FullPath, Entry.Data, false)
+		if err != nil {
+			panic(err)
+		}
+	case WALWriteAt:
+		err := os.MkdirAll(path.Dir(FullPath), 0777)
+		if err != nil {
+			panic(err)
+		}
+		f, err := os.OpenFile(FullPath, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			panic(err)
+		}
+		_, err = f.WriteAt(Entry.Data, Entry.Offset)
+		if err != nil {
+			panic(err)
+		}
+		// Cuts off anything after the data so the file is the same however many times this is replayed.
+		err = f.Truncate(Entry.Offset + int64(len(Entry.Data)))
+		if err != nil {
+			panic(err)
+		}
+		err = f.Close()
+		if err != nil {
+			panic(err)
+		}
+	case WALRemove:
+		err := os.Remove(FullPath)
+		if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	case WALRemoveAll:
+		err := os.RemoveAll(FullPath)
+		if err != nil {
+			panic(err)
+		}
+	case WALMkdir:
+		err := os.MkdirAll(FullPath, 0777)
+		if err != nil {
+			panic(err)
+		}
+	}
+	w.Dirty[FullPath] = true
+	w.Dirty[path.Dir(FullPath)] = true
+}
+
+// Gets the path relative to the base folder.
+func (w *WriteAheadLog) Relative(FullPath string) string {
+	Rel, err := filepath.Rel(w.Base, FullPath)
+	if err != nil {
+		panic(err)
+	}
+	return filepath.ToSlash(Rel)
+}
+
+// Commits a batch of entries. The batch is flushed to the log before any of it is applied, so either all of it or none of it will be replayed after a crash.
+func (w *WriteAheadLog) Commit(Batch []*WALEntry) {
+	// Stops a checkpoint happening between the batch being logged and applied.
+	w.CheckpointLock.RLock()
+
+	// Encodes the batch.
+	Payload, err := json.Marshal(Batch)
+	if err != nil {
+		panic(err)
+	}
+	Frame := make([]byte, 8+len(Payload))
+	binary.LittleEndian.PutUint32(Frame[:4], uint32(len(Payload)))
+	binary.LittleEndian.PutUint32(Frame[4:8], crc32.ChecksumIEEE(Payload))
+	copy(Frame[8:], Payload)
+
+	// Writes the batch to the log and flushes it to disk (depending on the durability mode).
+	w.AppendLock.Lock()
+	_, err = w.File.Write(Frame)
+	if err != nil {
+		panic(err)
+	}
+	SyncFile(w.File)
+	w.Size += int64(len(Frame))
+
+	// Applies the batch. This is done while holding the append lock so the dirty map is safe.
+	for _, e := range Batch {
+		w.Apply(e)
+	}
+	NeedsCheckpoint := w.Size > WALCheckpointSize
+	w.AppendLock.Unlock()
+
+	// Allows checkpoints again.
+	w.CheckpointLock.RUnlock()
+
+	// Checkpoints the log if it is getting too big.
+	if NeedsCheckpoint {
+		w.Checkpoint()
+	}
+}
+
+// Writes a file through the log.
+func (w *WriteAheadLog) WriteFile(FullPath string, Data []byte) {
+	w.Commit([]*WALEntry{{Op: WALWrite, Path: w.Relative(FullPath), Data: Data}})
+}
+
+// Appends to the end of a file through the log.
+func (w *WriteAheadLog) AppendFile(FullPath string, Data []byte) {
+	Offset := int64(0)
+	if Info, err := os.Stat(FullPath); err == nil {
+		Offset = Info.Size()
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+	w.Commit([]*WALEntry{{Op: WALWriteAt, Path: w.Relative(FullPath), Data: Data, Offset: Offset}})
+}
+
+// Removes a file through the log.
+func (w *WriteAheadLog) Remove(FullPath string) {
+	w.Commit([]*WALEntry{{Op: WALRemove, Path: w.Relative(FullPath)}})
+}
+
+// Removes a folder and everything inside of it through the log.
+func (w *WriteAheadLog) RemoveAll(FullPath string) {
+	w.Commit([]*WALEntry{{Op: WALRemoveAll, Path: w.Relative(FullPath)}})
+}
+
+// Makes a folder through the log.
+func (w *WriteAheadLog) Mkdir(FullPath string) {
+	w.Commit([]*WALEntry{{Op: WALMkdir, Path: w.Relative(FullPath)}})
+}
+
+// Flushes everything which was changed since the last checkpoint to disk and then empties the log.
+func (w *WriteAheadLog) Checkpoint() {
+	// Waits for any batches which are being applied to finish.
+	w.CheckpointLock.Lock()
+
+	// Flushes all the changed files and folders. Removed files are skipped since their parent folder is flushed.
+	for p := range w.Dirty {
+		if !DurabilityFlushes() {
+			break
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			panic(err)
+		}
+		err = f.Sync()
+		_ = f.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+	w.Dirty = map[string]bool{}
+
+	// Empties the log.
+	err := w.File.Truncate(0)
+	if err != nil {
+		panic(err)
+	}
+	_, err = w.File.Seek(0, io.SeekStart)
+	if err != nil {
+		panic(err)
+	}
+	if DurabilityFlushes() {
+		err = w.File.Sync()
+		if err != nil {
+			panic(err)
+		}
+	}
+	w.Size = 0
+
+	// Unlocks the checkpoint lock.
+	w.CheckpointLock.Unlock()
+}